@@ -0,0 +1,27 @@
+package command
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+)
+
+// configureLogger sets the level and format of the logger from the config. It
+// is called again on reload, so both can be changed without a restart.
+func configureLogger(logger *logrus.Logger, cfg *config.Config) error {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(level)
+
+	switch cfg.LogFormat {
+	case config.LogFormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package command
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/payload"
+)
+
+// LoadFunc builds the config again from the same flags, environment and config
+// file the service was started with.
+type LoadFunc func() (*config.Config, error)
+
+// reloader swaps in a freshly loaded config without restarting the service.
+type reloader struct {
+	load    LoadFunc
+	live    *config.Live
+	hosts   *host.Manager
+	payload *payload.Service
+	log     *logrus.Entry
+	// check is run on the new config before it is applied, it is not applied
+	// if the check fails
+	check func(*config.Config) error
+	// setTemplates swaps in the userdata templates of the new config
+	setTemplates func(handler.UserDataTemplates)
+}
+
+// reload loads the config and applies it. Hosts, credentials, labels,
+// profiles, userdata templates and logging take effect straight away.
+// Settings which size or locate things which were built on startup cannot
+// change, so their old values are kept and a warning is logged. If the new
+// config cannot be loaded, one of its userdata templates is broken, or its
+// runner groups are not in github, nothing changes.
+func (r reloader) reload() error {
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	old := r.live.Get()
+
+	r.keepStartupSettings(old, cfg)
+
+	templates, err := handler.LoadUserDataTemplates(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := r.check(cfg); err != nil {
+		return err
+	}
+
+	if err := configureLogger(r.log.Logger, cfg); err != nil {
+		return err
+	}
+
+	r.live.Set(cfg)
+	r.setTemplates(templates)
+	r.hosts.SetHosts(cfg.Hosts)
+	r.payload.SetSecret(cfg.WebhookSecret)
+
+	if draining := r.hosts.Draining(); len(draining) > 0 {
+		r.log.Infof("draining hosts %v, they will be removed once their runners have finished", draining)
+	}
+
+	return nil
+}
+
+// keepStartupSettings copies the settings which cannot be reloaded from the
+// old config to the new one.
+func (r reloader) keepStartupSettings(old, cfg *config.Config) {
+	changed := func(name string, differ bool) {
+		if differ {
+			r.log.Warnf("%s cannot be changed without a restart, keeping the current value", name)
+		}
+	}
+
+	changed("state file", old.StateFile != cfg.StateFile)
+	changed("queue file", old.QueueFile != cfg.QueueFile)
+	changed("queue max length", old.QueueMaxLength != cfg.QueueMaxLength)
+	changed("queue max wait", old.QueueMaxWait != cfg.QueueMaxWait)
+	changed("workers", old.Workers != cfg.Workers)
+	changed("worker queue size", old.WorkerQueueSize != cfg.WorkerQueueSize)
+	changed("worker retries", old.WorkerRetries != cfg.WorkerRetries)
+	changed("dedupe ttl", old.DedupeTTL != cfg.DedupeTTL)
+	changed("listen address", old.ListenAddress != cfg.ListenAddress)
+	changed("tls cert and key files", old.TLSCertFile != cfg.TLSCertFile || old.TLSKeyFile != cfg.TLSKeyFile)
+	changed("health check interval and timeout", old.HealthCheckInterval != cfg.HealthCheckInterval || old.HealthCheckTimeout != cfg.HealthCheckTimeout)
+	changed("reap interval", old.ReapInterval != cfg.ReapInterval)
+	changed("server timeouts", old.ReadTimeout != cfg.ReadTimeout || old.WriteTimeout != cfg.WriteTimeout || old.ShutdownTimeout != cfg.ShutdownTimeout)
+	// runners already registered in the old scope could not be removed
+	changed("runner scope", old.RunnerScope != cfg.RunnerScope || old.Enterprise != cfg.Enterprise)
+	changed("github server", old.GitHubURL != cfg.GitHubURL || old.GitHubAPIURL != cfg.GitHubAPIURL || old.CABundleFile != cfg.CABundleFile)
+
+	// a token can be swapped for another, but the github app is set up on start
+	if old.UsesGitHubApp() || cfg.UsesGitHubApp() {
+		changed("github app", old.APIToken != cfg.APIToken ||
+			old.GitHubAppID != cfg.GitHubAppID ||
+			old.GitHubAppInstallationID != cfg.GitHubAppInstallationID ||
+			old.GitHubAppPrivateKeyFile != cfg.GitHubAppPrivateKeyFile)
+
+		cfg.APIToken = old.APIToken
+		cfg.GitHubAppID = old.GitHubAppID
+		cfg.GitHubAppInstallationID = old.GitHubAppInstallationID
+		cfg.GitHubAppPrivateKeyFile = old.GitHubAppPrivateKeyFile
+	}
+
+	cfg.StateFile = old.StateFile
+	cfg.QueueFile = old.QueueFile
+	cfg.QueueMaxLength = old.QueueMaxLength
+	cfg.QueueMaxWait = old.QueueMaxWait
+	cfg.Workers = old.Workers
+	cfg.WorkerQueueSize = old.WorkerQueueSize
+	cfg.WorkerRetries = old.WorkerRetries
+	cfg.DedupeTTL = old.DedupeTTL
+	cfg.ListenAddress = old.ListenAddress
+	cfg.TLSCertFile = old.TLSCertFile
+	cfg.TLSKeyFile = old.TLSKeyFile
+	cfg.ReadTimeout = old.ReadTimeout
+	cfg.WriteTimeout = old.WriteTimeout
+	cfg.ShutdownTimeout = old.ShutdownTimeout
+	cfg.HealthCheckInterval = old.HealthCheckInterval
+	cfg.HealthCheckTimeout = old.HealthCheckTimeout
+	cfg.ReapInterval = old.ReapInterval
+	cfg.RunnerScope = old.RunnerScope
+	cfg.Enterprise = old.Enterprise
+	cfg.GitHubURL = old.GitHubURL
+	cfg.GitHubAPIURL = old.GitHubAPIURL
+	cfg.CABundleFile = old.CABundleFile
+}
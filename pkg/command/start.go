@@ -1,16 +1,35 @@
 package command
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/dedupe"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/flags"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/health"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/payload"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/server"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
+)
+
+const (
+	queueDrainInterval = 30 * time.Second
+	workerRetryBackoff = 5 * time.Second
 )
 
 func startCommand() *cli.Command {
@@ -22,37 +41,306 @@ func startCommand() *cli.Command {
 		Aliases: []string{"s"},
 		Before:  flags.ParseFlags(cfg),
 		Flags: flags.CLIFlags(
+			flags.WithConfigFileFlag(),
 			flags.WithRepoFlags(),
+			flags.WithRunnerGroupFlags(),
 			flags.WithHostsFlag(),
 			flags.WithAPITokenFlag(),
+			flags.WithGitHubAppFlags(),
+			flags.WithGitHubServerFlags(),
 			flags.WithWebhookSecretFlag(),
 			flags.WithSSHPublicKeyFlag(),
+			flags.WithLabelsFlag(),
+			flags.WithProfilesFileFlag(),
+			flags.WithStateFileFlag(),
+			flags.WithQueueFlags(),
+			flags.WithWorkerFlags(),
+			flags.WithDedupeFlag(),
+			flags.WithServerFlags(),
+			flags.WithHealthCheckFlags(),
+			flags.WithReaperFlags(),
+			flags.WithWarmPoolFlag(),
+			flags.WithLogFlags(),
 		),
 		Action: func(c *cli.Context) error {
-			return StartFn(cfg)
+			return StartFn(cfg, func() (*config.Config, error) {
+				reloaded := &config.Config{}
+				return reloaded, flags.ParseFlags(reloaded)(c)
+			})
 		},
 	}
 }
 
-func StartFn(cfg *config.Config) error {
-	// TODO: configurable logging levels
-	log := logrus.NewEntry(logrus.StandardLogger())
+// StartFn runs the service with the given config. On SIGHUP the config is built
+// again with load and applied without a restart.
+func StartFn(cfg *config.Config, load LoadFunc) error {
+	logger := logrus.StandardLogger()
+	if err := configureLogger(logger, cfg); err != nil {
+		return err
+	}
+
+	log := logrus.NewEntry(logger)
+
+	store := host.NewMemoryStore()
+	if cfg.StateFile != "" {
+		store = host.NewFileStore(cfg.StateFile)
+	}
+
+	manager, err := host.New(cfg.Hosts, store)
+	if err != nil {
+		return err
+	}
+
+	pending, err := queue.New(cfg.QueueFile, cfg.QueueMaxLength, cfg.QueueMaxWait)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// failed events stop being retried once the service is shutting down
+	workers := worker.New(cfg.WorkerQueueSize, cfg.WorkerRetries, workerRetryBackoff)
+	workers.Start(ctx, cfg.Workers)
+
+	warm := warmpool.New()
+
+	m := metrics.New()
+	m.Register(metrics.NewHostCollector(manager), metrics.NewQueueCollector(pending), metrics.NewWarmPoolCollector(warm))
+
+	live := config.NewLive(cfg)
+
+	httpClient, err := githubHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := githubTokens(live, httpClient)
+	if err != nil {
+		return err
+	}
+
+	payloadService := payload.New(cfg.WebhookSecret)
 
 	p := handler.Params{
-		Config:      cfg,
+		Config:      live,
 		L:           log,
-		HostManager: host.New(cfg.Hosts),
-		Payload:     payload.New(cfg.WebhookSecret),
+		HostManager: manager,
+		Queue:       pending,
+		Workers:     workers,
+		Seen:        dedupe.New(cfg.DedupeTTL),
+		Payload:     payloadService,
 		Client:      handler.NewFlintClient,
+		Metrics:     m,
+		Warm:        warm,
+		GitHub:      githubapi.New(cfg.APIURL(), tokens, httpClient),
 	}
 
 	h, err := handler.New(p)
 	if err != nil {
 		return err
 	}
-	http.HandleFunc("/webhook", h.HandleWebhookPost)
 
-	// TODO configurable port
-	log.Infof("starting service on localhost:3000")
-	return http.ListenAndServe(":3000", nil)
+	templates, err := handler.LoadUserDataTemplates(cfg)
+	if err != nil {
+		return err
+	}
+
+	h.SetUserDataTemplates(templates)
+
+	// make sure every runner group is there before any runners are registered,
+	// their IDs are kept for registering runners
+	if err := h.CheckRunnerGroups(context.Background(), cfg); err != nil {
+		return err
+	}
+
+	// pick up any runners which were left behind by a previous run of the
+	// service, an unreachable host should not stop us from starting though
+	if err := h.Reconcile(); err != nil {
+		log.Warnf("continuing with partial host records: %s", err)
+	}
+
+	// warm runners are kept topped up whenever the pending queue is drained,
+	// which first happens on the ticker below, so start filling them now
+	h.FillWarmPool()
+
+	// jobs which were pending before a restart, or which are waiting on a host
+	// which was down, are retried regularly as well as whenever a runner finishes
+	go func() {
+		ticker := time.NewTicker(queueDrainInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.DrainQueue()
+			}
+		}
+	}()
+
+	// runners whose completed webhook never arrived, or failed, are cleaned up
+	// regularly so they do not take up space on the hosts forever, along with
+	// any offline runners left registered with github
+	if cfg.ReapInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.ReapInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := h.Reap(ctx); err != nil {
+						log.WithError(err).Warn("reaping stale microvms did not fully succeed")
+					}
+
+					if err := h.SweepRunners(ctx); err != nil {
+						log.WithError(err).Warn("sweeping offline runners did not fully succeed")
+					}
+				}
+			}
+		}()
+	}
+
+	r := reloader{
+		load:    load,
+		live:    live,
+		hosts:   manager,
+		payload: payloadService,
+		log:     log,
+		check: func(cfg *config.Config) error {
+			return h.CheckRunnerGroups(ctx, cfg)
+		},
+		setTemplates: h.SetUserDataTemplates,
+	}
+
+	// runners on hosts which are removed are left alone to finish, and any
+	// hosts which are added may be able to take pending jobs
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Info("reloading config")
+
+			if err := r.reload(); err != nil {
+				log.Errorf("failed to reload config, keeping the current config: %s", err)
+				continue
+			}
+
+			log.Info("reloaded config")
+			h.DrainQueue()
+		}
+	}()
+
+	// the hosts are read from the live config so that reloads are picked up,
+	// draining hosts are left out since no new runners can go to them
+	checker := health.New(func() []string {
+		hosts := live.Get().Hosts
+
+		addrs := make([]string, len(hosts))
+		for i, h := range hosts {
+			addrs[i] = h.Address
+		}
+
+		return addrs
+	}, health.GRPCCheck, cfg.HealthCheckTimeout)
+
+	go checker.Run(ctx, cfg.HealthCheckInterval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", h.HandleWebhookPost)
+	mux.HandleFunc("/queue", h.HandleQueueGet)
+	mux.HandleFunc("/jobs/", h.HandleJobGet)
+	mux.HandleFunc("/healthz", checker.HandleHealthz)
+	mux.HandleFunc("/livez", checker.HandleHealthz)
+	mux.HandleFunc("/readyz", checker.HandleReadyz)
+	mux.Handle("/metrics", m.Handler())
+
+	srv, err := server.New(server.Params{
+		Address:      cfg.ListenAddress,
+		Handler:      mux,
+		TLSCertFile:  cfg.TLSCertFile,
+		TLSKeyFile:   cfg.TLSKeyFile,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		L:            log,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the error is returned once the workers are stopped, since the server not
+	// shutting down cleanly is no reason to leave microvms half created
+	err = srv.Run(ctx, cfg.ShutdownTimeout)
+
+	// no new webhooks are coming in, so finish off the events which were
+	// already accepted so that no microvms are left half created or deleted
+	stopWorkers(workers, cfg.ShutdownTimeout, log)
+
+	return err
+}
+
+// githubHTTPClient returns the http client to talk to github with, which
+// trusts the CA bundle if one is set.
+func githubHTTPClient(cfg *config.Config) (*http.Client, error) {
+	if cfg.CABundleFile == "" {
+		return githubapi.NewHTTPClient(nil)
+	}
+
+	bundle, err := os.ReadFile(cfg.CABundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca bundle: %w", err)
+	}
+
+	return githubapi.NewHTTPClient(bundle)
+}
+
+// githubTokens returns where the github client gets its tokens from: the
+// github app if one is set, otherwise the token in the live config so that a
+// new one is picked up on reload.
+func githubTokens(live *config.Live, httpClient *http.Client) (githubapi.TokenSource, error) {
+	cfg := live.Get()
+
+	if !cfg.UsesGitHubApp() {
+		return githubapi.StaticToken(func() string {
+			return live.Get().APIToken
+		}), nil
+	}
+
+	key, err := os.ReadFile(cfg.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read github app private key: %w", err)
+	}
+
+	return githubapi.NewApp(githubapi.AppParams{
+		BaseURL:        cfg.APIURL(),
+		AppID:          cfg.GitHubAppID,
+		InstallationID: cfg.GitHubAppInstallationID,
+		PrivateKey:     key,
+		HTTPClient:     httpClient,
+	})
+}
+
+// stopWorkers waits up to timeout for the worker pool to finish everything it
+// was given.
+func stopWorkers(workers *worker.Pool, timeout time.Duration, log *logrus.Entry) {
+	log.Info("waiting for webhook events in flight to be processed")
+
+	done := make(chan struct{})
+
+	go func() {
+		workers.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("all webhook events processed, shut down cleanly")
+	case <-time.After(timeout):
+		log.Warn("timed out waiting for webhook events to be processed, some microvms may need to be cleaned up by hand")
+	}
 }
@@ -1,17 +1,335 @@
 package config
 
-// Config stores the parsed flag opt values for use by the commands
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultGitHubURL is the address of github.com.
+const DefaultGitHubURL = "https://github.com"
+
+// DefaultRunnerDownloadURL is where runner releases are downloaded from
+// github.com.
+const DefaultRunnerDownloadURL = "https://github.com/actions/runner/releases/download"
+
+// ghesAPIPath is where a GitHub Enterprise Server serves its api.
+const ghesAPIPath = "/api/v3"
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Config stores the parsed flag opt values, merged with any set in the config
+// file, for use by the commands
 type Config struct {
 	// Username is the user or org which owns the repo
 	Username string
-	// Repository is the name of the repo
+	// Repository is the name of the repo. Along with Username it allows jobs
+	// from a single repo, more can be allowed with AllowedRepos.
 	Repository string
-	// Hosts is a slice of addresses + ports of any number of flintlock servers
-	Hosts []string
-	// APIToken is the Github PAT with repo scope
+	// AllowedRepos are the repos, as owner/name, which jobs are accepted from.
+	// owner/* allows every repo the owner has.
+	AllowedRepos []string
+	// RunnerScope is where runners are registered: with their job's repo, its
+	// org, or the enterprise
+	RunnerScope string
+	// Enterprise is the slug of the enterprise to register runners with when
+	// RunnerScope is enterprise
+	Enterprise string
+	// RunnerGroup is the runner group runners are registered in when neither
+	// their profile nor their repo name one. When empty the default group is
+	// used.
+	RunnerGroup string
+	// RepoRunnerGroups are the runner groups which runners for jobs from each
+	// repo, given as owner/name or owner/*, are registered in
+	RepoRunnerGroups map[string]string
+	// Hosts is a slice of any number of flintlock servers
+	Hosts []Host
+	// APIToken is the Github PAT with repo scope. Either this or a github app
+	// must be set.
 	APIToken string
+	// GitHubAppID, GitHubAppInstallationID and GitHubAppPrivateKeyFile are the
+	// github app to authenticate as instead of a PAT
+	GitHubAppID             int64
+	GitHubAppInstallationID int64
+	GitHubAppPrivateKeyFile string
+	// GitHubURL is the address of github, which is a GitHub Enterprise Server
+	// when it is not DefaultGitHubURL
+	GitHubURL string
+	// GitHubAPIURL is the address of github's api. When empty it is worked out
+	// from GitHubURL, see APIURL.
+	GitHubAPIURL string
+	// CABundleFile is a PEM file of certificates to trust as well as the
+	// system's when talking to github. MicroVMs are made to trust them too.
+	CABundleFile string
+	// RunnerDownloadURL is where the runner release is downloaded from by
+	// MicroVMs, laid out like github's releases of actions/runner
+	RunnerDownloadURL string
+	// Labels are the runs-on labels which this service will create runners for.
+	// Jobs asking for any other label are left for other runners to pick up.
+	Labels []string
+	// Profiles are the MicroVM shapes which jobs can ask for with their labels.
+	// Jobs which match no profile get the default MicroVM.
+	Profiles []Profile
 	// SSHPublicKey is the pub key to add to MicroVMs
 	SSHPublicKey string
 	// WebhookSecret is a plaintext string for extra auth to the github runner webhook
 	WebhookSecret string
+	// StateFile is the path to the file where runner to host assignments are
+	// saved. When empty, assignments are only kept in memory.
+	StateFile string
+	// QueueFile is the path to the file where jobs waiting for a host with
+	// enough capacity are saved. When empty, pending jobs are only kept in memory.
+	QueueFile string
+	// QueueMaxLength is the most jobs which can be pending at once
+	QueueMaxLength int
+	// QueueMaxWait is how long a job can be pending before it is dropped
+	QueueMaxWait time.Duration
+	// Workers is how many webhook events can be processed at once
+	Workers int
+	// WorkerQueueSize is how many webhook events can wait for a free worker
+	WorkerQueueSize int
+	// WorkerRetries is how many times processing an event is retried if it fails
+	WorkerRetries int
+	// DedupeTTL is how long webhook deliveries and jobs are remembered for, so
+	// that redeliveries of the same event are ignored
+	DedupeTTL time.Duration
+	// ListenAddress is the host:port the service listens on
+	ListenAddress string
+	// TLSCertFile and TLSKeyFile are the certificate and key to serve HTTPS
+	// with. When empty, plain HTTP is served.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ReadTimeout is how long a client has to send its whole request
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a request has to be answered
+	WriteTimeout time.Duration
+	// ShutdownTimeout is how long to wait for requests and events which are in
+	// flight to finish when the service is stopped
+	ShutdownTimeout time.Duration
+	// HealthCheckInterval is how often every host is checked to see whether the
+	// service is ready
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is how long a host has to answer a health check
+	HealthCheckTimeout time.Duration
+	// ReapInterval is how often every host is checked for MicroVMs which should
+	// be deleted. 0 turns the reaper off.
+	ReapInterval time.Duration
+	// MaxLifetime is how long a MicroVM can run before the reaper deletes it,
+	// whether or not its job has finished. 0 means there is no limit.
+	MaxLifetime time.Duration
+	// ReapCheckGitHub has the reaper ask github whether each MicroVM's job has
+	// completed, and delete it if so
+	ReapCheckGitHub bool
+	// ReapDryRun has the reaper log what it would delete without deleting it
+	ReapDryRun bool
+	// WarmPoolSize is how many runners with the default MicroVM are kept booted
+	// ahead of time, ready for jobs. Profiles set their own with WarmPool.
+	WarmPoolSize int
+	// LogLevel is the least severe level which is logged, eg. info
+	LogLevel string
+	// LogFormat is either text or json
+	LogFormat string
+}
+
+// Host is a flintlock server which MicroVMs can be created on, along with how
+// much it is allowed to run at once. Zero values for any of the limits mean
+// that resource is not limited.
+type Host struct {
+	// Address is the address + port of the flintlock server
+	Address string `yaml:"address"`
+	// VCPU is the total number of vCPUs which can be given to MicroVMs
+	VCPU int `yaml:"vcpu,omitempty"`
+	// MemoryMiB is the total memory in MiB which can be given to MicroVMs
+	MemoryMiB int `yaml:"memory,omitempty"`
+	// MaxMicroVMs is the maximum number of MicroVMs which can run at once
+	MaxMicroVMs int `yaml:"maxMicroVMs,omitempty"`
+}
+
+// Validate checks that everything the service needs has been set, wherever it
+// was set from, and that nothing is out of range.
+func (c *Config) Validate() error {
+	if err := c.validateRepos(); err != nil {
+		return err
+	}
+
+	if err := c.validateGitHubAuth(); err != nil {
+		return err
+	}
+
+	if err := c.validateGitHubServer(); err != nil {
+		return err
+	}
+
+	if len(c.Hosts) == 0 {
+		return errors.New("at least one host must be set")
+	}
+
+	addresses := map[string]bool{}
+
+	for i, h := range c.Hosts {
+		if h.Address == "" {
+			return fmt.Errorf("hosts[%d]: address must not be empty", i)
+		}
+
+		if addresses[h.Address] {
+			return fmt.Errorf("hosts[%d]: address %s is used more than once", i, h.Address)
+		}
+
+		addresses[h.Address] = true
+
+		if h.VCPU < 0 || h.MemoryMiB < 0 || h.MaxMicroVMs < 0 {
+			return fmt.Errorf("hosts[%d]: limits must not be negative", i)
+		}
+	}
+
+	if err := ValidateProfiles(c.Profiles); err != nil {
+		return err
+	}
+
+	if err := c.validateProfilesFit(); err != nil {
+		return err
+	}
+
+	if err := c.validateRunnerGroups(); err != nil {
+		return err
+	}
+
+	switch {
+	case c.QueueMaxLength < 0:
+		return errors.New("queue max length must not be negative")
+	case c.QueueMaxWait < 0:
+		return errors.New("queue max wait must not be negative")
+	case c.Workers < 1:
+		return errors.New("workers must be at least 1")
+	case c.WorkerQueueSize < 1:
+		return errors.New("worker queue size must be at least 1")
+	case c.WorkerRetries < 0:
+		return errors.New("worker retries must not be negative")
+	case c.DedupeTTL < 0:
+		return errors.New("dedupe ttl must not be negative")
+	case c.ListenAddress == "":
+		return errors.New("listen address must be set")
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == ""):
+		return errors.New("tls cert file and tls key file must be set together")
+	case c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.ShutdownTimeout < 0:
+		return errors.New("server timeouts must not be negative")
+	case c.HealthCheckInterval <= 0:
+		return errors.New("health check interval must be more than 0")
+	case c.HealthCheckTimeout <= 0:
+		return errors.New("health check timeout must be more than 0")
+	case c.ReapInterval < 0:
+		return errors.New("reap interval must not be negative")
+	case c.MaxLifetime < 0:
+		return errors.New("max lifetime must not be negative")
+	case c.WarmPoolSize < 0:
+		return errors.New("warm pool size must not be negative")
+	}
+
+	if _, ok := c.WarmPoolRepo(); !ok && len(c.WarmPoolSizes()) > 0 {
+		return errors.New("warm pools need runners to be registered with a single repo, an org which owns every allowed repo, or an enterprise")
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log level %q is not valid", c.LogLevel)
+	}
+
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("log format must be %s or %s, not %q", LogFormatText, LogFormatJSON, c.LogFormat)
+	}
+
+	return nil
+}
+
+// UsesGitHubApp reports whether the service authenticates as a github app
+// rather than with a token.
+func (c *Config) UsesGitHubApp() bool {
+	return c.GitHubAppID != 0
+}
+
+// APIURL returns the address of the github api: GitHubAPIURL when it is set,
+// or else where a GitHub Enterprise Server at GitHubURL serves it. It is empty
+// for github.com, whose api is at its own address.
+func (c *Config) APIURL() string {
+	if c.GitHubAPIURL != "" {
+		return c.GitHubAPIURL
+	}
+
+	if c.GitHubURL == "" || strings.TrimSuffix(c.GitHubURL, "/") == DefaultGitHubURL {
+		return ""
+	}
+
+	return strings.TrimSuffix(c.GitHubURL, "/") + ghesAPIPath
+}
+
+// validateGitHubServer checks that every github address is an absolute http
+// or https url.
+func (c *Config) validateGitHubServer() error {
+	for _, u := range []struct{ name, value string }{
+		{name: "github url", value: c.GitHubURL},
+		{name: "github api url", value: c.GitHubAPIURL},
+		{name: "runner download url", value: c.RunnerDownloadURL},
+	} {
+		if u.value == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(u.value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s %q must be an absolute http or https url", u.name, u.value)
+		}
+	}
+
+	return nil
+}
+
+// validateProfilesFit checks that every profile's MicroVM fits on at least one
+// empty host, so that its jobs are not left pending forever. Sizes which a
+// profile leaves to the default MicroVM are not known here, so are not
+// checked.
+func (c *Config) validateProfilesFit() error {
+	for _, p := range c.Profiles {
+		fits := false
+
+		for _, h := range c.Hosts {
+			if (h.VCPU == 0 || p.VCPU <= h.VCPU) && (h.MemoryMiB == 0 || p.MemoryMiB <= h.MemoryMiB) {
+				fits = true
+				break
+			}
+		}
+
+		if !fits {
+			return fmt.Errorf("profile %q: larger than every host", p.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateGitHubAuth checks that exactly one of a token or a whole github app
+// has been set.
+func (c *Config) validateGitHubAuth() error {
+	app := c.GitHubAppID != 0 || c.GitHubAppInstallationID != 0 || c.GitHubAppPrivateKeyFile != ""
+
+	switch {
+	case c.APIToken == "" && !app:
+		return errors.New("token or github app must be set")
+	case c.APIToken != "" && app:
+		return errors.New("token and github app must not both be set")
+	case c.APIToken != "":
+		return nil
+	case c.GitHubAppID < 0 || c.GitHubAppInstallationID < 0:
+		return errors.New("github app and installation ids must not be negative")
+	case c.GitHubAppID == 0 || c.GitHubAppInstallationID == 0 || c.GitHubAppPrivateKeyFile == "":
+		return errors.New("github app id, installation id and private key file must be set together")
+	}
+
+	return nil
 }
@@ -0,0 +1,43 @@
+package config_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+)
+
+func TestConfig_APIURL(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name     string
+		cfg      config.Config
+		expected string
+	}{
+		{
+			name: "github.com, its own api is used",
+			cfg:  config.Config{GitHubURL: config.DefaultGitHubURL},
+		},
+		{
+			name: "no url, github.com's api is used",
+		},
+		{
+			name:     "a GitHub Enterprise Server, its api is under its own address",
+			cfg:      config.Config{GitHubURL: "https://github.example.com/"},
+			expected: "https://github.example.com/api/v3",
+		},
+		{
+			name:     "an api url, it wins",
+			cfg:      config.Config{GitHubURL: "https://github.example.com", GitHubAPIURL: "https://api.github.example.com"},
+			expected: "https://api.github.example.com",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			g.Expect(tc.cfg.APIURL()).To(Equal(tc.expected))
+		})
+	}
+}
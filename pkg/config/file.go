@@ -0,0 +1,152 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileVersion is the version of the config file schema which this build
+// understands.
+const FileVersion = "v1"
+
+// File is the schema of the config file. Everything apart from the version is
+// optional, anything which is left out comes from flags, environment variables
+// or defaults instead. JSON is valid YAML, so files can be written in either.
+type File struct {
+	// Version is the version of the schema the file was written for
+	Version string `yaml:"version"`
+	// User is the github user or org which owns the repo
+	User string `yaml:"user,omitempty"`
+	// Repo is the name of the github repo
+	Repo string `yaml:"repo,omitempty"`
+	// AllowedRepos are more repos to accept jobs from, as owner/name or owner/*
+	AllowedRepos []string `yaml:"allowedRepos,omitempty"`
+	// RunnerScope is where runners are registered: repo, org or enterprise
+	RunnerScope string `yaml:"runnerScope,omitempty"`
+	// Enterprise is the slug of the enterprise to register runners with
+	Enterprise string `yaml:"enterprise,omitempty"`
+	// RunnerGroup is the runner group to register runners in
+	RunnerGroup string `yaml:"runnerGroup,omitempty"`
+	// RepoRunnerGroups are the runner groups for runners of each repo, keyed by
+	// owner/name or owner/*
+	RepoRunnerGroups map[string]string `yaml:"repoRunnerGroups,omitempty"`
+	// Token is the github API token with repo scope
+	Token string `yaml:"token,omitempty"`
+	// GitHubApp is the github app to authenticate as instead of a token
+	GitHubApp FileGitHubApp `yaml:"githubApp,omitempty"`
+	// GitHubServer is where github is, when it is not github.com
+	GitHubServer FileGitHubServer `yaml:"githubServer,omitempty"`
+	// RunnerDownloadURL is where MicroVMs download the runner release from
+	RunnerDownloadURL string `yaml:"runnerDownloadURL,omitempty"`
+	// Secret is the plaintext secret set for the webhook
+	Secret string `yaml:"secret,omitempty"`
+	// SSHPublicKey is the pub key to add to MicroVMs
+	SSHPublicKey string `yaml:"sshPublicKey,omitempty"`
+	// Labels are the runs-on labels to create runners for
+	Labels []string `yaml:"labels,omitempty"`
+	// Hosts are the flintlock servers to create MicroVMs on
+	Hosts []Host `yaml:"hosts,omitempty"`
+	// Profiles are the MicroVM shapes which jobs can select with their labels
+	Profiles []Profile `yaml:"profiles,omitempty"`
+	// StateFile is where runner to host assignments are saved
+	StateFile string `yaml:"stateFile,omitempty"`
+	// Queue configures the queue of jobs waiting for host capacity
+	Queue FileQueue `yaml:"queue,omitempty"`
+	// Workers configures the pool which processes webhook events
+	Workers FileWorkers `yaml:"workers,omitempty"`
+	// DedupeTTL is how long webhook deliveries are remembered for
+	DedupeTTL *time.Duration `yaml:"dedupeTTL,omitempty"`
+	// Server configures how webhooks are served
+	Server FileServer `yaml:"server,omitempty"`
+	// HealthCheck configures how hosts are checked for readiness
+	HealthCheck FileHealthCheck `yaml:"healthCheck,omitempty"`
+	// Reaper configures the cleanup of stale MicroVMs
+	Reaper FileReaper `yaml:"reaper,omitempty"`
+	// WarmPool is how many runners with the default MicroVM are kept booted
+	WarmPool *int `yaml:"warmPool,omitempty"`
+	// Log configures what is logged and how
+	Log FileLog `yaml:"log,omitempty"`
+}
+
+// FileGitHubApp is the github app section of the config file.
+type FileGitHubApp struct {
+	AppID          int64  `yaml:"appID,omitempty"`
+	InstallationID int64  `yaml:"installationID,omitempty"`
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+}
+
+// FileGitHubServer is the github server section of the config file.
+type FileGitHubServer struct {
+	URL          string `yaml:"url,omitempty"`
+	APIURL       string `yaml:"apiURL,omitempty"`
+	CABundleFile string `yaml:"caBundleFile,omitempty"`
+}
+
+// FileQueue is the pending job queue section of the config file. Numbers are
+// pointers so that an explicit 0, meaning no limit, can be told apart from
+// the setting being left out.
+type FileQueue struct {
+	File      string         `yaml:"file,omitempty"`
+	MaxLength *int           `yaml:"maxLength,omitempty"`
+	MaxWait   *time.Duration `yaml:"maxWait,omitempty"`
+}
+
+// FileWorkers is the worker pool section of the config file.
+type FileWorkers struct {
+	Count     *int `yaml:"count,omitempty"`
+	QueueSize *int `yaml:"queueSize,omitempty"`
+	Retries   *int `yaml:"retries,omitempty"`
+}
+
+// FileServer is the webhook server section of the config file.
+type FileServer struct {
+	Address         string         `yaml:"address,omitempty"`
+	TLSCertFile     string         `yaml:"tlsCertFile,omitempty"`
+	TLSKeyFile      string         `yaml:"tlsKeyFile,omitempty"`
+	ReadTimeout     *time.Duration `yaml:"readTimeout,omitempty"`
+	WriteTimeout    *time.Duration `yaml:"writeTimeout,omitempty"`
+	ShutdownTimeout *time.Duration `yaml:"shutdownTimeout,omitempty"`
+}
+
+// FileHealthCheck is the host health check section of the config file.
+type FileHealthCheck struct {
+	Interval *time.Duration `yaml:"interval,omitempty"`
+	Timeout  *time.Duration `yaml:"timeout,omitempty"`
+}
+
+// FileReaper is the stale MicroVM reaper section of the config file.
+type FileReaper struct {
+	Interval    *time.Duration `yaml:"interval,omitempty"`
+	MaxLifetime *time.Duration `yaml:"maxLifetime,omitempty"`
+	CheckGitHub *bool          `yaml:"checkGitHub,omitempty"`
+	DryRun      *bool          `yaml:"dryRun,omitempty"`
+}
+
+// FileLog is the logging section of the config file.
+type FileLog struct {
+	Level  string `yaml:"level,omitempty"`
+	Format string `yaml:"format,omitempty"`
+}
+
+// LoadFile reads the config file at path. Unknown fields and versions are
+// rejected rather than ignored, so that mistakes are not silently missed.
+func LoadFile(path string) (*File, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var f File
+	if err := yaml.UnmarshalStrict(dat, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if f.Version != FileVersion {
+		return nil, fmt.Errorf("config file %s: unsupported version %q, expected %q", path, f.Version, FileVersion)
+	}
+
+	return &f, nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RunnerGroupFor returns the name of the runner group which runners for jobs
+// from the repo, given as owner/name, with the profile are registered in. The
+// profile's group wins over the repo's, which wins over RunnerGroup. An empty
+// name is the default group.
+func (c *Config) RunnerGroupFor(repo string, profile Profile) string {
+	if profile.RunnerGroup != "" {
+		return profile.RunnerGroup
+	}
+
+	var (
+		owner, name, _ = strings.Cut(repo, "/")
+		wildcard       string
+	)
+
+	for r, group := range c.RepoRunnerGroups {
+		groupOwner, groupName, _ := strings.Cut(r, "/")
+		if !strings.EqualFold(owner, groupOwner) {
+			continue
+		}
+
+		if strings.EqualFold(name, groupName) {
+			return group
+		}
+
+		if groupName == anyRepo {
+			wildcard = group
+		}
+	}
+
+	if wildcard != "" {
+		return wildcard
+	}
+
+	return c.RunnerGroup
+}
+
+// usesRunnerGroups returns true if any runners are registered in a group other
+// than the default one.
+func (c *Config) usesRunnerGroups() bool {
+	if c.RunnerGroup != "" || len(c.RepoRunnerGroups) > 0 {
+		return true
+	}
+
+	for _, p := range c.Profiles {
+		if p.RunnerGroup != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRunnerGroups checks that runner groups are only used where github
+// has them, and that every repo given a group is allowed. Whether the groups
+// exist can only be checked with github.
+func (c *Config) validateRunnerGroups() error {
+	if !c.usesRunnerGroups() {
+		return nil
+	}
+
+	if c.RunnerScope == ScopeRepo {
+		return errors.New("runner groups can only be used when runners are registered with an org or the enterprise")
+	}
+
+	repos := make([]string, 0, len(c.RepoRunnerGroups))
+	for r := range c.RepoRunnerGroups {
+		repos = append(repos, r)
+	}
+
+	sort.Strings(repos)
+
+	for _, r := range repos {
+		if c.RepoRunnerGroups[r] == "" {
+			return fmt.Errorf("repoRunnerGroups[%s]: runner group must not be empty", r)
+		}
+
+		if !c.ownerOrRepoAllowed(r) {
+			return fmt.Errorf("repoRunnerGroups[%s]: repo must be an allowed repo, as owner/name or owner/*", r)
+		}
+	}
+
+	return nil
+}
+
+// ownerOrRepoAllowed returns true if the repo, given as owner/name, is allowed
+// or, for owner/*, if any of the owner's repos are.
+func (c *Config) ownerOrRepoAllowed(repo string) bool {
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok || strings.Contains(name, "/") {
+		return false
+	}
+
+	if name != anyRepo {
+		return c.RepoAllowed(repo)
+	}
+
+	for _, allowed := range c.Repos() {
+		if allowedOwner, _, _ := strings.Cut(allowed, "/"); strings.EqualFold(owner, allowedOwner) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,28 @@
+package config
+
+import "sync/atomic"
+
+// Live holds the current Config so that it can be swapped for a reloaded one
+// while it is being read. A Config must not be changed once it has been Set,
+// reloading always sets a whole new one.
+type Live struct {
+	cfg atomic.Pointer[Config]
+}
+
+// NewLive returns a Live holding cfg.
+func NewLive(cfg *Config) *Live {
+	l := &Live{}
+	l.Set(cfg)
+
+	return l
+}
+
+// Get returns the current Config.
+func (l *Live) Get() *Config {
+	return l.cfg.Load()
+}
+
+// Set replaces the current Config.
+func (l *Live) Set(cfg *Config) {
+	l.cfg.Store(cfg)
+}
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// InterfaceMACVTAP is a network interface backed by macvtap
+	InterfaceMACVTAP = "macvtap"
+	// InterfaceTAP is a network interface backed by a tap device
+	InterfaceTAP = "tap"
+)
+
+// Profile is a named MicroVM shape which is used for jobs asking for all of
+// its labels. Anything which is left out falls back to the default MicroVM.
+type Profile struct {
+	// Name is the unique name of the profile
+	Name string `yaml:"name"`
+	// Labels are the runs-on labels which select this profile. When empty the
+	// profile is selected by its name.
+	Labels []string `yaml:"labels,omitempty"`
+	// VCPU is how many vCPUs the MicroVM gets
+	VCPU int `yaml:"vcpu,omitempty"`
+	// MemoryMiB is how much memory in MiB the MicroVM gets
+	MemoryMiB int `yaml:"memory,omitempty"`
+	// KernelImage is the container image holding the kernel
+	KernelImage string `yaml:"kernelImage,omitempty"`
+	// KernelFilename is the path of the kernel binary within the kernel image
+	KernelFilename string `yaml:"kernelFilename,omitempty"`
+	// RootVolumeImage is the container image used as the root volume
+	RootVolumeImage string `yaml:"rootVolumeImage,omitempty"`
+	// Volumes are attached to the MicroVM as well as the root volume
+	Volumes []Volume `yaml:"volumes,omitempty"`
+	// Interfaces replace the default network interfaces of the MicroVM
+	Interfaces []Interface `yaml:"interfaces,omitempty"`
+	// MaxLifetime is how long the MicroVM can run before it is deleted, in
+	// place of the global max lifetime. 0 means the global one is used.
+	MaxLifetime time.Duration `yaml:"maxLifetime,omitempty"`
+	// WarmPool is how many runners with this profile are kept booted ahead of
+	// time, ready for jobs
+	WarmPool int `yaml:"warmPool,omitempty"`
+	// RunnerGroup is the runner group the profile's runners are registered in,
+	// in place of the repo's or the global one
+	RunnerGroup string `yaml:"runnerGroup,omitempty"`
+	// UserDataTemplateFile is a text/template file which replaces the script
+	// the MicroVM starts its runner with
+	UserDataTemplateFile string `yaml:"userDataTemplateFile,omitempty"`
+}
+
+// Volume is an extra volume for a MicroVM, sourced from a container image.
+type Volume struct {
+	// ID is the unique name of the volume within the MicroVM
+	ID string `yaml:"id"`
+	// Image is the container image the volume is created from
+	Image string `yaml:"image"`
+	// ReadOnly mounts the volume read only
+	ReadOnly bool `yaml:"readOnly,omitempty"`
+	// SizeMiB resizes the volume, when zero it is left at the size of the image
+	SizeMiB int `yaml:"size,omitempty"`
+}
+
+// Interface is a network interface for a MicroVM.
+type Interface struct {
+	// DeviceID is the unique name of the interface on the host
+	DeviceID string `yaml:"deviceId"`
+	// Type is either macvtap (the default) or tap
+	Type string `yaml:"type,omitempty"`
+	// GuestMAC is the MAC address of the interface, generated when empty
+	GuestMAC string `yaml:"guestMac,omitempty"`
+	// Address is a static address in CIDR notation, DHCP is used when empty
+	Address string `yaml:"address,omitempty"`
+	// Gateway is the default gateway to use with a static address
+	Gateway string `yaml:"gateway,omitempty"`
+	// Nameservers are the DNS servers to use with a static address
+	Nameservers []string `yaml:"nameservers,omitempty"`
+}
+
+// SelectedBy returns the labels which select the profile.
+func (p Profile) SelectedBy() []string {
+	if len(p.Labels) == 0 {
+		return []string{p.Name}
+	}
+
+	return p.Labels
+}
+
+type profilesFile struct {
+	Profiles []Profile `yaml:"profiles"`
+}
+
+// LoadProfiles reads and validates the profiles in the YAML file at path.
+func LoadProfiles(path string) ([]Profile, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file: %w", err)
+	}
+
+	var f profilesFile
+	if err := yaml.UnmarshalStrict(dat, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file %s: %w", path, err)
+	}
+
+	if err := ValidateProfiles(f.Profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+
+	return f.Profiles, nil
+}
+
+// ValidateProfiles checks that every profile is complete and that no two
+// profiles share a name or are selected by the same labels.
+func ValidateProfiles(profiles []Profile) error {
+	var (
+		names     = map[string]bool{}
+		selectors = map[string]string{}
+	)
+
+	for i, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profiles[%d]: name must not be empty", i)
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("profile %q: name is used more than once", p.Name)
+		}
+
+		names[p.Name] = true
+
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+
+		key := selectorKey(p.SelectedBy())
+		if other, ok := selectors[key]; ok {
+			return fmt.Errorf("profile %q: selected by the same labels as profile %q", p.Name, other)
+		}
+
+		selectors[key] = p.Name
+	}
+
+	return nil
+}
+
+func (p Profile) validate() error {
+	if p.VCPU < 0 {
+		return errors.New("vcpu must not be negative")
+	}
+
+	if p.MemoryMiB < 0 {
+		return errors.New("memory must not be negative")
+	}
+
+	if p.MaxLifetime < 0 {
+		return errors.New("max lifetime must not be negative")
+	}
+
+	if p.WarmPool < 0 {
+		return errors.New("warm pool must not be negative")
+	}
+
+	for _, l := range p.Labels {
+		if strings.TrimSpace(l) == "" {
+			return errors.New("labels must not be empty")
+		}
+	}
+
+	volumes := map[string]bool{"root": true}
+
+	for i, v := range p.Volumes {
+		if v.ID == "" {
+			return fmt.Errorf("volumes[%d]: id must not be empty", i)
+		}
+
+		if volumes[v.ID] {
+			return fmt.Errorf("volumes[%d]: id %q is already in use", i, v.ID)
+		}
+
+		volumes[v.ID] = true
+
+		if v.Image == "" {
+			return fmt.Errorf("volumes[%d]: image must not be empty", i)
+		}
+
+		if v.SizeMiB < 0 {
+			return fmt.Errorf("volumes[%d]: size must not be negative", i)
+		}
+	}
+
+	devices := map[string]bool{}
+
+	for i, iface := range p.Interfaces {
+		if iface.DeviceID == "" {
+			return fmt.Errorf("interfaces[%d]: deviceId must not be empty", i)
+		}
+
+		if devices[iface.DeviceID] {
+			return fmt.Errorf("interfaces[%d]: deviceId %q is already in use", i, iface.DeviceID)
+		}
+
+		devices[iface.DeviceID] = true
+
+		switch iface.Type {
+		case "", InterfaceMACVTAP, InterfaceTAP:
+		default:
+			return fmt.Errorf("interfaces[%d]: type must be %s or %s, got %q", i, InterfaceMACVTAP, InterfaceTAP, iface.Type)
+		}
+
+		if iface.GuestMAC != "" {
+			if _, err := net.ParseMAC(iface.GuestMAC); err != nil {
+				return fmt.Errorf("interfaces[%d]: invalid guestMac: %w", i, err)
+			}
+		}
+
+		if iface.Address != "" {
+			if _, _, err := net.ParseCIDR(iface.Address); err != nil {
+				return fmt.Errorf("interfaces[%d]: address must be in CIDR notation: %w", i, err)
+			}
+		}
+
+		if iface.Address == "" && (iface.Gateway != "" || len(iface.Nameservers) > 0) {
+			return fmt.Errorf("interfaces[%d]: gateway and nameservers can only be set with an address", i)
+		}
+
+		if iface.Gateway != "" && net.ParseIP(iface.Gateway) == nil {
+			return fmt.Errorf("interfaces[%d]: invalid gateway %q", i, iface.Gateway)
+		}
+	}
+
+	return nil
+}
+
+// SelectProfile returns the profile for a job with the given labels. A profile
+// is a match if the job asks for every one of its labels, and when more than
+// one matches the one with the most labels wins, or the first of those if
+// they have as many labels. It returns false if there is no match. Labels are
+// compared without regard to case.
+func SelectProfile(profiles []Profile, labels []string) (Profile, bool) {
+	asked := map[string]bool{}
+	for _, l := range labels {
+		asked[strings.ToLower(l)] = true
+	}
+
+	var (
+		best  Profile
+		found bool
+	)
+
+	for _, p := range profiles {
+		selectedBy := p.SelectedBy()
+
+		if !containsAll(asked, selectedBy) {
+			continue
+		}
+
+		if !found || len(selectedBy) > len(best.SelectedBy()) {
+			best = p
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func containsAll(set map[string]bool, labels []string) bool {
+	for _, l := range labels {
+		if !set[strings.ToLower(l)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selectorKey returns the same key for the same set of labels, whatever their
+// order or case.
+func selectorKey(labels []string) string {
+	set := map[string]bool{}
+	for _, l := range labels {
+		set[strings.ToLower(l)] = true
+	}
+
+	keys := make([]string, 0, len(set))
+	for l := range set {
+		keys = append(keys, l)
+	}
+
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
+
+// MaxLifetimeFor returns how long a MicroVM created with the named profile can
+// run for. This is the profile's max lifetime if it has one, otherwise the
+// global one. Profiles which no longer exist get the global one.
+func (c *Config) MaxLifetimeFor(profile string) time.Duration {
+	if p := c.ProfileNamed(profile); p.MaxLifetime > 0 {
+		return p.MaxLifetime
+	}
+
+	return c.MaxLifetime
+}
+
+// WarmPoolSizes returns how many warm runners to keep for each profile which
+// has a warm pool. The default MicroVM is the empty profile.
+func (c *Config) WarmPoolSizes() map[string]int {
+	sizes := map[string]int{}
+
+	if c.WarmPoolSize > 0 {
+		sizes[""] = c.WarmPoolSize
+	}
+
+	for _, p := range c.Profiles {
+		if p.WarmPool > 0 {
+			sizes[p.Name] = p.WarmPool
+		}
+	}
+
+	return sizes
+}
+
+// ProfileNamed returns the profile with the given name. The empty name, and
+// any profile which no longer exists, is the default MicroVM.
+func (c *Config) ProfileNamed(name string) Profile {
+	for _, p := range c.Profiles {
+		if p.Name == name && name != "" {
+			return p
+		}
+	}
+
+	return Profile{}
+}
@@ -0,0 +1,259 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	g := NewWithT(t)
+
+	path := writeFile(t, `
+profiles:
+- name: large
+  vcpu: 8
+  memory: 16384
+  maxLifetime: 2h
+- name: arm64-build
+  labels: [arm64, build]
+  kernelImage: kernel:arm64
+  rootVolumeImage: root:arm64
+  volumes:
+  - id: cache
+    image: cache:latest
+    size: 1024
+  interfaces:
+  - deviceId: eth1
+    type: tap
+    address: 10.0.0.2/24
+    gateway: 10.0.0.1
+`)
+
+	profiles, err := config.LoadProfiles(path)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(profiles).To(Equal([]config.Profile{
+		{Name: "large", VCPU: 8, MemoryMiB: 16384, MaxLifetime: 2 * time.Hour},
+		{
+			Name:            "arm64-build",
+			Labels:          []string{"arm64", "build"},
+			KernelImage:     "kernel:arm64",
+			RootVolumeImage: "root:arm64",
+			Volumes:         []config.Volume{{ID: "cache", Image: "cache:latest", SizeMiB: 1024}},
+			Interfaces:      []config.Interface{{DeviceID: "eth1", Type: "tap", Address: "10.0.0.2/24", Gateway: "10.0.0.1"}},
+		},
+	}))
+}
+
+func TestLoadProfiles_Errors(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := config.LoadProfiles(filepath.Join(t.TempDir(), "missing.yaml"))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to read profiles file")))
+
+	_, err = config.LoadProfiles(writeFile(t, "profiles:\n- name: large\n  cpus: 8\n"))
+	g.Expect(err).To(MatchError(ContainSubstring("field cpus not found")))
+
+	_, err = config.LoadProfiles(writeFile(t, "profiles:\n- name: large\n  vcpu: -1\n"))
+	g.Expect(err).To(MatchError(ContainSubstring(`profile "large": vcpu must not be negative`)))
+}
+
+func TestValidateProfiles(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		profiles    []config.Profile
+		expectedErr string
+	}{
+		{
+			name:     "valid profiles",
+			profiles: []config.Profile{{Name: "small", VCPU: 1}, {Name: "large", Labels: []string{"big"}}},
+		},
+		{
+			name:        "profiles must have a name",
+			profiles:    []config.Profile{{VCPU: 1}},
+			expectedErr: "profiles[0]: name must not be empty",
+		},
+		{
+			name:        "names must be unique",
+			profiles:    []config.Profile{{Name: "small"}, {Name: "small", Labels: []string{"tiny"}}},
+			expectedErr: `profile "small": name is used more than once`,
+		},
+		{
+			name:        "profiles cannot be selected by the same labels",
+			profiles:    []config.Profile{{Name: "a", Labels: []string{"x", "y"}}, {Name: "b", Labels: []string{"Y", "x"}}},
+			expectedErr: `profile "b": selected by the same labels as profile "a"`,
+		},
+		{
+			name:        "memory must not be negative",
+			profiles:    []config.Profile{{Name: "a", MemoryMiB: -1}},
+			expectedErr: "memory must not be negative",
+		},
+		{
+			name:        "max lifetime must not be negative",
+			profiles:    []config.Profile{{Name: "a", MaxLifetime: -time.Hour}},
+			expectedErr: "max lifetime must not be negative",
+		},
+		{
+			name:        "warm pool must not be negative",
+			profiles:    []config.Profile{{Name: "a", WarmPool: -1}},
+			expectedErr: "warm pool must not be negative",
+		},
+		{
+			name:        "labels must not be blank",
+			profiles:    []config.Profile{{Name: "a", Labels: []string{" "}}},
+			expectedErr: "labels must not be empty",
+		},
+		{
+			name:        "volumes need an image",
+			profiles:    []config.Profile{{Name: "a", Volumes: []config.Volume{{ID: "data"}}}},
+			expectedErr: "volumes[0]: image must not be empty",
+		},
+		{
+			name:        "volumes cannot replace the root volume",
+			profiles:    []config.Profile{{Name: "a", Volumes: []config.Volume{{ID: "root", Image: "img"}}}},
+			expectedErr: `volumes[0]: id "root" is already in use`,
+		},
+		{
+			name:        "interfaces need a device id",
+			profiles:    []config.Profile{{Name: "a", Interfaces: []config.Interface{{}}}},
+			expectedErr: "interfaces[0]: deviceId must not be empty",
+		},
+		{
+			name:        "interfaces must have a known type",
+			profiles:    []config.Profile{{Name: "a", Interfaces: []config.Interface{{DeviceID: "eth1", Type: "bridge"}}}},
+			expectedErr: `interfaces[0]: type must be macvtap or tap, got "bridge"`,
+		},
+		{
+			name:        "static addresses must be CIDRs",
+			profiles:    []config.Profile{{Name: "a", Interfaces: []config.Interface{{DeviceID: "eth1", Address: "10.0.0.2"}}}},
+			expectedErr: "interfaces[0]: address must be in CIDR notation",
+		},
+		{
+			name:        "gateways need a static address",
+			profiles:    []config.Profile{{Name: "a", Interfaces: []config.Interface{{DeviceID: "eth1", Gateway: "10.0.0.1"}}}},
+			expectedErr: "interfaces[0]: gateway and nameservers can only be set with an address",
+		},
+		{
+			name:        "mac addresses must be valid",
+			profiles:    []config.Profile{{Name: "a", Interfaces: []config.Interface{{DeviceID: "eth1", GuestMAC: "nope"}}}},
+			expectedErr: "interfaces[0]: invalid guestMac",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := config.ValidateProfiles(tc.profiles)
+			if tc.expectedErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+		})
+	}
+}
+
+func TestMaxLifetimeFor(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := &config.Config{
+		MaxLifetime: 6 * time.Hour,
+		Profiles: []config.Profile{
+			{Name: "short", MaxLifetime: time.Hour},
+			{Name: "default"},
+		},
+	}
+
+	g.Expect(cfg.MaxLifetimeFor("short")).To(Equal(time.Hour))
+	// profiles without their own max lifetime use the global one
+	g.Expect(cfg.MaxLifetimeFor("default")).To(Equal(6 * time.Hour))
+	// as do MicroVMs without a profile, or whose profile has been removed
+	g.Expect(cfg.MaxLifetimeFor("")).To(Equal(6 * time.Hour))
+	g.Expect(cfg.MaxLifetimeFor("removed")).To(Equal(6 * time.Hour))
+}
+
+func TestWarmPoolSizes(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := &config.Config{
+		WarmPoolSize: 2,
+		Profiles: []config.Profile{
+			{Name: "small", WarmPool: 3},
+			{Name: "large"},
+		},
+	}
+
+	// the default MicroVM is the empty profile, and profiles without a warm
+	// pool are left out
+	g.Expect(cfg.WarmPoolSizes()).To(Equal(map[string]int{"": 2, "small": 3}))
+
+	cfg.WarmPoolSize = 0
+	g.Expect(cfg.WarmPoolSizes()).To(Equal(map[string]int{"small": 3}))
+}
+
+func TestSelectProfile(t *testing.T) {
+	g := NewWithT(t)
+
+	profiles := []config.Profile{
+		{Name: "small"},
+		{Name: "large"},
+		{Name: "gpu"},
+		{Name: "large-gpu", Labels: []string{"large", "gpu"}},
+	}
+
+	tt := []struct {
+		name     string
+		labels   []string
+		expected string
+	}{
+		{
+			name:     "no profile labels gives no profile",
+			labels:   []string{"self-hosted"},
+			expected: "",
+		},
+		{
+			name:     "a profile is selected by its name",
+			labels:   []string{"self-hosted", "small"},
+			expected: "small",
+		},
+		{
+			name:     "labels are compared without case",
+			labels:   []string{"self-hosted", "LARGE"},
+			expected: "large",
+		},
+		{
+			name:     "the profile matching the most labels wins",
+			labels:   []string{"gpu", "self-hosted", "large"},
+			expected: "large-gpu",
+		},
+		{
+			name:     "the first profile wins a tie",
+			labels:   []string{"gpu", "small"},
+			expected: "small",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			profile, ok := config.SelectProfile(profiles, tc.labels)
+			g.Expect(ok).To(Equal(tc.expected != ""))
+			g.Expect(profile.Name).To(Equal(tc.expected))
+		})
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	g.Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+
+	return path
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Runner scopes
+const (
+	ScopeRepo       = "repo"
+	ScopeOrg        = "org"
+	ScopeEnterprise = "enterprise"
+)
+
+// anyRepo is the name which allows every repo an owner has, eg. owner/*.
+const anyRepo = "*"
+
+// Repos returns every allowed repo, including the one given by Username and
+// Repository.
+func (c *Config) Repos() []string {
+	repos := append([]string{}, c.AllowedRepos...)
+
+	if c.Username != "" && c.Repository != "" {
+		repos = append(repos, c.Username+"/"+c.Repository)
+	}
+
+	return repos
+}
+
+// RepoAllowed returns true if jobs from the repo, given as owner/name, are
+// accepted. Names are compared without regard to case, as github does.
+func (c *Config) RepoAllowed(repo string) bool {
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok {
+		return false
+	}
+
+	for _, allowed := range c.Repos() {
+		allowedOwner, allowedName, _ := strings.Cut(allowed, "/")
+
+		if strings.EqualFold(owner, allowedOwner) && (allowedName == anyRepo || strings.EqualFold(name, allowedName)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WarmPoolRepo returns the repo, as owner/name, which warm runners are
+// registered for. They are created before there is a job to take the repo
+// from, so can only be used when every allowed repo registers its runners in
+// the same place: the enterprise, an org which owns every allowed repo, or the
+// only allowed repo.
+func (c *Config) WarmPoolRepo() (string, bool) {
+	repos := c.Repos()
+	if len(repos) == 0 {
+		return "", false
+	}
+
+	switch c.RunnerScope {
+	case ScopeEnterprise:
+		return repos[0], true
+	case ScopeOrg:
+		owner, _, _ := strings.Cut(repos[0], "/")
+
+		for _, r := range repos[1:] {
+			if other, _, _ := strings.Cut(r, "/"); !strings.EqualFold(owner, other) {
+				return "", false
+			}
+		}
+
+		return repos[0], true
+	default:
+		if _, name, _ := strings.Cut(repos[0], "/"); len(repos) == 1 && name != anyRepo {
+			return repos[0], true
+		}
+	}
+
+	return "", false
+}
+
+// validateRepos checks that at least one repo is allowed, that every allowed
+// repo is well formed, and that runners can be registered where they are
+// meant to be.
+func (c *Config) validateRepos() error {
+	if (c.Username == "") != (c.Repository == "") {
+		return errors.New("user and repo must be set together")
+	}
+
+	if len(c.Repos()) == 0 {
+		return errors.New("at least one repo must be allowed, set user and repo or allowed repos")
+	}
+
+	for i, r := range c.AllowedRepos {
+		owner, name, ok := strings.Cut(r, "/")
+		if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("allowedRepos[%d]: %q must be owner/name or owner/*", i, r)
+		}
+	}
+
+	switch c.RunnerScope {
+	case ScopeRepo, ScopeOrg:
+	case ScopeEnterprise:
+		if c.Enterprise == "" {
+			return errors.New("enterprise must be set when runners are registered with the enterprise")
+		}
+	default:
+		return fmt.Errorf("runner scope must be %s, %s or %s, not %q", ScopeRepo, ScopeOrg, ScopeEnterprise, c.RunnerScope)
+	}
+
+	return nil
+}
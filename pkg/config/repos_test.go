@@ -0,0 +1,114 @@
+package config_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+)
+
+func TestConfig_RepoAllowed(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := &config.Config{
+		Username:     "foo",
+		Repository:   "bar",
+		AllowedRepos: []string{"baz/qux", "acme/*"},
+	}
+
+	tt := []struct {
+		repo     string
+		expected bool
+	}{
+		{repo: "foo/bar", expected: true},
+		{repo: "baz/qux", expected: true},
+		{repo: "Baz/QUX", expected: true},
+		{repo: "acme/anything", expected: true},
+		{repo: "foo/other"},
+		{repo: "baz"},
+		{repo: ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.repo, func(t *testing.T) {
+			g.Expect(cfg.RepoAllowed(tc.repo)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestConfig_WarmPoolRepo(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name         string
+		cfg          config.Config
+		expectedRepo string
+	}{
+		{
+			name:         "a single repo, runners go to it",
+			cfg:          config.Config{Username: "foo", Repository: "bar", RunnerScope: config.ScopeRepo},
+			expectedRepo: "foo/bar",
+		},
+		{
+			name: "many repos, there is no single repo for runners",
+			cfg:  config.Config{Username: "foo", Repository: "bar", AllowedRepos: []string{"foo/baz"}, RunnerScope: config.ScopeRepo},
+		},
+		{
+			name: "a wildcard repo, there is no single repo for runners",
+			cfg:  config.Config{AllowedRepos: []string{"foo/*"}, RunnerScope: config.ScopeRepo},
+		},
+		{
+			name:         "an org which owns every repo, runners go to the org",
+			cfg:          config.Config{AllowedRepos: []string{"foo/*", "Foo/baz"}, RunnerScope: config.ScopeOrg},
+			expectedRepo: "foo/*",
+		},
+		{
+			name: "repos in many orgs, there is no single org for runners",
+			cfg:  config.Config{AllowedRepos: []string{"foo/bar", "baz/qux"}, RunnerScope: config.ScopeOrg},
+		},
+		{
+			name:         "the enterprise, runners go to it whatever the repos",
+			cfg:          config.Config{AllowedRepos: []string{"foo/bar", "baz/qux"}, RunnerScope: config.ScopeEnterprise, Enterprise: "acme"},
+			expectedRepo: "foo/bar",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, ok := tc.cfg.WarmPoolRepo()
+			g.Expect(ok).To(Equal(tc.expectedRepo != ""))
+			g.Expect(repo).To(Equal(tc.expectedRepo))
+		})
+	}
+}
+
+func TestConfig_RunnerGroupFor(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := &config.Config{
+		RunnerGroup: "everyone",
+		RepoRunnerGroups: map[string]string{
+			"foo/bar": "bar-group",
+			"foo/*":   "foo-group",
+		},
+	}
+
+	tt := []struct {
+		name     string
+		repo     string
+		profile  config.Profile
+		expected string
+	}{
+		{name: "the repo's group", repo: "Foo/Bar", expected: "bar-group"},
+		{name: "the owner's group", repo: "foo/baz", expected: "foo-group"},
+		{name: "the global group", repo: "other/repo", expected: "everyone"},
+		{name: "the profile's group wins", repo: "foo/bar", profile: config.Profile{RunnerGroup: "gpus"}, expected: "gpus"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			g.Expect(cfg.RunnerGroupFor(tc.repo, tc.profile)).To(Equal(tc.expected))
+		})
+	}
+}
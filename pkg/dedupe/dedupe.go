@@ -0,0 +1,72 @@
+package dedupe
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache remembers keys for a while so that repeats of the same thing can be
+// spotted. It is safe for concurrent use.
+type Cache struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// New returns a new Cache which remembers each key for ttl.
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:  ttl,
+		seen: map[string]time.Time{},
+	}
+}
+
+// Seen records all of the keys and reports whether any of them had already
+// been recorded within the ttl. Checking and recording happen atomically, so
+// of several concurrent calls with the same key only one will return false.
+func (c *Cache) Seen(keys ...string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+
+	found := false
+
+	for _, key := range keys {
+		if _, ok := c.seen[key]; ok {
+			found = true
+		}
+	}
+
+	if found {
+		return true
+	}
+
+	for _, key := range keys {
+		c.seen[key] = now
+	}
+
+	return false
+}
+
+// Forget removes the keys, so that they will not count as seen next time.
+func (c *Cache) Forget(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		delete(c.seen, key)
+	}
+}
+
+// prune drops every key which was recorded longer than the ttl ago. The caller
+// must hold the lock.
+func (c *Cache) prune(now time.Time) {
+	for key, at := range c.seen {
+		if now.Sub(at) > c.ttl {
+			delete(c.seen, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package dedupe_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/dedupe"
+)
+
+func Test_CacheSeen(t *testing.T) {
+	g := NewWithT(t)
+
+	c := dedupe.New(time.Hour)
+
+	g.Expect(c.Seen("a", "b")).To(BeFalse())
+	g.Expect(c.Seen("a")).To(BeTrue())
+	g.Expect(c.Seen("b", "c")).To(BeTrue())
+	// nothing is recorded when a key was already seen
+	g.Expect(c.Seen("c")).To(BeFalse())
+}
+
+func Test_CacheForget(t *testing.T) {
+	g := NewWithT(t)
+
+	c := dedupe.New(time.Hour)
+
+	g.Expect(c.Seen("a", "b")).To(BeFalse())
+	c.Forget("a", "b")
+	g.Expect(c.Seen("a", "b")).To(BeFalse())
+}
+
+func Test_CacheExpires(t *testing.T) {
+	g := NewWithT(t)
+
+	c := dedupe.New(10 * time.Millisecond)
+
+	g.Expect(c.Seen("a")).To(BeFalse())
+	time.Sleep(20 * time.Millisecond)
+	g.Expect(c.Seen("a")).To(BeFalse())
+}
+
+func Test_CacheConcurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		c     = dedupe.New(time.Hour)
+		wg    sync.WaitGroup
+		fresh int32
+	)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if !c.Seen("a") {
+				atomic.AddInt32(&fresh, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	g.Expect(atomic.LoadInt32(&fresh)).To(Equal(int32(1)))
+}
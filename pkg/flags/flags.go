@@ -1,6 +1,11 @@
 package flags
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/urfave/cli/v2"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
 )
@@ -21,30 +26,169 @@ func CLIFlags(options ...WithFlagsFunc) []cli.Flag {
 	return flags
 }
 
+// envPrefix is put in front of a flag's name to get the environment variable
+// which can be used instead of it.
+const envPrefix = "MICROVM_ACTION_RUNNER_"
+
+const (
+	configFlag   = "config"
+	userFlag     = "user"
+	repoFlag     = "repo"
+	hostsFlag    = "hosts"
+	tokenFlag    = "token"
+	secretFlag   = "secret"
+	keyFlag      = "key"
+	labelsFlag   = "labels"
+	profilesFlag = "profiles-file"
+	stateFlag    = "state-file"
+
+	allowedReposFlag = "allowed-repos"
+	runnerScopeFlag  = "runner-scope"
+	enterpriseFlag   = "enterprise"
+
+	runnerGroupFlag      = "runner-group"
+	repoRunnerGroupsFlag = "repo-runner-groups"
+
+	githubAppIDFlag             = "github-app-id"
+	githubAppInstallationIDFlag = "github-app-installation-id"
+	githubAppPrivateKeyFileFlag = "github-app-private-key-file"
+
+	githubURLFlag         = "github-url"
+	githubAPIURLFlag      = "github-api-url"
+	caBundleFileFlag      = "ca-bundle-file"
+	runnerDownloadURLFlag = "runner-download-url"
+
+	queueFileFlag      = "queue-file"
+	queueMaxLengthFlag = "queue-max-length"
+	queueMaxWaitFlag   = "queue-max-wait"
+
+	workersFlag         = "workers"
+	workerQueueSizeFlag = "worker-queue-size"
+	workerRetriesFlag   = "worker-retries"
+
+	dedupeTTLFlag = "dedupe-ttl"
+
+	listenAddressFlag   = "listen-address"
+	tlsCertFileFlag     = "tls-cert-file"
+	tlsKeyFileFlag      = "tls-key-file"
+	readTimeoutFlag     = "read-timeout"
+	writeTimeoutFlag    = "write-timeout"
+	shutdownTimeoutFlag = "shutdown-timeout"
+
+	healthCheckIntervalFlag = "health-check-interval"
+	healthCheckTimeoutFlag  = "health-check-timeout"
+
+	reapIntervalFlag    = "reap-interval"
+	maxLifetimeFlag     = "max-lifetime"
+	reapCheckGitHubFlag = "reap-check-github"
+	reapDryRunFlag      = "reap-dry-run"
+
+	warmPoolSizeFlag = "warm-pool-size"
+
+	logLevelFlag  = "log-level"
+	logFormatFlag = "log-format"
+)
+
 const (
-	userFlag   = "user"
-	repoFlag   = "repo"
-	hostsFlag  = "hosts"
-	tokenFlag  = "token"
-	secretFlag = "secret"
-	keyFlag    = "key"
+	defaultRunnerScope = config.ScopeRepo
+
+	defaultQueueMaxLength = 100
+	defaultQueueMaxWait   = time.Hour
+
+	defaultWorkers         = 4
+	defaultWorkerQueueSize = 100
+	defaultWorkerRetries   = 3
+
+	defaultDedupeTTL = 24 * time.Hour
+
+	defaultListenAddress   = ":3000"
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = 30 * time.Second
+	defaultShutdownTimeout = 2 * time.Minute
+
+	defaultHealthCheckInterval = 15 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+
+	defaultReapInterval = 10 * time.Minute
+
+	defaultLogLevel  = "info"
+	defaultLogFormat = config.LogFormatText
 )
 
-// WithRepoFlags adds the github user and repo flags to the command.
+// WithConfigFileFlag adds the config file flag to the command.
+func WithConfigFileFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     configFlag,
+				Aliases:  []string{"c"},
+				EnvVars:  envVars(configFlag),
+				Usage:    "yaml or json config file, any flags or environment variables which are set take precedence over it",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithRepoFlags adds the flags for which github repos jobs are accepted from,
+// and where their runners are registered, to the command.
 func WithRepoFlags() WithFlagsFunc {
 	return func() []cli.Flag {
 		return []cli.Flag{
 			&cli.StringFlag{
 				Name:     userFlag,
+				EnvVars:  envVars(userFlag),
 				Aliases:  []string{"u"},
 				Usage:    "the github username or org for the repo",
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     repoFlag,
+				EnvVars:  envVars(repoFlag),
 				Aliases:  []string{"r"},
 				Usage:    "the github repo name",
-				Required: true,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     allowedReposFlag,
+				EnvVars:  envVars(allowedReposFlag),
+				Usage:    "repos to accept jobs from as well as the one given by user and repo, as owner/name or owner/* for all of an owner's repos",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     runnerScopeFlag,
+				EnvVars:  envVars(runnerScopeFlag),
+				Usage:    "where to register runners, with the job's repo, its org, or the enterprise",
+				Value:    defaultRunnerScope,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     enterpriseFlag,
+				EnvVars:  envVars(enterpriseFlag),
+				Usage:    "the slug of the enterprise to register runners with when --runner-scope is enterprise",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithRunnerGroupFlags adds the flags for which runner groups runners are
+// registered in to the command.
+func WithRunnerGroupFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     runnerGroupFlag,
+				EnvVars:  envVars(runnerGroupFlag),
+				Usage:    "the org or enterprise runner group to register runners in, unless their repo or profile names another (default: the default group)",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     repoRunnerGroupsFlag,
+				EnvVars:  envVars(repoRunnerGroupsFlag),
+				Aliases:  []string{"repo-runner-group"},
+				Usage:    "the runner group to register runners for jobs from a repo in, as owner/name=group or owner/*=group",
+				Required: false,
 			},
 		}
 	}
@@ -56,9 +200,10 @@ func WithHostsFlag() WithFlagsFunc {
 		return []cli.Flag{
 			&cli.StringSliceFlag{
 				Name:     hostsFlag,
+				EnvVars:  envVars(hostsFlag),
 				Aliases:  []string{"host"},
-				Usage:    "a list of flintlock server addresses (eg. 1.2.3.4:9090)",
-				Required: true,
+				Usage:    "a list of flintlock server addresses with optional capacity limits (eg. 1.2.3.4:9090 or '1.2.3.4:9090;vcpu=16;memory=32768;max-microvms=8')",
+				Required: false,
 			},
 		}
 	}
@@ -70,9 +215,72 @@ func WithAPITokenFlag() WithFlagsFunc {
 		return []cli.Flag{
 			&cli.StringFlag{
 				Name:     tokenFlag,
+				EnvVars:  envVars(tokenFlag),
 				Aliases:  []string{"t"},
 				Usage:    "github API token with repo scope",
-				Required: true,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithGitHubAppFlags adds the flags for authenticating as a github app instead
+// of with a token to the command.
+func WithGitHubAppFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.Int64Flag{
+				Name:     githubAppIDFlag,
+				EnvVars:  envVars(githubAppIDFlag),
+				Usage:    "the ID of the github app to authenticate as instead of using a token",
+				Required: false,
+			},
+			&cli.Int64Flag{
+				Name:     githubAppInstallationIDFlag,
+				EnvVars:  envVars(githubAppInstallationIDFlag),
+				Usage:    "the ID of the github app's installation on the user or org",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     githubAppPrivateKeyFileFlag,
+				EnvVars:  envVars(githubAppPrivateKeyFileFlag),
+				Usage:    "the PEM file with the github app's private key",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithGitHubServerFlags adds the flags for talking to a GitHub Enterprise
+// Server instead of github.com to the command.
+func WithGitHubServerFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     githubURLFlag,
+				EnvVars:  envVars(githubURLFlag),
+				Usage:    "the address of github, set to a GitHub Enterprise Server's to use it instead of github.com",
+				Value:    config.DefaultGitHubURL,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     githubAPIURLFlag,
+				EnvVars:  envVars(githubAPIURLFlag),
+				Usage:    "the address of github's api (default: api.github.com, or --github-url plus /api/v3 for a GitHub Enterprise Server)",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     caBundleFileFlag,
+				EnvVars:  envVars(caBundleFileFlag),
+				Usage:    "PEM file of CA certificates to trust when talking to github, which MicroVMs are made to trust as well",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     runnerDownloadURLFlag,
+				EnvVars:  envVars(runnerDownloadURLFlag),
+				Usage:    "where MicroVMs download the runner from, a mirror laid out like github's actions/runner releases",
+				Value:    config.DefaultRunnerDownloadURL,
+				Required: false,
 			},
 		}
 	}
@@ -84,6 +292,7 @@ func WithWebhookSecretFlag() WithFlagsFunc {
 		return []cli.Flag{
 			&cli.StringFlag{
 				Name:     secretFlag,
+				EnvVars:  envVars(secretFlag),
 				Aliases:  []string{"s"},
 				Usage:    "the plaintext secret set for the webhook",
 				Required: false,
@@ -98,6 +307,7 @@ func WithSSHPublicKeyFlag() WithFlagsFunc {
 		return []cli.Flag{
 			&cli.StringFlag{
 				Name:     keyFlag,
+				EnvVars:  envVars(keyFlag),
 				Aliases:  []string{"k"},
 				Usage:    "public ssh key for microvm access",
 				Required: false,
@@ -106,17 +316,609 @@ func WithSSHPublicKeyFlag() WithFlagsFunc {
 	}
 }
 
+// WithLabelsFlag adds the runner labels flag to the command.
+func WithLabelsFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     labelsFlag,
+				EnvVars:  envVars(labelsFlag),
+				Aliases:  []string{"label"},
+				Usage:    "the runs-on labels to create runners for, jobs asking for any other labels are ignored",
+				Value:    cli.NewStringSlice("self-hosted"),
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithProfilesFileFlag adds the MicroVM profiles file flag to the command.
+func WithProfilesFileFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     profilesFlag,
+				EnvVars:  envVars(profilesFlag),
+				Usage:    "yaml file of named microvm profiles which jobs can select with their labels (default: every runner gets the same microvm)",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithStateFileFlag adds the host assignment state file flag to the command.
+func WithStateFileFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     stateFlag,
+				EnvVars:  envVars(stateFlag),
+				Usage:    "file to persist runner to host assignments in, so they survive restarts (default: in memory only)",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithQueueFlags adds the pending job queue flags to the command.
+func WithQueueFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     queueFileFlag,
+				EnvVars:  envVars(queueFileFlag),
+				Usage:    "file to persist jobs waiting for host capacity in, so they survive restarts (default: in memory only)",
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     queueMaxLengthFlag,
+				EnvVars:  envVars(queueMaxLengthFlag),
+				Usage:    "the maximum number of jobs which can wait for host capacity, 0 for no limit",
+				Value:    defaultQueueMaxLength,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     queueMaxWaitFlag,
+				EnvVars:  envVars(queueMaxWaitFlag),
+				Usage:    "how long a job can wait for host capacity before it is dropped, 0 for no limit",
+				Value:    defaultQueueMaxWait,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithWorkerFlags adds the flags for the pool which processes webhook events
+// to the command.
+func WithWorkerFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.IntFlag{
+				Name:     workersFlag,
+				EnvVars:  envVars(workersFlag),
+				Usage:    "the number of webhook events which can be processed at once",
+				Value:    defaultWorkers,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     workerQueueSizeFlag,
+				EnvVars:  envVars(workerQueueSizeFlag),
+				Usage:    "the number of webhook events which can wait to be processed before new ones are turned away",
+				Value:    defaultWorkerQueueSize,
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     workerRetriesFlag,
+				EnvVars:  envVars(workerRetriesFlag),
+				Usage:    "the number of times processing a webhook event is retried if it fails",
+				Value:    defaultWorkerRetries,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithDedupeFlag adds the flag for how long events are remembered to spot
+// duplicates to the command.
+func WithDedupeFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.DurationFlag{
+				Name:     dedupeTTLFlag,
+				EnvVars:  envVars(dedupeTTLFlag),
+				Usage:    "how long webhook deliveries are remembered for, so that redeliveries are ignored",
+				Value:    defaultDedupeTTL,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithServerFlags adds the flags for how webhooks are served to the command.
+func WithServerFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     listenAddressFlag,
+				EnvVars:  envVars(listenAddressFlag),
+				Usage:    "the address to listen for webhooks on",
+				Value:    defaultListenAddress,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     tlsCertFileFlag,
+				EnvVars:  envVars(tlsCertFileFlag),
+				Usage:    "PEM certificate to serve https with, changes to the file are picked up without a restart (default: serve http)",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     tlsKeyFileFlag,
+				EnvVars:  envVars(tlsKeyFileFlag),
+				Usage:    "PEM key for the --tls-cert-file",
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     readTimeoutFlag,
+				EnvVars:  envVars(readTimeoutFlag),
+				Usage:    "how long a client has to send its whole request",
+				Value:    defaultReadTimeout,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     writeTimeoutFlag,
+				EnvVars:  envVars(writeTimeoutFlag),
+				Usage:    "how long a request has to be answered",
+				Value:    defaultWriteTimeout,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     shutdownTimeoutFlag,
+				EnvVars:  envVars(shutdownTimeoutFlag),
+				Usage:    "how long to wait on shutdown for requests and webhook events in flight to finish",
+				Value:    defaultShutdownTimeout,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithHealthCheckFlags adds the flags for checking the flintlock hosts to the
+// command.
+func WithHealthCheckFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.DurationFlag{
+				Name:     healthCheckIntervalFlag,
+				EnvVars:  envVars(healthCheckIntervalFlag),
+				Usage:    "how often to check the flintlock hosts for /readyz",
+				Value:    defaultHealthCheckInterval,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     healthCheckTimeoutFlag,
+				EnvVars:  envVars(healthCheckTimeoutFlag),
+				Usage:    "how long a flintlock host has to answer a health check",
+				Value:    defaultHealthCheckTimeout,
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithReaperFlags adds the flags for cleaning up stale MicroVMs to the command.
+func WithReaperFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.DurationFlag{
+				Name:     reapIntervalFlag,
+				EnvVars:  envVars(reapIntervalFlag),
+				Usage:    "how often to look for MicroVMs which should have been deleted, 0 to never look",
+				Value:    defaultReapInterval,
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     maxLifetimeFlag,
+				EnvVars:  envVars(maxLifetimeFlag),
+				Usage:    "delete MicroVMs which have been running for longer than this, 0 for no limit",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     reapCheckGitHubFlag,
+				EnvVars:  envVars(reapCheckGitHubFlag),
+				Usage:    "ask github for the status of each MicroVM's job, and delete the MicroVM once it has completed",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     reapDryRunFlag,
+				EnvVars:  envVars(reapDryRunFlag),
+				Usage:    "only log the MicroVMs which would be deleted",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithWarmPoolFlag adds the flag for how many runners to keep booted ahead of
+// time to the command.
+func WithWarmPoolFlag() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.IntFlag{
+				Name:     warmPoolSizeFlag,
+				EnvVars:  envVars(warmPoolSizeFlag),
+				Usage:    "how many runners with the default MicroVM to keep booted ahead of time, profiles set their own with warmPool",
+				Required: false,
+			},
+		}
+	}
+}
+
+// WithLogFlags adds the logging flags to the command.
+func WithLogFlags() WithFlagsFunc {
+	return func() []cli.Flag {
+		return []cli.Flag{
+			&cli.StringFlag{
+				Name:     logLevelFlag,
+				EnvVars:  envVars(logLevelFlag),
+				Usage:    "the least severe level to log, one of trace, debug, info, warn or error",
+				Value:    defaultLogLevel,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     logFormatFlag,
+				EnvVars:  envVars(logFormatFlag),
+				Usage:    "how to write log lines, text or json",
+				Value:    defaultLogFormat,
+				Required: false,
+			},
+		}
+	}
+}
+
 // ParseFlags processes all flags on the CLI context and builds a config object
-// which will be used in the command's action.
+// which will be used in the command's action. Values come from, in order of
+// precedence: flags, environment variables, the config file and then the flag
+// defaults. The merged config is validated before it is returned.
 func ParseFlags(cfg *config.Config) cli.BeforeFunc {
 	return func(ctx *cli.Context) error {
+		hosts, err := parseHosts(ctx.StringSlice(hostsFlag))
+		if err != nil {
+			return err
+		}
+
+		repoGroups, err := parseRepoRunnerGroups(ctx.StringSlice(repoRunnerGroupsFlag))
+		if err != nil {
+			return err
+		}
+
+		if path := ctx.String(profilesFlag); path != "" {
+			profiles, err := config.LoadProfiles(path)
+			if err != nil {
+				return err
+			}
+
+			cfg.Profiles = profiles
+		}
+
 		cfg.Repository = ctx.String(repoFlag)
 		cfg.Username = ctx.String(userFlag)
-		cfg.Hosts = ctx.StringSlice(hostsFlag)
+		cfg.AllowedRepos = ctx.StringSlice(allowedReposFlag)
+		cfg.RunnerScope = ctx.String(runnerScopeFlag)
+		cfg.Enterprise = ctx.String(enterpriseFlag)
+		cfg.RunnerGroup = ctx.String(runnerGroupFlag)
+		cfg.RepoRunnerGroups = repoGroups
+		cfg.Hosts = hosts
 		cfg.APIToken = ctx.String(tokenFlag)
+		cfg.GitHubAppID = ctx.Int64(githubAppIDFlag)
+		cfg.GitHubAppInstallationID = ctx.Int64(githubAppInstallationIDFlag)
+		cfg.GitHubAppPrivateKeyFile = ctx.String(githubAppPrivateKeyFileFlag)
+		cfg.GitHubURL = ctx.String(githubURLFlag)
+		cfg.GitHubAPIURL = ctx.String(githubAPIURLFlag)
+		cfg.CABundleFile = ctx.String(caBundleFileFlag)
+		cfg.RunnerDownloadURL = ctx.String(runnerDownloadURLFlag)
 		cfg.WebhookSecret = ctx.String(secretFlag)
 		cfg.SSHPublicKey = ctx.String(keyFlag)
+		cfg.Labels = ctx.StringSlice(labelsFlag)
+		cfg.StateFile = ctx.String(stateFlag)
+		cfg.QueueFile = ctx.String(queueFileFlag)
+		cfg.QueueMaxLength = ctx.Int(queueMaxLengthFlag)
+		cfg.QueueMaxWait = ctx.Duration(queueMaxWaitFlag)
+		cfg.Workers = ctx.Int(workersFlag)
+		cfg.WorkerQueueSize = ctx.Int(workerQueueSizeFlag)
+		cfg.WorkerRetries = ctx.Int(workerRetriesFlag)
+		cfg.DedupeTTL = ctx.Duration(dedupeTTLFlag)
+		cfg.ListenAddress = ctx.String(listenAddressFlag)
+		cfg.TLSCertFile = ctx.String(tlsCertFileFlag)
+		cfg.TLSKeyFile = ctx.String(tlsKeyFileFlag)
+		cfg.ReadTimeout = ctx.Duration(readTimeoutFlag)
+		cfg.WriteTimeout = ctx.Duration(writeTimeoutFlag)
+		cfg.ShutdownTimeout = ctx.Duration(shutdownTimeoutFlag)
+		cfg.HealthCheckInterval = ctx.Duration(healthCheckIntervalFlag)
+		cfg.HealthCheckTimeout = ctx.Duration(healthCheckTimeoutFlag)
+		cfg.ReapInterval = ctx.Duration(reapIntervalFlag)
+		cfg.MaxLifetime = ctx.Duration(maxLifetimeFlag)
+		cfg.ReapCheckGitHub = ctx.Bool(reapCheckGitHubFlag)
+		cfg.ReapDryRun = ctx.Bool(reapDryRunFlag)
+		cfg.WarmPoolSize = ctx.Int(warmPoolSizeFlag)
+		cfg.LogLevel = ctx.String(logLevelFlag)
+		cfg.LogFormat = ctx.String(logFormatFlag)
+
+		if path := ctx.String(configFlag); path != "" {
+			f, err := config.LoadFile(path)
+			if err != nil {
+				return err
+			}
+
+			applyFile(ctx, cfg, f)
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
 
 		return nil
 	}
 }
+
+// applyFile sets everything in the config file on the config, unless it was
+// also given as a flag or environment variable.
+func applyFile(ctx *cli.Context, cfg *config.Config, f *config.File) {
+	unset := func(name string) bool {
+		return !ctx.IsSet(name)
+	}
+
+	if unset(repoFlag) && f.Repo != "" {
+		cfg.Repository = f.Repo
+	}
+
+	if unset(userFlag) && f.User != "" {
+		cfg.Username = f.User
+	}
+
+	if unset(allowedReposFlag) && len(f.AllowedRepos) > 0 {
+		cfg.AllowedRepos = f.AllowedRepos
+	}
+
+	if unset(runnerScopeFlag) && f.RunnerScope != "" {
+		cfg.RunnerScope = f.RunnerScope
+	}
+
+	if unset(enterpriseFlag) && f.Enterprise != "" {
+		cfg.Enterprise = f.Enterprise
+	}
+
+	if unset(runnerGroupFlag) && f.RunnerGroup != "" {
+		cfg.RunnerGroup = f.RunnerGroup
+	}
+
+	if unset(repoRunnerGroupsFlag) && len(f.RepoRunnerGroups) > 0 {
+		cfg.RepoRunnerGroups = f.RepoRunnerGroups
+	}
+
+	if unset(hostsFlag) && len(f.Hosts) > 0 {
+		cfg.Hosts = f.Hosts
+	}
+
+	if unset(tokenFlag) && f.Token != "" {
+		cfg.APIToken = f.Token
+	}
+
+	if unset(githubAppIDFlag) && f.GitHubApp.AppID != 0 {
+		cfg.GitHubAppID = f.GitHubApp.AppID
+	}
+
+	if unset(githubAppInstallationIDFlag) && f.GitHubApp.InstallationID != 0 {
+		cfg.GitHubAppInstallationID = f.GitHubApp.InstallationID
+	}
+
+	if unset(githubAppPrivateKeyFileFlag) && f.GitHubApp.PrivateKeyFile != "" {
+		cfg.GitHubAppPrivateKeyFile = f.GitHubApp.PrivateKeyFile
+	}
+
+	if unset(githubURLFlag) && f.GitHubServer.URL != "" {
+		cfg.GitHubURL = f.GitHubServer.URL
+	}
+
+	if unset(githubAPIURLFlag) && f.GitHubServer.APIURL != "" {
+		cfg.GitHubAPIURL = f.GitHubServer.APIURL
+	}
+
+	if unset(caBundleFileFlag) && f.GitHubServer.CABundleFile != "" {
+		cfg.CABundleFile = f.GitHubServer.CABundleFile
+	}
+
+	if unset(runnerDownloadURLFlag) && f.RunnerDownloadURL != "" {
+		cfg.RunnerDownloadURL = f.RunnerDownloadURL
+	}
+
+	if unset(secretFlag) && f.Secret != "" {
+		cfg.WebhookSecret = f.Secret
+	}
+
+	if unset(keyFlag) && f.SSHPublicKey != "" {
+		cfg.SSHPublicKey = f.SSHPublicKey
+	}
+
+	if unset(labelsFlag) && len(f.Labels) > 0 {
+		cfg.Labels = f.Labels
+	}
+
+	if unset(profilesFlag) && len(f.Profiles) > 0 {
+		cfg.Profiles = f.Profiles
+	}
+
+	if unset(stateFlag) && f.StateFile != "" {
+		cfg.StateFile = f.StateFile
+	}
+
+	if unset(queueFileFlag) && f.Queue.File != "" {
+		cfg.QueueFile = f.Queue.File
+	}
+
+	if unset(queueMaxLengthFlag) && f.Queue.MaxLength != nil {
+		cfg.QueueMaxLength = *f.Queue.MaxLength
+	}
+
+	if unset(queueMaxWaitFlag) && f.Queue.MaxWait != nil {
+		cfg.QueueMaxWait = *f.Queue.MaxWait
+	}
+
+	if unset(workersFlag) && f.Workers.Count != nil {
+		cfg.Workers = *f.Workers.Count
+	}
+
+	if unset(workerQueueSizeFlag) && f.Workers.QueueSize != nil {
+		cfg.WorkerQueueSize = *f.Workers.QueueSize
+	}
+
+	if unset(workerRetriesFlag) && f.Workers.Retries != nil {
+		cfg.WorkerRetries = *f.Workers.Retries
+	}
+
+	if unset(dedupeTTLFlag) && f.DedupeTTL != nil {
+		cfg.DedupeTTL = *f.DedupeTTL
+	}
+
+	if unset(listenAddressFlag) && f.Server.Address != "" {
+		cfg.ListenAddress = f.Server.Address
+	}
+
+	if unset(tlsCertFileFlag) && f.Server.TLSCertFile != "" {
+		cfg.TLSCertFile = f.Server.TLSCertFile
+	}
+
+	if unset(tlsKeyFileFlag) && f.Server.TLSKeyFile != "" {
+		cfg.TLSKeyFile = f.Server.TLSKeyFile
+	}
+
+	if unset(readTimeoutFlag) && f.Server.ReadTimeout != nil {
+		cfg.ReadTimeout = *f.Server.ReadTimeout
+	}
+
+	if unset(writeTimeoutFlag) && f.Server.WriteTimeout != nil {
+		cfg.WriteTimeout = *f.Server.WriteTimeout
+	}
+
+	if unset(shutdownTimeoutFlag) && f.Server.ShutdownTimeout != nil {
+		cfg.ShutdownTimeout = *f.Server.ShutdownTimeout
+	}
+
+	if unset(healthCheckIntervalFlag) && f.HealthCheck.Interval != nil {
+		cfg.HealthCheckInterval = *f.HealthCheck.Interval
+	}
+
+	if unset(healthCheckTimeoutFlag) && f.HealthCheck.Timeout != nil {
+		cfg.HealthCheckTimeout = *f.HealthCheck.Timeout
+	}
+
+	if unset(reapIntervalFlag) && f.Reaper.Interval != nil {
+		cfg.ReapInterval = *f.Reaper.Interval
+	}
+
+	if unset(maxLifetimeFlag) && f.Reaper.MaxLifetime != nil {
+		cfg.MaxLifetime = *f.Reaper.MaxLifetime
+	}
+
+	if unset(reapCheckGitHubFlag) && f.Reaper.CheckGitHub != nil {
+		cfg.ReapCheckGitHub = *f.Reaper.CheckGitHub
+	}
+
+	if unset(reapDryRunFlag) && f.Reaper.DryRun != nil {
+		cfg.ReapDryRun = *f.Reaper.DryRun
+	}
+
+	if unset(warmPoolSizeFlag) && f.WarmPool != nil {
+		cfg.WarmPoolSize = *f.WarmPool
+	}
+
+	if unset(logLevelFlag) && f.Log.Level != "" {
+		cfg.LogLevel = f.Log.Level
+	}
+
+	if unset(logFormatFlag) && f.Log.Format != "" {
+		cfg.LogFormat = f.Log.Format
+	}
+}
+
+// envVars returns the environment variable which can be used to set the flag.
+func envVars(name string) []string {
+	return []string{envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))}
+}
+
+// parseRepoRunnerGroups reads owner/name=group values into a map of repo to
+// runner group.
+func parseRepoRunnerGroups(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	groups := make(map[string]string, len(values))
+
+	for _, v := range values {
+		repo, group, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(repo) == "" || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("invalid --%s value %q: expected owner/name=group", repoRunnerGroupsFlag, v)
+		}
+
+		groups[strings.TrimSpace(repo)] = strings.TrimSpace(group)
+	}
+
+	return groups, nil
+}
+
+const (
+	hostVCPUOpt        = "vcpu"
+	hostMemoryOpt      = "memory"
+	hostMaxMicroVMsOpt = "max-microvms"
+)
+
+func parseHosts(values []string) ([]config.Host, error) {
+	hosts := make([]config.Host, 0, len(values))
+
+	for _, v := range values {
+		h, err := parseHost(v)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+// parseHost turns a value like "1.2.3.4:9090;vcpu=16;memory=32768" into a
+// config.Host. Any limits which are not given are left unlimited.
+func parseHost(value string) (config.Host, error) {
+	parts := strings.Split(value, ";")
+
+	h := config.Host{Address: strings.TrimSpace(parts[0])}
+	if h.Address == "" {
+		return config.Host{}, fmt.Errorf("invalid --%s value %q: address must not be empty", hostsFlag, value)
+	}
+
+	for _, opt := range parts[1:] {
+		key, val, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return config.Host{}, fmt.Errorf("invalid --%s value %q: expected key=value, got %q", hostsFlag, value, opt)
+		}
+
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return config.Host{}, fmt.Errorf("invalid --%s value %q: %s must be a positive number", hostsFlag, value, key)
+		}
+
+		switch key {
+		case hostVCPUOpt:
+			h.VCPU = n
+		case hostMemoryOpt:
+			h.MemoryMiB = n
+		case hostMaxMicroVMsOpt:
+			h.MaxMicroVMs = n
+		default:
+			return config.Host{}, fmt.Errorf("invalid --%s value %q: unknown option %q", hostsFlag, value, key)
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,465 @@
+package flags_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/urfave/cli/v2"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/flags"
+)
+
+func Test_ParseFlags_Hosts(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		args        []string
+		expected    []config.Host
+		expectedErr string
+	}{
+		{
+			name:     "plain addresses have no limits",
+			args:     []string{"--host", "foo:9090", "--host", "bar:9090"},
+			expected: []config.Host{{Address: "foo:9090"}, {Address: "bar:9090"}},
+		},
+		{
+			name: "limits are parsed from the host value",
+			args: []string{"--host", "foo:9090;vcpu=16;memory=32768;max-microvms=8"},
+			expected: []config.Host{{
+				Address:     "foo:9090",
+				VCPU:        16,
+				MemoryMiB:   32768,
+				MaxMicroVMs: 8,
+			}},
+		},
+		{
+			name:        "unknown limits are rejected",
+			args:        []string{"--host", "foo:9090;disk=10"},
+			expectedErr: `unknown option "disk"`,
+		},
+		{
+			name:        "limits which are not numbers are rejected",
+			args:        []string{"--host", "foo:9090;vcpu=lots"},
+			expectedErr: "vcpu must be a positive number",
+		},
+		{
+			name:        "limits without a value are rejected",
+			args:        []string{"--host", "foo:9090;vcpu"},
+			expectedErr: "expected key=value",
+		},
+		{
+			name:        "empty addresses are rejected",
+			args:        []string{"--host", ";vcpu=2"},
+			expectedErr: "address must not be empty",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{}
+
+			err := runWithFlags(cfg, append(requiredArgs(), tc.args...)...)
+			if tc.expectedErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(cfg.Hosts).To(Equal(tc.expected))
+		})
+	}
+}
+
+func Test_ParseFlags_ConfigFile(t *testing.T) {
+	g := NewWithT(t)
+
+	path := writeFile(t, `
+version: v1
+user: file-user
+repo: file-repo
+token: file-token
+labels: [microvm]
+hosts:
+- address: foo:9090
+  vcpu: 16
+  maxMicroVMs: 4
+queue:
+  maxLength: 0
+  maxWait: 10m
+workers:
+  count: 8
+dedupeTTL: 1h
+server:
+  address: 127.0.0.1:8443
+  tlsCertFile: cert.pem
+  tlsKeyFile: key.pem
+  readTimeout: 5s
+healthCheck:
+  interval: 1m
+reaper:
+  maxLifetime: 6h
+  dryRun: true
+warmPool: 2
+log:
+  format: json
+`)
+
+	t.Setenv("MICROVM_ACTION_RUNNER_REPO", "env-repo")
+	t.Setenv("MICROVM_ACTION_RUNNER_TOKEN", "env-token")
+
+	cfg := &config.Config{}
+	g.Expect(runWithFlags(cfg, "--config", path, "--token", "flag-token")).To(Succeed())
+
+	// flags win over the environment, which wins over the file
+	g.Expect(cfg.APIToken).To(Equal("flag-token"))
+	g.Expect(cfg.Repository).To(Equal("env-repo"))
+	g.Expect(cfg.Username).To(Equal("file-user"))
+
+	g.Expect(cfg.Labels).To(Equal([]string{"microvm"}))
+	g.Expect(cfg.Hosts).To(Equal([]config.Host{{Address: "foo:9090", VCPU: 16, MaxMicroVMs: 4}}))
+	g.Expect(cfg.QueueMaxLength).To(Equal(0))
+	g.Expect(cfg.QueueMaxWait).To(Equal(10 * time.Minute))
+	g.Expect(cfg.Workers).To(Equal(8))
+	g.Expect(cfg.DedupeTTL).To(Equal(time.Hour))
+	g.Expect(cfg.ListenAddress).To(Equal("127.0.0.1:8443"))
+	g.Expect(cfg.TLSCertFile).To(Equal("cert.pem"))
+	g.Expect(cfg.TLSKeyFile).To(Equal("key.pem"))
+	g.Expect(cfg.ReadTimeout).To(Equal(5 * time.Second))
+	g.Expect(cfg.HealthCheckInterval).To(Equal(time.Minute))
+	g.Expect(cfg.MaxLifetime).To(Equal(6 * time.Hour))
+	g.Expect(cfg.ReapDryRun).To(BeTrue())
+	g.Expect(cfg.WarmPoolSize).To(Equal(2))
+	g.Expect(cfg.LogFormat).To(Equal("json"))
+
+	// anything left out of the file keeps its default
+	g.Expect(cfg.WorkerQueueSize).To(Equal(100))
+	g.Expect(cfg.WorkerRetries).To(Equal(3))
+	g.Expect(cfg.WriteTimeout).To(Equal(30 * time.Second))
+	g.Expect(cfg.HealthCheckTimeout).To(Equal(5 * time.Second))
+	g.Expect(cfg.ReapInterval).To(Equal(10 * time.Minute))
+	g.Expect(cfg.ReapCheckGitHub).To(BeFalse())
+	g.Expect(cfg.LogLevel).To(Equal("info"))
+}
+
+func Test_ParseFlags_Repos(t *testing.T) {
+	g := NewWithT(t)
+
+	path := writeFile(t, `
+version: v1
+allowedRepos: [acme/*, other/app]
+runnerScope: enterprise
+enterprise: acme-corp
+`)
+
+	cfg := &config.Config{}
+	g.Expect(runWithFlags(cfg, "--config", path, "--token", "token", "--host", "foo:9090")).To(Succeed())
+
+	g.Expect(cfg.AllowedRepos).To(Equal([]string{"acme/*", "other/app"}))
+	g.Expect(cfg.RunnerScope).To(Equal(config.ScopeEnterprise))
+	g.Expect(cfg.Enterprise).To(Equal("acme-corp"))
+
+	// runners are registered with the job's repo by default
+	cfg = &config.Config{}
+	g.Expect(runWithFlags(cfg, requiredArgs("foo:9090")...)).To(Succeed())
+	g.Expect(cfg.RunnerScope).To(Equal(config.ScopeRepo))
+	g.Expect(cfg.Repos()).To(Equal([]string{"user/repo"}))
+}
+
+func Test_ParseFlags_RunnerGroups(t *testing.T) {
+	g := NewWithT(t)
+
+	path := writeFile(t, `
+version: v1
+runnerScope: org
+runnerGroup: file-group
+repoRunnerGroups:
+  user/repo: repo-group
+profiles:
+- name: gpu
+  runnerGroup: gpu-group
+`)
+
+	cfg := &config.Config{}
+	g.Expect(runWithFlags(cfg, append(requiredArgs("foo:9090"), "--config", path)...)).To(Succeed())
+
+	g.Expect(cfg.RunnerGroup).To(Equal("file-group"))
+	g.Expect(cfg.RepoRunnerGroups).To(Equal(map[string]string{"user/repo": "repo-group"}))
+	g.Expect(cfg.Profiles[0].RunnerGroup).To(Equal("gpu-group"))
+
+	cfg = &config.Config{}
+	g.Expect(runWithFlags(cfg, append(requiredArgs("foo:9090"),
+		"--config", path,
+		"--runner-group", "flag-group",
+		"--repo-runner-group", "user/*=owner-group",
+	)...)).To(Succeed())
+
+	g.Expect(cfg.RunnerGroup).To(Equal("flag-group"))
+	g.Expect(cfg.RepoRunnerGroups).To(Equal(map[string]string{"user/*": "owner-group"}))
+}
+
+func Test_ParseFlags_GitHubServer(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := &config.Config{}
+	g.Expect(runWithFlags(cfg, requiredArgs("foo:9090")...)).To(Succeed())
+
+	g.Expect(cfg.GitHubURL).To(Equal(config.DefaultGitHubURL))
+	g.Expect(cfg.RunnerDownloadURL).To(Equal(config.DefaultRunnerDownloadURL))
+	g.Expect(cfg.APIURL()).To(BeEmpty())
+
+	path := writeFile(t, `
+version: v1
+githubServer:
+  url: https://github.example.com
+  caBundleFile: /etc/microvm-action-runner/ca.pem
+runnerDownloadURL: https://mirror.example.com/actions-runner
+`)
+
+	cfg = &config.Config{}
+	g.Expect(runWithFlags(cfg, append(requiredArgs("foo:9090"), "--config", path)...)).To(Succeed())
+
+	g.Expect(cfg.GitHubURL).To(Equal("https://github.example.com"))
+	g.Expect(cfg.APIURL()).To(Equal("https://github.example.com/api/v3"))
+	g.Expect(cfg.CABundleFile).To(Equal("/etc/microvm-action-runner/ca.pem"))
+	g.Expect(cfg.RunnerDownloadURL).To(Equal("https://mirror.example.com/actions-runner"))
+
+	cfg = &config.Config{}
+	g.Expect(runWithFlags(cfg, append(requiredArgs("foo:9090"),
+		"--config", path,
+		"--github-api-url", "https://api.github.example.com",
+	)...)).To(Succeed())
+
+	g.Expect(cfg.GitHubURL).To(Equal("https://github.example.com"))
+	g.Expect(cfg.APIURL()).To(Equal("https://api.github.example.com"))
+}
+
+func Test_ParseFlags_GitHubApp(t *testing.T) {
+	g := NewWithT(t)
+
+	path := writeFile(t, `
+version: v1
+githubApp:
+  appID: 42
+  installationID: 1234
+  privateKeyFile: /etc/microvm-action-runner/app.pem
+`)
+
+	t.Setenv("MICROVM_ACTION_RUNNER_GITHUB_APP_INSTALLATION_ID", "5678")
+
+	cfg := &config.Config{}
+	g.Expect(runWithFlags(cfg, "--config", path, "--user", "user", "--repo", "repo", "--host", "foo:9090")).To(Succeed())
+
+	g.Expect(cfg.UsesGitHubApp()).To(BeTrue())
+	g.Expect(cfg.APIToken).To(BeEmpty())
+	g.Expect(cfg.GitHubAppID).To(BeEquivalentTo(42))
+	g.Expect(cfg.GitHubAppInstallationID).To(BeEquivalentTo(5678))
+	g.Expect(cfg.GitHubAppPrivateKeyFile).To(Equal("/etc/microvm-action-runner/app.pem"))
+}
+
+func Test_ParseFlags_Errors(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		args        []string
+		file        string
+		expectedErr string
+	}{
+		{
+			name:        "required values must be set somewhere",
+			args:        []string{"--host", "foo:9090"},
+			expectedErr: "invalid configuration: at least one repo must be allowed, set user and repo or allowed repos",
+		},
+		{
+			name:        "user and repo must be set together",
+			args:        []string{"--user", "user", "--token", "token", "--host", "foo:9090"},
+			expectedErr: "invalid configuration: user and repo must be set together",
+		},
+		{
+			name:        "allowed repos must have an owner and a name",
+			args:        append(requiredArgs("foo:9090"), "--allowed-repos", "foo"),
+			expectedErr: `invalid configuration: allowedRepos[0]: "foo" must be owner/name or owner/*`,
+		},
+		{
+			name:        "the runner scope must be known",
+			args:        append(requiredArgs("foo:9090"), "--runner-scope", "team"),
+			expectedErr: `invalid configuration: runner scope must be repo, org or enterprise, not "team"`,
+		},
+		{
+			name:        "the enterprise scope needs an enterprise",
+			args:        append(requiredArgs("foo:9090"), "--runner-scope", "enterprise"),
+			expectedErr: "invalid configuration: enterprise must be set when runners are registered with the enterprise",
+		},
+		{
+			name:        "warm pools need a single place to register runners",
+			args:        append(requiredArgs("foo:9090"), "--allowed-repos", "user/other", "--warm-pool-size", "1"),
+			expectedErr: "invalid configuration: warm pools need runners to be registered with a single repo",
+		},
+		{
+			name:        "repo runner groups must name a group",
+			args:        append(requiredArgs("foo:9090"), "--runner-scope", "org", "--repo-runner-group", "user/repo"),
+			expectedErr: `invalid --repo-runner-groups value "user/repo": expected owner/name=group`,
+		},
+		{
+			name:        "runner groups need org or enterprise runners",
+			args:        append(requiredArgs("foo:9090"), "--runner-group", "builders"),
+			expectedErr: "invalid configuration: runner groups can only be used when runners are registered with an org or the enterprise",
+		},
+		{
+			name:        "repo runner groups must be for allowed repos",
+			args:        append(requiredArgs("foo:9090"), "--runner-scope", "org", "--repo-runner-group", "other/repo=builders"),
+			expectedErr: "invalid configuration: repoRunnerGroups[other/repo]: repo must be an allowed repo, as owner/name or owner/*",
+		},
+		{
+			name:        "a token or github app must be set",
+			args:        []string{"--user", "user", "--repo", "repo", "--host", "foo:9090"},
+			expectedErr: "invalid configuration: token or github app must be set",
+		},
+		{
+			name:        "a token and github app cannot both be set",
+			args:        append(requiredArgs("foo:9090"), "--github-app-id", "42"),
+			expectedErr: "invalid configuration: token and github app must not both be set",
+		},
+		{
+			name:        "a github app needs an installation and a key",
+			args:        []string{"--user", "user", "--repo", "repo", "--host", "foo:9090", "--github-app-id", "42"},
+			expectedErr: "invalid configuration: github app id, installation id and private key file must be set together",
+		},
+		{
+			name:        "hosts must be set somewhere",
+			args:        requiredArgs(),
+			expectedErr: "invalid configuration: at least one host must be set",
+		},
+		{
+			name:        "hosts must be unique",
+			args:        requiredArgs("foo:9090", "foo:9090"),
+			expectedErr: "hosts[1]: address foo:9090 is used more than once",
+		},
+		{
+			name:        "the github url must be absolute",
+			args:        append(requiredArgs("foo:9090"), "--github-url", "github.example.com"),
+			expectedErr: `invalid configuration: github url "github.example.com" must be an absolute http or https url`,
+		},
+		{
+			name:        "values out of range are rejected",
+			args:        append(requiredArgs("foo:9090"), "--workers", "0"),
+			expectedErr: "invalid configuration: workers must be at least 1",
+		},
+		{
+			name:        "tls needs both a cert and a key",
+			args:        append(requiredArgs("foo:9090"), "--tls-cert-file", "cert.pem"),
+			expectedErr: "tls cert file and tls key file must be set together",
+		},
+		{
+			name:        "the warm pool size must not be negative",
+			args:        append(requiredArgs("foo:9090"), "--warm-pool-size", "-1"),
+			expectedErr: "invalid configuration: warm pool size must not be negative",
+		},
+		{
+			name:        "the log level must be known",
+			args:        append(requiredArgs("foo:9090"), "--log-level", "loud"),
+			expectedErr: `invalid configuration: log level "loud" is not valid`,
+		},
+		{
+			name:        "the log format must be text or json",
+			args:        append(requiredArgs("foo:9090"), "--log-format", "xml"),
+			expectedErr: `invalid configuration: log format must be text or json, not "xml"`,
+		},
+		{
+			name:        "the config file must have a known version",
+			file:        "version: v2\n",
+			args:        requiredArgs("foo:9090"),
+			expectedErr: `unsupported version "v2", expected "v1"`,
+		},
+		{
+			name:        "the config file must not have unknown fields",
+			file:        "version: v1\nusername: foo\n",
+			args:        requiredArgs("foo:9090"),
+			expectedErr: "field username not found",
+		},
+		{
+			name:        "profiles in the config file are validated",
+			file:        "version: v1\nprofiles:\n- name: small\n  vcpu: -1\n",
+			args:        requiredArgs("foo:9090"),
+			expectedErr: `profile "small": vcpu must not be negative`,
+		},
+		{
+			name:        "profiles must fit on a host",
+			file:        "version: v1\nhosts:\n- address: foo:9090\n  vcpu: 4\n- address: bar:9090\n  memory: 8192\nprofiles:\n- name: large\n  vcpu: 8\n  memory: 16384\n",
+			args:        requiredArgs(),
+			expectedErr: `invalid configuration: profile "large": larger than every host`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			args := tc.args
+			if tc.file != "" {
+				args = append(args, "--config", writeFile(t, tc.file))
+			}
+
+			err := runWithFlags(&config.Config{}, args...)
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+}
+
+// runWithFlags runs a throwaway app with the start command's flags so that
+// ParseFlags can be called with a real cli.Context.
+func runWithFlags(cfg *config.Config, args ...string) error {
+	app := &cli.App{
+		Name: "test",
+		Flags: flags.CLIFlags(
+			flags.WithConfigFileFlag(),
+			flags.WithRepoFlags(),
+			flags.WithRunnerGroupFlags(),
+			flags.WithHostsFlag(),
+			flags.WithAPITokenFlag(),
+			flags.WithGitHubAppFlags(),
+			flags.WithGitHubServerFlags(),
+			flags.WithWebhookSecretFlag(),
+			flags.WithSSHPublicKeyFlag(),
+			flags.WithLabelsFlag(),
+			flags.WithProfilesFileFlag(),
+			flags.WithStateFileFlag(),
+			flags.WithQueueFlags(),
+			flags.WithWorkerFlags(),
+			flags.WithDedupeFlag(),
+			flags.WithServerFlags(),
+			flags.WithHealthCheckFlags(),
+			flags.WithReaperFlags(),
+			flags.WithWarmPoolFlag(),
+			flags.WithLogFlags(),
+		),
+		Before: flags.ParseFlags(cfg),
+		Action: func(*cli.Context) error { return nil },
+	}
+
+	return app.Run(append([]string{"test"}, args...))
+}
+
+// requiredArgs returns the flags, apart from hosts, which must be set for the
+// config to be valid.
+func requiredArgs(hosts ...string) []string {
+	args := []string{"--user", "user", "--repo", "repo", "--token", "token"}
+
+	for _, h := range hosts {
+		args = append(args, "--host", h)
+	}
+
+	return args
+}
+
+func writeFile(t *testing.T, content string) string {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	g.Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+
+	return path
+}
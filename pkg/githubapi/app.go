@@ -0,0 +1,225 @@
+package githubapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource gives the token to authenticate a request to the api with.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource for a personal access token. It is called before
+// every request, so that a token which is changed while running is picked up.
+type StaticToken func() string
+
+// Token returns the token.
+func (t StaticToken) Token(context.Context) (string, error) {
+	return t(), nil
+}
+
+const (
+	// jwtIssuedSkew backdates the app's JWTs in case our clock is ahead of
+	// github's, which would have them rejected
+	jwtIssuedSkew = time.Minute
+	// jwtLifetime is kept under the 10 minutes github allows
+	jwtLifetime = 9 * time.Minute
+	// tokenRefreshBefore is how long before an installation token expires that
+	// a new one is minted, so that a token never runs out part way through a
+	// request
+	tokenRefreshBefore = 5 * time.Minute
+)
+
+// AppParams are the details of a github app installation.
+type AppParams struct {
+	// BaseURL is the address of the api, github.com's if empty
+	BaseURL string
+	// AppID is the ID of the github app
+	AppID int64
+	// InstallationID is the ID of the app's installation on the user or org
+	InstallationID int64
+	// PrivateKey is the PEM encoded private key of the app
+	PrivateKey []byte
+	// Now is the clock used to sign JWTs and expire tokens, time.Now if nil
+	Now func() time.Time
+	// HTTPClient is used to mint tokens, one from NewHTTPClient without a CA
+	// bundle if nil
+	HTTPClient *http.Client
+}
+
+// App is a TokenSource which authenticates as a github app installation. The
+// installation tokens it mints are cached, and a new one is minted shortly
+// before the last expires. It is safe for concurrent use.
+type App struct {
+	baseURL        string
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	http           *http.Client
+	now            func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewApp returns a new App, or an error if the private key cannot be parsed.
+func NewApp(p AppParams) (*App, error) {
+	if p.AppID == 0 {
+		return nil, errors.New("app id not provided")
+	}
+
+	if p.InstallationID == 0 {
+		return nil, errors.New("installation id not provided")
+	}
+
+	key, err := parsePrivateKey(p.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse github app private key: %w", err)
+	}
+
+	if p.BaseURL == "" {
+		p.BaseURL = DefaultBaseURL
+	}
+
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+
+	if p.HTTPClient == nil {
+		p.HTTPClient = &http.Client{Timeout: requestTimeout}
+	}
+
+	return &App{
+		baseURL:        strings.TrimSuffix(p.BaseURL, "/"),
+		appID:          p.AppID,
+		installationID: p.InstallationID,
+		key:            key,
+		http:           p.HTTPClient,
+		now:            p.Now,
+	}, nil
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Token returns an installation token, minting a new one if there is none
+// cached or the cached one is about to expire.
+func (a *App) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+
+	if a.token != "" && now.Add(tokenRefreshBefore).Before(a.expiresAt) {
+		return a.token, nil
+	}
+
+	t, err := a.mint(ctx, now)
+	if err != nil {
+		return "", fmt.Errorf("failed to mint installation token for github app %d: %w", a.appID, err)
+	}
+
+	a.token = t.Token
+	a.expiresAt = t.ExpiresAt
+
+	return a.token, nil
+}
+
+// mint asks github for a new installation token, authenticating as the app.
+func (a *App) mint(ctx context.Context, now time.Time) (installationToken, error) {
+	jwt, err := a.jwt(now)
+	if err != nil {
+		return installationToken{}, err
+	}
+
+	c := &Client{
+		baseURL: a.baseURL,
+		tokens:  StaticToken(func() string { return jwt }),
+		http:    a.http,
+	}
+
+	var t installationToken
+
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", a.installationID), nil, &t); err != nil {
+		return installationToken{}, err
+	}
+
+	if t.Token == "" {
+		return installationToken{}, errors.New("github responded without a token")
+	}
+
+	return t, nil
+}
+
+// jwt returns a JWT signed with the app's private key, which github accepts in
+// place of a token for the app's own endpoints.
+func (a *App) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-jwtIssuedSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(a.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign jwt: %w", err)
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// parsePrivateKey reads an RSA key in PKCS#1 form, as github gives them out,
+// or PKCS#8 form.
+func parsePrivateKey(dat []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
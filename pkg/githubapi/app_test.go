@@ -0,0 +1,229 @@
+package githubapi_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi/githubapitest"
+)
+
+const (
+	testAppID          = 42
+	testInstallationID = 1234
+)
+
+func TestApp_Token(t *testing.T) {
+	g := NewWithT(t)
+
+	key := newTestKey(g)
+	clock := &testClock{now: time.Now()}
+
+	gh := githubapitest.NewServer()
+	defer gh.Close()
+
+	gh.InstallApp(testAppID, testInstallationID, &key.PublicKey)
+	gh.SetClock(clock.Now)
+
+	app, err := githubapi.NewApp(githubapi.AppParams{
+		BaseURL:        gh.URL,
+		AppID:          testAppID,
+		InstallationID: testInstallationID,
+		PrivateKey:     encodePKCS1(key),
+		Now:            clock.Now,
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	c := githubapi.New(gh.URL, app, nil)
+	gh.AddRunner("repos/foo/bar", "runner")
+
+	list := func() {
+		runners, err := c.ListRunners(context.Background(), githubapi.RepoScope("foo", "bar"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(runners).To(HaveLen(1))
+	}
+
+	// the token is minted on first use, and used for every call after
+	list()
+	list()
+	g.Expect(gh.MintedTokens()).To(Equal(1))
+
+	clock.Add(50 * time.Minute)
+	list()
+	g.Expect(gh.MintedTokens()).To(Equal(1))
+
+	// a new token is minted before the old one runs out
+	clock.Add(6 * time.Minute)
+	list()
+	g.Expect(gh.MintedTokens()).To(Equal(2))
+
+	// which is then cached in turn
+	clock.Add(30 * time.Minute)
+	list()
+	g.Expect(gh.MintedTokens()).To(Equal(2))
+}
+
+func TestApp_TokenErrors(t *testing.T) {
+	g := NewWithT(t)
+
+	key := newTestKey(g)
+
+	tt := []struct {
+		name           string
+		appID          int64
+		installationID int64
+		fail           int
+		expectedErr    string
+	}{
+		{
+			name:           "the app is not installed, the error is returned",
+			appID:          testAppID,
+			installationID: 1,
+			expectedErr:    "failed to mint installation token for github app 42: not found",
+		},
+		{
+			name:           "the jwt is not for the app, the error is returned",
+			appID:          1,
+			installationID: testInstallationID,
+			expectedErr:    "failed to mint installation token for github app 1: github responded with 401",
+		},
+		{
+			name:           "github fails, the error is returned",
+			appID:          testAppID,
+			installationID: testInstallationID,
+			fail:           http.StatusInternalServerError,
+			expectedErr:    "failed to mint installation token for github app 42: github responded with 500",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gh := githubapitest.NewServer()
+			defer gh.Close()
+
+			gh.InstallApp(testAppID, testInstallationID, &key.PublicKey)
+			gh.Fail(tc.fail)
+
+			app, err := githubapi.NewApp(githubapi.AppParams{
+				BaseURL:        gh.URL,
+				AppID:          tc.appID,
+				InstallationID: tc.installationID,
+				PrivateKey:     encodePKCS1(key),
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			_, err = githubapi.New(gh.URL, app, nil).ListRunners(context.Background(), githubapi.RepoScope("foo", "bar"))
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+			g.Expect(gh.MintedTokens()).To(Equal(0))
+		})
+	}
+}
+
+func TestNewApp(t *testing.T) {
+	g := NewWithT(t)
+
+	key := newTestKey(g)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ec, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tt := []struct {
+		name        string
+		params      githubapi.AppParams
+		expectedErr string
+	}{
+		{
+			name:   "a PKCS#1 key, as github gives out, is accepted",
+			params: githubapi.AppParams{AppID: 1, InstallationID: 2, PrivateKey: encodePKCS1(key)},
+		},
+		{
+			name:   "a PKCS#8 key is accepted",
+			params: githubapi.AppParams{AppID: 1, InstallationID: 2, PrivateKey: encodePEM("PRIVATE KEY", pkcs8)},
+		},
+		{
+			name:        "a key which is not RSA is rejected",
+			params:      githubapi.AppParams{AppID: 1, InstallationID: 2, PrivateKey: encodePEM("PRIVATE KEY", ec)},
+			expectedErr: "failed to parse github app private key: key is not an RSA key",
+		},
+		{
+			name:        "a file which is not PEM is rejected",
+			params:      githubapi.AppParams{AppID: 1, InstallationID: 2, PrivateKey: []byte("not a key")},
+			expectedErr: "failed to parse github app private key: no PEM data found",
+		},
+		{
+			name:        "the app id is required",
+			params:      githubapi.AppParams{InstallationID: 2, PrivateKey: encodePKCS1(key)},
+			expectedErr: "app id not provided",
+		},
+		{
+			name:        "the installation id is required",
+			params:      githubapi.AppParams{AppID: 1, PrivateKey: encodePKCS1(key)},
+			expectedErr: "installation id not provided",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := githubapi.NewApp(tc.params)
+			if tc.expectedErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).To(MatchError(tc.expectedErr))
+		})
+	}
+}
+
+func newTestKey(g *WithT) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	return key
+}
+
+func encodePKCS1(key *rsa.PrivateKey) []byte {
+	return encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+}
+
+func encodePEM(kind string, dat []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: dat})
+}
+
+// testClock is moved forward by the test, and read by the app and the fake
+// github api from their own goroutines.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
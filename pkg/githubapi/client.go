@@ -0,0 +1,407 @@
+package githubapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the address of the api for github.com.
+const DefaultBaseURL = "https://api.github.com"
+
+const requestTimeout = 30 * time.Second
+
+// Workflow job statuses
+const (
+	JobQueued     = "queued"
+	JobInProgress = "in_progress"
+	JobCompleted  = "completed"
+)
+
+// Runner statuses
+const (
+	RunnerOnline  = "online"
+	RunnerOffline = "offline"
+)
+
+// ErrNotFound is returned when github has no record of what was asked for, or
+// the token is not allowed to see it.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when what was asked for clashes with something which
+// already exists, eg. a runner with the same name.
+var ErrConflict = errors.New("conflict")
+
+// ErrUnprocessable is returned when github refuses what was asked for as
+// things stand, eg. deleting a runner which is running a job.
+var ErrUnprocessable = errors.New("unprocessable")
+
+// Client makes calls to the github REST api.
+type Client struct {
+	baseURL string
+	tokens  TokenSource
+	http    *http.Client
+}
+
+// New returns a new Client which authenticates with a token from tokens before
+// every request. If baseURL is empty, the api for github.com is used. If
+// httpClient is nil, one from NewHTTPClient without a CA bundle is used.
+func New(baseURL string, tokens TokenSource, httpClient *http.Client) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: requestTimeout}
+	}
+
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		tokens:  tokens,
+		http:    httpClient,
+	}
+}
+
+// NewHTTPClient returns an http client for the api which trusts the PEM
+// certificates in caBundle as well as the system's, eg. for a GitHub
+// Enterprise Server with a certificate from a private CA.
+func NewHTTPClient(caBundle []byte) (*http.Client, error) {
+	c := &http.Client{Timeout: requestTimeout}
+
+	if len(caBundle) == 0 {
+		return c, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, errors.New("no certificates found in ca bundle")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	c.Transport = transport
+
+	return c, nil
+}
+
+type job struct {
+	Status string `json:"status"`
+}
+
+// JobStatus returns the status of the workflow job, one of JobQueued,
+// JobInProgress or JobCompleted.
+func (c *Client) JobStatus(ctx context.Context, owner, repo string, id int64) (string, error) {
+	var j job
+
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/%s/actions/jobs/%d", owner, repo, id), nil, &j); err != nil {
+		return "", fmt.Errorf("failed to get status of job %d: %w", id, err)
+	}
+
+	return j.Status, nil
+}
+
+// Scope is where self-hosted runners are registered: a repo, an org or an
+// enterprise.
+type Scope struct {
+	path string
+}
+
+// RepoScope returns the scope of the repo.
+func RepoScope(owner, repo string) Scope {
+	return Scope{path: fmt.Sprintf("repos/%s/%s", owner, repo)}
+}
+
+// OrgScope returns the scope of the org.
+func OrgScope(org string) Scope {
+	return Scope{path: "orgs/" + org}
+}
+
+// EnterpriseScope returns the scope of the enterprise, by its slug.
+func EnterpriseScope(enterprise string) Scope {
+	return Scope{path: "enterprises/" + enterprise}
+}
+
+// String returns the scope as it appears in api paths, eg. repos/owner/repo.
+func (s Scope) String() string {
+	return s.path
+}
+
+// Runner is a self-hosted runner registered with a repo, org or enterprise.
+type Runner struct {
+	ID     int64         `json:"id"`
+	Name   string        `json:"name"`
+	Status string        `json:"status"`
+	Busy   bool          `json:"busy"`
+	Labels []RunnerLabel `json:"labels"`
+}
+
+// RunnerLabel is one of the labels a runner was registered with.
+type RunnerLabel struct {
+	Name string `json:"name"`
+}
+
+// HasLabel returns true if the runner has the label. Labels are compared
+// without regard to case, as github does.
+func (r Runner) HasLabel(name string) bool {
+	for _, l := range r.Labels {
+		if strings.EqualFold(l.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type runnerList struct {
+	TotalCount int      `json:"total_count"`
+	Runners    []Runner `json:"runners"`
+}
+
+const runnersPerPage = 100
+
+// ListRunners returns every self-hosted runner registered in the scope.
+func (c *Client) ListRunners(ctx context.Context, scope Scope) ([]Runner, error) {
+	var runners []Runner
+
+	for page := 1; ; page++ {
+		var list runnerList
+
+		path := fmt.Sprintf("/%s/actions/runners?per_page=%d&page=%d", scope, runnersPerPage, page)
+		if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+			return nil, fmt.Errorf("failed to list runners: %w", err)
+		}
+
+		runners = append(runners, list.Runners...)
+
+		if len(list.Runners) == 0 || len(runners) >= list.TotalCount {
+			return runners, nil
+		}
+	}
+}
+
+// DeleteRunner removes the self-hosted runner from the scope. ErrUnprocessable
+// is returned if the runner is running a job.
+func (c *Client) DeleteRunner(ctx context.Context, scope Scope, id int64) error {
+	if err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/%s/actions/runners/%d", scope, id), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete runner %d: %w", id, err)
+	}
+
+	return nil
+}
+
+// DefaultRunnerGroupID is the ID of the runner group every org and enterprise
+// has, repos always use it.
+const DefaultRunnerGroupID = 1
+
+// Runner group visibilities
+const (
+	// RunnerGroupAll lets every repo in the org use the group
+	RunnerGroupAll = "all"
+	// RunnerGroupSelected only lets the group's selected repos use it
+	RunnerGroupSelected = "selected"
+	// RunnerGroupPrivate only lets the org's private repos use the group
+	RunnerGroupPrivate = "private"
+)
+
+// RunnerGroup is a group of an org's or enterprise's self-hosted runners,
+// along with which repos may use them.
+type RunnerGroup struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+}
+
+type runnerGroupList struct {
+	TotalCount   int           `json:"total_count"`
+	RunnerGroups []RunnerGroup `json:"runner_groups"`
+}
+
+// ListRunnerGroups returns every runner group in the scope, which must be an
+// org or an enterprise.
+func (c *Client) ListRunnerGroups(ctx context.Context, scope Scope) ([]RunnerGroup, error) {
+	var groups []RunnerGroup
+
+	for page := 1; ; page++ {
+		var list runnerGroupList
+
+		path := fmt.Sprintf("/%s/actions/runner-groups?per_page=%d&page=%d", scope, runnersPerPage, page)
+		if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+			return nil, fmt.Errorf("failed to list runner groups: %w", err)
+		}
+
+		groups = append(groups, list.RunnerGroups...)
+
+		if len(list.RunnerGroups) == 0 || len(groups) >= list.TotalCount {
+			return groups, nil
+		}
+	}
+}
+
+// RunnerGroupNamed returns the runner group in the scope with the name, or
+// ErrNotFound if there is none. Names are compared without regard to case, as
+// github does.
+func (c *Client) RunnerGroupNamed(ctx context.Context, scope Scope, name string) (RunnerGroup, error) {
+	groups, err := c.ListRunnerGroups(ctx, scope)
+	if err != nil {
+		return RunnerGroup{}, err
+	}
+
+	for _, g := range groups {
+		if strings.EqualFold(g.Name, name) {
+			return g, nil
+		}
+	}
+
+	return RunnerGroup{}, fmt.Errorf("runner group %q in %s: %w", name, scope, ErrNotFound)
+}
+
+type repo struct {
+	FullName string `json:"full_name"`
+}
+
+type repoList struct {
+	TotalCount   int    `json:"total_count"`
+	Repositories []repo `json:"repositories"`
+}
+
+// RunnerGroupRepos returns the repos, as owner/name, which may use the org's
+// runner group when its visibility is RunnerGroupSelected.
+func (c *Client) RunnerGroupRepos(ctx context.Context, org string, id int64) ([]string, error) {
+	var repos []string
+
+	for page := 1; ; page++ {
+		var list repoList
+
+		path := fmt.Sprintf("/orgs/%s/actions/runner-groups/%d/repositories?per_page=%d&page=%d", org, id, runnersPerPage, page)
+		if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+			return nil, fmt.Errorf("failed to list repos of runner group %d: %w", id, err)
+		}
+
+		for _, r := range list.Repositories {
+			repos = append(repos, r.FullName)
+		}
+
+		if len(list.Repositories) == 0 || len(repos) >= list.TotalCount {
+			return repos, nil
+		}
+	}
+}
+
+const runnerWorkFolder = "_work"
+
+// JITConfig is what a runner needs to register itself and run a single job,
+// without being given a token.
+type JITConfig struct {
+	// Runner is the runner which was registered
+	Runner Runner `json:"runner"`
+	// EncodedJITConfig is passed to the runner with --jitconfig
+	EncodedJITConfig string `json:"encoded_jit_config"`
+}
+
+type jitConfigRequest struct {
+	Name          string   `json:"name"`
+	RunnerGroupID int64    `json:"runner_group_id"`
+	Labels        []string `json:"labels"`
+	WorkFolder    string   `json:"work_folder"`
+}
+
+// GenerateJITConfig registers a runner in the runner group in the scope and
+// returns the just in time config to start it with. A group of 0 is the
+// default group. The config can only be used once, and the runner is removed
+// by github after it has run one job. ErrConflict is returned if a runner with
+// the name is already registered.
+func (c *Client) GenerateJITConfig(ctx context.Context, scope Scope, name string, group int64, labels []string) (JITConfig, error) {
+	if group == 0 {
+		group = DefaultRunnerGroupID
+	}
+
+	in := jitConfigRequest{
+		Name:          name,
+		RunnerGroupID: group,
+		Labels:        labels,
+		WorkFolder:    runnerWorkFolder,
+	}
+
+	var out JITConfig
+
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/%s/actions/runners/generate-jitconfig", scope), in, &out); err != nil {
+		return JITConfig{}, fmt.Errorf("failed to generate jit config for runner %s: %w", name, err)
+	}
+
+	return out, nil
+}
+
+// do sends a request to the api, with in as the JSON body if it is not nil,
+// and decodes the response into out.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+
+	if in != nil {
+		dat, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(dat)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusUnprocessableEntity:
+		return ErrUnprocessable
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("github responded with %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,301 @@
+package githubapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi/githubapitest"
+)
+
+func TestJobStatus(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name           string
+		status         int
+		body           string
+		expectedStatus string
+		expectedErr    string
+	}{
+		{
+			name:           "the job is found, its status is returned",
+			status:         http.StatusOK,
+			body:           `{"id": 1234, "status": "completed", "conclusion": "success"}`,
+			expectedStatus: githubapi.JobCompleted,
+		},
+		{
+			name:        "the job is not found, ErrNotFound is returned",
+			status:      http.StatusNotFound,
+			body:        `{"message": "Not Found"}`,
+			expectedErr: "failed to get status of job 1234: not found",
+		},
+		{
+			name:        "github fails, the error is returned",
+			status:      http.StatusUnauthorized,
+			body:        `{"message": "Bad credentials"}`,
+			expectedErr: `failed to get status of job 1234: github responded with 401: {"message": "Bad credentials"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.Method).To(Equal(http.MethodGet))
+				g.Expect(r.URL.Path).To(Equal("/repos/foo/bar/actions/jobs/1234"))
+				g.Expect(r.Header.Get("Authorization")).To(Equal("Bearer token"))
+
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			c := githubapi.New(srv.URL+"/", githubapi.StaticToken(func() string { return "token" }), nil)
+
+			status, err := c.JobStatus(context.Background(), "foo", "bar", 1234)
+			if tc.expectedErr != "" {
+				g.Expect(err).To(MatchError(tc.expectedErr))
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(status).To(Equal(tc.expectedStatus))
+		})
+	}
+}
+
+func TestListRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	// more runners than fit on one page
+	all := make([]githubapi.Runner, 150)
+	for i := range all {
+		all[i] = githubapi.Runner{ID: int64(i), Name: fmt.Sprintf("runner-%d", i), Status: "online"}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.URL.Path).To(Equal("/repos/foo/bar/actions/runners"))
+		g.Expect(r.URL.Query().Get("per_page")).To(Equal("100"))
+
+		start := 0
+		if r.URL.Query().Get("page") == "2" {
+			start = 100
+		}
+
+		end := start + 100
+		if end > len(all) {
+			end = len(all)
+		}
+
+		g.Expect(json.NewEncoder(w).Encode(map[string]interface{}{
+			"total_count": len(all),
+			"runners":     all[start:end],
+		})).To(Succeed())
+	}))
+	defer srv.Close()
+
+	runners, err := githubapi.New(srv.URL, githubapi.StaticToken(func() string { return "token" }), nil).ListRunners(context.Background(), githubapi.RepoScope("foo", "bar"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(runners).To(Equal(all))
+}
+
+func TestDeleteRunner(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		scope        githubapi.Scope
+		expectedPath string
+	}{
+		{scope: githubapi.RepoScope("foo", "bar"), expectedPath: "/repos/foo/bar/actions/runners/42"},
+		{scope: githubapi.OrgScope("foo"), expectedPath: "/orgs/foo/actions/runners/42"},
+		{scope: githubapi.EnterpriseScope("acme"), expectedPath: "/enterprises/acme/actions/runners/42"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.scope.String(), func(t *testing.T) {
+			var deleted []string
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				g.Expect(r.Method).To(Equal(http.MethodDelete))
+
+				deleted = append(deleted, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			g.Expect(githubapi.New(srv.URL, githubapi.StaticToken(func() string { return "token" }), nil).DeleteRunner(context.Background(), tc.scope, 42)).To(Succeed())
+			g.Expect(deleted).To(Equal([]string{tc.expectedPath}))
+		})
+	}
+}
+
+func TestDeleteRunner_Busy(t *testing.T) {
+	g := NewWithT(t)
+
+	gh := githubapitest.NewServer()
+	defer gh.Close()
+
+	r := gh.AddRunner("repos/foo/bar", "runner-1")
+	gh.SetRunnerStatus("repos/foo/bar", "runner-1", githubapi.RunnerOnline, true)
+
+	err := gh.Client().DeleteRunner(context.Background(), githubapi.RepoScope("foo", "bar"), r.ID)
+	g.Expect(errors.Is(err, githubapi.ErrUnprocessable)).To(BeTrue())
+	g.Expect(gh.Runners("repos/foo/bar")).To(HaveLen(1))
+}
+
+func TestGenerateJITConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	gh := githubapitest.NewServer()
+	defer gh.Close()
+
+	var (
+		c    = gh.Client()
+		repo = githubapi.RepoScope("foo", "bar")
+	)
+
+	jit, err := c.GenerateJITConfig(context.Background(), repo, "runner-1", 0, []string{"self-hosted", "large"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(jit.Runner.Name).To(Equal("runner-1"))
+	g.Expect(jit.EncodedJITConfig).NotTo(BeEmpty())
+
+	runners := gh.Runners("repos/foo/bar")
+	g.Expect(runners).To(HaveLen(1))
+	g.Expect(runners[0].ID).To(Equal(jit.Runner.ID))
+	g.Expect(runners[0].Labels).To(Equal([]string{"self-hosted", "large"}))
+	g.Expect(runners[0].GroupID).To(BeEquivalentTo(githubapi.DefaultRunnerGroupID))
+	g.Expect(runners[0].JITConfig).To(Equal(jit.EncodedJITConfig))
+
+	listed, err := c.ListRunners(context.Background(), repo)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(listed).To(HaveLen(1))
+	g.Expect(listed[0].HasLabel("Large")).To(BeTrue())
+	g.Expect(listed[0].HasLabel("gpu")).To(BeFalse())
+
+	// runner names are unique within a scope
+	_, err = c.GenerateJITConfig(context.Background(), repo, "runner-1", 0, []string{"self-hosted"})
+	g.Expect(errors.Is(err, githubapi.ErrConflict)).To(BeTrue())
+
+	_, err = c.GenerateJITConfig(context.Background(), githubapi.RepoScope("foo", "baz"), "runner-1", 0, []string{"self-hosted"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = c.GenerateJITConfig(context.Background(), githubapi.OrgScope("foo"), "runner-1", 0, []string{"self-hosted"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gh.Runners("orgs/foo")).To(HaveLen(1))
+
+	// runners can go in an org's other groups, but only ones which exist
+	group := gh.AddRunnerGroup("orgs/foo", "builders")
+
+	_, err = c.GenerateJITConfig(context.Background(), githubapi.OrgScope("foo"), "runner-2", group, []string{"self-hosted"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gh.Runners("orgs/foo")[1].GroupID).To(Equal(group))
+
+	_, err = c.GenerateJITConfig(context.Background(), githubapi.OrgScope("foo"), "runner-3", group+1, []string{"self-hosted"})
+	g.Expect(errors.Is(err, githubapi.ErrNotFound)).To(BeTrue())
+
+	gh.Fail(http.StatusInternalServerError)
+
+	_, err = c.GenerateJITConfig(context.Background(), repo, "runner-2", 0, []string{"self-hosted"})
+	g.Expect(err).To(MatchError(ContainSubstring("failed to generate jit config for runner runner-2: github responded with 500")))
+}
+
+func TestRunnerGroups(t *testing.T) {
+	g := NewWithT(t)
+
+	gh := githubapitest.NewServer()
+	defer gh.Close()
+
+	var (
+		c   = gh.Client()
+		ctx = context.Background()
+		org = githubapi.OrgScope("foo")
+	)
+
+	builders := gh.AddRunnerGroup("orgs/foo", "builders", "foo/bar", "foo/baz")
+	gh.AddRunnerGroup("enterprises/acme", "everyone")
+
+	groups, err := c.ListRunnerGroups(ctx, org)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(groups).To(ConsistOf(
+		githubapi.RunnerGroup{ID: githubapi.DefaultRunnerGroupID, Name: "Default", Visibility: githubapi.RunnerGroupAll},
+		githubapi.RunnerGroup{ID: builders, Name: "builders", Visibility: githubapi.RunnerGroupSelected},
+	))
+
+	// names are compared without regard to case
+	group, err := c.RunnerGroupNamed(ctx, org, "Builders")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(group.ID).To(Equal(builders))
+
+	_, err = c.RunnerGroupNamed(ctx, org, "everyone")
+	g.Expect(err).To(MatchError(`runner group "everyone" in orgs/foo: not found`))
+
+	_, err = c.RunnerGroupNamed(ctx, githubapi.EnterpriseScope("acme"), "everyone")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	repos, err := c.RunnerGroupRepos(ctx, "foo", builders)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(repos).To(Equal([]string{"foo/bar", "foo/baz"}))
+
+	// repos do not have runner groups of their own
+	_, err = c.ListRunnerGroups(ctx, githubapi.RepoScope("foo", "bar"))
+	g.Expect(errors.Is(err, githubapi.ErrNotFound)).To(BeTrue())
+
+	gh.Fail(http.StatusInternalServerError)
+
+	_, err = c.ListRunnerGroups(ctx, org)
+	g.Expect(err).To(MatchError(ContainSubstring("failed to list runner groups: github responded with 500")))
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	g := NewWithT(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"total_count": 0, "runners": []}`))
+	}))
+	defer srv.Close()
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	tt := []struct {
+		name        string
+		bundle      []byte
+		expectedErr string
+	}{
+		{
+			name:   "the server's CA is in the bundle, it is trusted",
+			bundle: bundle,
+		},
+		{
+			name:        "no bundle, the server's CA is not trusted",
+			expectedErr: "certificate",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient, err := githubapi.NewHTTPClient(tc.bundle)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			c := githubapi.New(srv.URL, githubapi.StaticToken(func() string { return "token" }), httpClient)
+
+			_, err = c.ListRunners(context.Background(), githubapi.RepoScope("foo", "bar"))
+			if tc.expectedErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+
+	_, err := githubapi.NewHTTPClient([]byte("not a certificate"))
+	g.Expect(err).To(MatchError("no certificates found in ca bundle"))
+}
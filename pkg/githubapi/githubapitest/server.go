@@ -0,0 +1,586 @@
+// Package githubapitest runs a fake of the parts of the github REST api which
+// the service uses, for tests.
+package githubapitest
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+)
+
+// Token is the token the fake expects to be called with.
+const Token = "fake-token"
+
+// InstallationTokenLifetime is how long the installation tokens the fake mints
+// for a github app are valid for, the same as github's.
+const InstallationTokenLifetime = time.Hour
+
+// RegisteredRunner is a runner which was registered with the fake.
+type RegisteredRunner struct {
+	githubapi.Runner
+	// Scope is where the runner was registered, eg. repos/owner/repo or
+	// orgs/owner, see githubapi.Scope
+	Scope string
+	// Labels are the labels the runner was registered with
+	Labels []string
+	// GroupID is the runner group the runner was registered in
+	GroupID int64
+	// JITConfig is the config which was returned for the runner
+	JITConfig string
+}
+
+// Server is a fake github api. It is safe for concurrent use.
+type Server struct {
+	// URL is the base URL of the api
+	URL string
+
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	nextID      int64
+	nextGroupID int64
+	runners     []RegisteredRunner
+	groups      map[string][]runnerGroup
+	jobs        map[int64]string
+	fail        int
+	now         func() time.Time
+	app         *app
+}
+
+// runnerGroup is a runner group which was added to the fake, along with the
+// repos selected to use it.
+type runnerGroup struct {
+	githubapi.RunnerGroup
+	repos []string
+}
+
+// app is a github app which is installed on the fake.
+type app struct {
+	id             int64
+	installationID int64
+	key            *rsa.PublicKey
+	tokens         map[string]time.Time
+}
+
+// scopePattern matches the scope of a runner in a path, see githubapi.Scope.
+const scopePattern = `(repos/[^/]+/[^/]+|orgs/[^/]+|enterprises/[^/]+)`
+
+var (
+	jitConfigPath = regexp.MustCompile(`^/` + scopePattern + `/actions/runners/generate-jitconfig$`)
+	runnersPath   = regexp.MustCompile(`^/` + scopePattern + `/actions/runners$`)
+	runnerPath    = regexp.MustCompile(`^/` + scopePattern + `/actions/runners/(\d+)$`)
+	groupsPath    = regexp.MustCompile(`^/` + scopePattern + `/actions/runner-groups$`)
+	groupRepoPath = regexp.MustCompile(`^/(orgs/[^/]+)/actions/runner-groups/(\d+)/repositories$`)
+	jobPath       = regexp.MustCompile(`^/repos/([^/]+/[^/]+)/actions/jobs/(\d+)$`)
+
+	accessTokensPath = regexp.MustCompile(`^/app/installations/(\d+)/access_tokens$`)
+)
+
+// NewServer starts a fake github api. It must be closed when it is no longer
+// needed.
+func NewServer() *Server {
+	s := &Server{
+		nextID:      1,
+		nextGroupID: githubapi.DefaultRunnerGroupID + 1,
+		groups:      map[string][]runnerGroup{},
+		jobs:        map[int64]string{},
+		now:         time.Now,
+	}
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns a client for the fake.
+func (s *Server) Client() *githubapi.Client {
+	return githubapi.New(s.URL, githubapi.StaticToken(func() string { return Token }), nil)
+}
+
+// Runners returns the runners which are registered in the scope, eg.
+// repos/owner/repo.
+func (s *Server) Runners(scope string) []RegisteredRunner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var runners []RegisteredRunner
+
+	for _, r := range s.runners {
+		if r.Scope == scope {
+			runners = append(runners, r)
+		}
+	}
+
+	return runners
+}
+
+// AddRunner registers a runner with the labels in the scope, eg.
+// repos/owner/repo, as though it had been registered some other way.
+func (s *Server) AddRunner(scope, name string, labels ...string) RegisteredRunner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.register(scope, name, labels, githubapi.DefaultRunnerGroupID)
+}
+
+// SetRunnerStatus sets the status of the named runner in the scope, eg.
+// repos/owner/repo, and whether it is busy with a job.
+func (s *Server) SetRunnerStatus(scope, name, status string, busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.runners {
+		if r.Scope == scope && r.Name == name {
+			s.runners[i].Status = status
+			s.runners[i].Busy = busy
+		}
+	}
+}
+
+// AddRunnerGroup adds a runner group to the scope, eg. orgs/owner, and returns
+// its ID. When repos, as owner/name, are given only they may use the group,
+// otherwise every repo may. Every org and enterprise already has the default
+// group.
+func (s *Server) AddRunnerGroup(scope, name string, repos ...string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := runnerGroup{
+		RunnerGroup: githubapi.RunnerGroup{ID: s.nextGroupID, Name: name, Visibility: githubapi.RunnerGroupAll},
+		repos:       repos,
+	}
+
+	if len(repos) > 0 {
+		g.Visibility = githubapi.RunnerGroupSelected
+	}
+
+	s.nextGroupID++
+	s.groups[scope] = append(s.groups[scope], g)
+
+	return g.ID
+}
+
+// RemoveRunnerGroup removes the named runner group from the scope, eg.
+// orgs/owner.
+func (s *Server) RemoveRunnerGroup(scope, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, g := range s.groups[scope] {
+		if g.Name == name {
+			s.groups[scope] = append(s.groups[scope][:i], s.groups[scope][i+1:]...)
+			return
+		}
+	}
+}
+
+// RenameRunnerGroup renames the runner group in the scope, eg. orgs/owner,
+// keeping its ID.
+func (s *Server) RenameRunnerGroup(scope, name, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, g := range s.groups[scope] {
+		if g.Name == name {
+			s.groups[scope][i].Name = to
+			return
+		}
+	}
+}
+
+// SetJobStatus sets the status of a workflow job. Jobs without a status are
+// not found.
+func (s *Server) SetJobStatus(id int64, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[id] = status
+}
+
+// Fail makes every request fail with the status code, or succeed again when it
+// is 0.
+func (s *Server) Fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = status
+}
+
+// InstallApp installs a github app with the public half of its key on the fake.
+// Installation tokens can then be minted with a JWT signed by the app, and are
+// accepted as well as Token until they expire.
+func (s *Server) InstallApp(id, installationID int64, key *rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.app = &app{
+		id:             id,
+		installationID: installationID,
+		key:            key,
+		tokens:         map[string]time.Time{},
+	}
+}
+
+// MintedTokens returns how many installation tokens have been minted for the
+// app.
+func (s *Server) MintedTokens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.app == nil {
+		return 0
+	}
+
+	return len(s.app.tokens)
+}
+
+// SetClock replaces the clock the fake expires installation tokens with.
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = now
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if r.Method == http.MethodPost && accessTokensPath.MatchString(r.URL.Path) {
+		s.mintToken(w, token, parseID(accessTokensPath.FindStringSubmatch(r.URL.Path)[1]))
+		return
+	}
+
+	if !s.authorized(token) {
+		writeError(w, http.StatusUnauthorized, "Bad credentials")
+		return
+	}
+
+	if s.fail != 0 {
+		writeError(w, s.fail, "failed on purpose")
+		return
+	}
+
+	path := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodPost && jitConfigPath.MatchString(path):
+		s.generateJITConfig(w, r, jitConfigPath.FindStringSubmatch(path)[1])
+	case r.Method == http.MethodGet && runnersPath.MatchString(path):
+		s.listRunners(w, runnersPath.FindStringSubmatch(path)[1])
+	case r.Method == http.MethodDelete && runnerPath.MatchString(path):
+		match := runnerPath.FindStringSubmatch(path)
+		s.deleteRunner(w, match[1], parseID(match[2]))
+	case r.Method == http.MethodGet && groupsPath.MatchString(path):
+		s.listRunnerGroups(w, groupsPath.FindStringSubmatch(path)[1])
+	case r.Method == http.MethodGet && groupRepoPath.MatchString(path):
+		match := groupRepoPath.FindStringSubmatch(path)
+		s.listRunnerGroupRepos(w, match[1], parseID(match[2]))
+	case r.Method == http.MethodGet && jobPath.MatchString(path):
+		s.getJob(w, parseID(jobPath.FindStringSubmatch(path)[2]))
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+type jitConfigRequest struct {
+	Name          string   `json:"name"`
+	RunnerGroupID int64    `json:"runner_group_id"`
+	Labels        []string `json:"labels"`
+	WorkFolder    string   `json:"work_folder"`
+}
+
+func (s *Server) generateJITConfig(w http.ResponseWriter, r *http.Request, scope string) {
+	var req jitConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Name == "" || len(req.Labels) == 0 || req.RunnerGroupID == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "name, labels and runner_group_id are required")
+		return
+	}
+
+	if _, ok := s.runnerGroup(scope, req.RunnerGroupID); !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	for _, existing := range s.runners {
+		if existing.Scope == scope && existing.Name == req.Name {
+			writeError(w, http.StatusConflict, "Already exists - A runner with the same name already exists.")
+			return
+		}
+	}
+
+	runner := s.register(scope, req.Name, req.Labels, req.RunnerGroupID)
+
+	writeJSON(w, http.StatusCreated, githubapi.JITConfig{
+		Runner:           runner.Runner,
+		EncodedJITConfig: runner.JITConfig,
+	})
+}
+
+func (s *Server) listRunners(w http.ResponseWriter, scope string) {
+	runners := []githubapi.Runner{}
+
+	for _, r := range s.runners {
+		if r.Scope == scope {
+			runners = append(runners, r.Runner)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count": len(runners),
+		"runners":     runners,
+	})
+}
+
+func (s *Server) listRunnerGroups(w http.ResponseWriter, scope string) {
+	// repos only have the default group, which they cannot list
+	if strings.HasPrefix(scope, "repos/") {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	groups := []githubapi.RunnerGroup{defaultRunnerGroup}
+
+	for _, g := range s.groups[scope] {
+		groups = append(groups, g.RunnerGroup)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count":   len(groups),
+		"runner_groups": groups,
+	})
+}
+
+func (s *Server) listRunnerGroupRepos(w http.ResponseWriter, scope string, id int64) {
+	g, ok := s.runnerGroup(scope, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	repos := []map[string]string{}
+
+	for _, r := range g.repos {
+		repos = append(repos, map[string]string{"full_name": r})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count":  len(repos),
+		"repositories": repos,
+	})
+}
+
+var defaultRunnerGroup = githubapi.RunnerGroup{
+	ID:         githubapi.DefaultRunnerGroupID,
+	Name:       "Default",
+	Visibility: githubapi.RunnerGroupAll,
+}
+
+// runnerGroup returns the group in the scope with the id, which is always
+// there for the default group. It must be called with the lock held.
+func (s *Server) runnerGroup(scope string, id int64) (runnerGroup, bool) {
+	if id == githubapi.DefaultRunnerGroupID {
+		return runnerGroup{RunnerGroup: defaultRunnerGroup}, true
+	}
+
+	for _, g := range s.groups[scope] {
+		if g.ID == id {
+			return g, true
+		}
+	}
+
+	return runnerGroup{}, false
+}
+
+func (s *Server) deleteRunner(w http.ResponseWriter, scope string, id int64) {
+	for i, r := range s.runners {
+		if r.Scope == scope && r.ID == id {
+			if r.Busy {
+				writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Bad request - Runner %q is still running a job", r.Name))
+				return
+			}
+
+			s.runners = append(s.runners[:i], s.runners[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "Not Found")
+}
+
+func (s *Server) getJob(w http.ResponseWriter, id int64) {
+	status, ok := s.jobs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "status": status})
+}
+
+// authorized reports whether the token is Token or an installation token which
+// has not expired. It must be called with the lock held.
+func (s *Server) authorized(token string) bool {
+	if token == Token {
+		return true
+	}
+
+	if s.app == nil {
+		return false
+	}
+
+	expiresAt, ok := s.app.tokens[token]
+
+	return ok && s.now().Before(expiresAt)
+}
+
+// mintToken must be called with the lock held.
+func (s *Server) mintToken(w http.ResponseWriter, jwt string, installationID int64) {
+	if s.app == nil || installationID != s.app.installationID {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if err := s.app.verify(jwt); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if s.fail != 0 {
+		writeError(w, s.fail, "failed on purpose")
+		return
+	}
+
+	token := fmt.Sprintf("ghs_%d", len(s.app.tokens)+1)
+	expiresAt := s.now().Add(InstallationTokenLifetime).UTC().Truncate(time.Second)
+	s.app.tokens[token] = expiresAt
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// maxJWTLifetime is the longest github allows an app's JWT to be valid for.
+const maxJWTLifetime = 10 * time.Minute
+
+// verify checks the JWT was signed by the app and asks for no more than github
+// allows.
+func (a *app) verify(jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("A JSON web token could not be decoded")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodePart(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return errors.New("A JSON web token could not be decoded")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("A JSON web token could not be decoded")
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(a.key, crypto.SHA256, sum[:], sig); err != nil {
+		return errors.New("A JSON web token could not be decoded")
+	}
+
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+
+	if err := decodePart(parts[1], &claims); err != nil {
+		return errors.New("A JSON web token could not be decoded")
+	}
+
+	if claims.Issuer != strconv.FormatInt(a.id, 10) {
+		return errors.New("Integration not found")
+	}
+
+	lifetime := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second
+	if lifetime <= 0 || lifetime > maxJWTLifetime {
+		return errors.New("'Expiration time' claim ('exp') is too far in the future")
+	}
+
+	return nil
+}
+
+func decodePart(part string, v interface{}) error {
+	dat, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(dat, v)
+}
+
+// register must be called with the lock held.
+func (s *Server) register(scope, name string, labels []string, group int64) RegisteredRunner {
+	runnerLabels := []githubapi.RunnerLabel{}
+	for _, l := range labels {
+		runnerLabels = append(runnerLabels, githubapi.RunnerLabel{Name: l})
+	}
+
+	r := RegisteredRunner{
+		Runner:    githubapi.Runner{ID: s.nextID, Name: name, Status: githubapi.RunnerOffline, Labels: runnerLabels},
+		Scope:     scope,
+		Labels:    labels,
+		GroupID:   group,
+		JITConfig: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("jit-config-for-%s", name))),
+	}
+
+	s.nextID++
+	s.runners = append(s.runners, r)
+
+	return r
+}
+
+func parseID(s string) int64 {
+	id, _ := strconv.ParseInt(s, 10, 64)
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,206 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"k8s.io/utils/pointer"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi/githubapitest"
+)
+
+func TestHandleWebhookPost_JITConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name            string
+		setup           func(gh *githubapitest.Server)
+		createErr       error
+		expectedCreates int
+		expectedRunners int
+		expectedPending int
+	}{
+		{
+			name:            "the runner is registered and its microvm created",
+			expectedCreates: 1,
+			expectedRunners: 1,
+		},
+		{
+			name:            "the microvm cannot be created, the runner is removed from github again",
+			createErr:       errors.New("fail"),
+			expectedCreates: 1,
+			expectedPending: 1,
+		},
+		{
+			name: "github cannot be reached, no microvm is created and the job is pending",
+			setup: func(gh *githubapitest.Server) {
+				gh.Fail(http.StatusInternalServerError)
+			},
+			expectedPending: 1,
+		},
+		{
+			name: "a runner with the same name was left behind, it is replaced",
+			setup: func(gh *githubapitest.Server) {
+				gh.AddRunner("repos/foo/bar", expectedName("foo", 1))
+			},
+			expectedCreates: 1,
+			expectedRunners: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ht := newHandlerTest(t, g, newTestConfig())
+
+			if tc.setup != nil {
+				tc.setup(ht.gh)
+			}
+
+			ht.flClient.CreateReturns(fakeMicrovm("uid"), tc.createErr)
+
+			g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+
+			g.Expect(ht.flClient.CreateCallCount()).To(Equal(tc.expectedCreates))
+			g.Expect(ht.queue.Len()).To(Equal(tc.expectedPending))
+
+			ht.gh.Fail(0)
+			g.Expect(ht.gh.Runners("repos/foo/bar")).To(HaveLen(tc.expectedRunners))
+		})
+	}
+}
+
+func TestHandleWebhookPost_GitHubServer(t *testing.T) {
+	g := NewWithT(t)
+
+	bundle := []byte("-----BEGIN CERTIFICATE-----\nfoo\n-----END CERTIFICATE-----\n")
+
+	cfg := newTestConfig()
+	cfg.CABundleFile = filepath.Join(t.TempDir(), "ca.pem")
+	cfg.RunnerDownloadURL = "https://mirror.example.com/actions-runner"
+	g.Expect(os.WriteFile(cfg.CABundleFile, bundle, 0o600)).To(Succeed())
+
+	ht := newHandlerTest(t, g, cfg)
+	ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+
+	// the MicroVM trusts the bundle and fetches the runner from the mirror
+	data := userData(g, ht.flClient.CreateArgsForCall(0))
+	g.Expect(data).To(ContainSubstring(base64.StdEncoding.EncodeToString(bundle)))
+	g.Expect(data).To(ContainSubstring(cfg.RunnerDownloadURL))
+
+	// a bundle which cannot be read leaves the job pending, and github clean
+	g.Expect(os.Remove(cfg.CABundleFile)).To(Succeed())
+	g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 2))).To(Equal(http.StatusAccepted))
+
+	g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(ht.queue.Len()).To(Equal(1))
+	g.Expect(ht.gh.Runners("repos/foo/bar")).To(HaveLen(1))
+}
+
+func TestHandleWebhookPost_CompletedCleansUpRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		own   = expectedName("foo", 1)
+		other = expectedName("bar", 2)
+	)
+
+	tt := []struct {
+		name            string
+		ranOn           string
+		busy            bool
+		expectedDeleted []string
+		expectedRunners []string
+	}{
+		{
+			name:            "the job ran on its own runner, github removes it",
+			ranOn:           own,
+			expectedDeleted: []string{own},
+			expectedRunners: []string{own, other, "someone-else"},
+		},
+		{
+			name:            "the job ran on another job's runner, that runner is deleted and its own is left for the other job",
+			ranOn:           other,
+			expectedDeleted: []string{other},
+			expectedRunners: []string{own, other, "someone-else"},
+		},
+		{
+			name:            "the job ran on a runner the service does not own, its own is deregistered",
+			ranOn:           "someone-else",
+			expectedDeleted: []string{own},
+			expectedRunners: []string{other, "someone-else"},
+		},
+		{
+			name:            "the job was cancelled before it ran, its runner is deregistered",
+			expectedDeleted: []string{own},
+			expectedRunners: []string{other, "someone-else"},
+		},
+		{
+			name:            "the job was cancelled after its runner picked up another job, it is left for that job",
+			busy:            true,
+			expectedDeleted: []string{},
+			expectedRunners: []string{own, other, "someone-else"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ht := newHandlerTest(t, g, newTestConfig())
+			ht.gh.AddRunner("repos/foo/bar", "someone-else", "self-hosted")
+
+			ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+			ht.flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+			g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+			g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "bar", 2))).To(Equal(http.StatusAccepted))
+			g.Expect(ht.flClient.CreateCallCount()).To(Equal(2))
+
+			// flintlock returns the microvms as they were created, with the
+			// ids of their runners
+			ht.flClient.ListCalls(func(name, _ string) (*v1alpha1.ListMicroVMsResponse, error) {
+				for i := 0; i < ht.flClient.CreateCallCount(); i++ {
+					if spec := ht.flClient.CreateArgsForCall(i); spec.Id == name {
+						spec.Uid = pointer.String(name)
+						return &v1alpha1.ListMicroVMsResponse{Microvm: []*types.MicroVM{{Spec: spec}}}, nil
+					}
+				}
+
+				return &v1alpha1.ListMicroVMsResponse{}, nil
+			})
+
+			if tc.busy {
+				ht.gh.SetRunnerStatus("repos/foo/bar", own, githubapi.RunnerOnline, true)
+			}
+
+			completed := fakeEvent("completed", "foo", 1)
+			completed.WorkflowJob.RunnerName = tc.ranOn
+
+			g.Expect(send(ht.testHandler, ht.payloadService, completed)).To(Equal(http.StatusAccepted))
+
+			deleted := []string{}
+			for i := 0; i < ht.flClient.DeleteCallCount(); i++ {
+				deleted = append(deleted, ht.flClient.DeleteArgsForCall(i))
+			}
+
+			g.Expect(deleted).To(Equal(tc.expectedDeleted))
+
+			// the fake does not remove runners after their job like github does
+			names := []string{}
+			for _, r := range ht.gh.Runners("repos/foo/bar") {
+				names = append(names, r.Name)
+			}
+
+			g.Expect(names).To(ConsistOf(tc.expectedRunners))
+		})
+	}
+}
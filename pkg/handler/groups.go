@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+)
+
+// CheckRunnerGroups checks with github that every runner group the config
+// registers runners in exists, and that each repo whose runners go in a group
+// which only selected repos may use is one of them. Repos allowed by a
+// wildcard cannot be listed, so are not checked against selected repos.
+func (h handler) CheckRunnerGroups(ctx context.Context, cfg *config.Config) error {
+	ids := map[runnerGroupKey]int64{}
+
+	for _, u := range runnerGroupUses(cfg) {
+		group, err := h.GitHub.RunnerGroupNamed(ctx, u.scope, u.group)
+		if err != nil {
+			return err
+		}
+
+		ids[newRunnerGroupKey(u.scope, u.group)] = group.ID
+
+		if group.Visibility != githubapi.RunnerGroupSelected || cfg.RunnerScope != config.ScopeOrg {
+			continue
+		}
+
+		org, _, _ := strings.Cut(u.repos[0], "/")
+
+		selected, err := h.GitHub.RunnerGroupRepos(ctx, org, group.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, repo := range u.repos {
+			if !strings.HasSuffix(repo, "/*") && !containsFold(selected, repo) {
+				return fmt.Errorf("repo %s is not one of the repos which may use runner group %q in %s", repo, u.group, u.scope)
+			}
+		}
+	}
+
+	// the groups are only looked up again once the config is reloaded, or
+	// github no longer knows a group's ID
+	h.groups.replace(ids)
+
+	return nil
+}
+
+// runnerGroupUse is a runner group in a scope, along with the repos whose
+// runners are registered in it.
+type runnerGroupUse struct {
+	scope githubapi.Scope
+	group string
+	repos []string
+}
+
+// runnerGroupUses returns every runner group, other than the default one, the
+// config registers runners in.
+func runnerGroupUses(cfg *config.Config) []runnerGroupUse {
+	type key struct {
+		scope githubapi.Scope
+		group string
+	}
+
+	var (
+		uses     []runnerGroupUse
+		seen     = map[key]int{}
+		profiles = append([]config.Profile{{}}, cfg.Profiles...)
+	)
+
+	for _, repo := range cfg.Repos() {
+		for _, p := range profiles {
+			group := cfg.RunnerGroupFor(repo, p)
+			if group == "" {
+				continue
+			}
+
+			k := key{scope: scopeFor(cfg, repo), group: group}
+
+			i, ok := seen[k]
+			if !ok {
+				i = len(uses)
+				seen[k] = i
+				uses = append(uses, runnerGroupUse{scope: k.scope, group: group})
+			}
+
+			if !containsFold(uses[i].repos, repo) {
+				uses[i].repos = append(uses[i].repos, repo)
+			}
+		}
+	}
+
+	return uses
+}
+
+// runnerGroupID returns the ID of the named runner group in the scope, or 0
+// for the default group when the name is empty. IDs are cached, see
+// forgetRunnerGroup.
+func (h handler) runnerGroupID(ctx context.Context, scope githubapi.Scope, name string) (int64, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	key := newRunnerGroupKey(scope, name)
+
+	if id, ok := h.groups.get(key); ok {
+		return id, nil
+	}
+
+	group, err := h.GitHub.RunnerGroupNamed(ctx, scope, name)
+	if err != nil {
+		return 0, err
+	}
+
+	h.groups.set(key, group.ID)
+
+	return group.ID, nil
+}
+
+// forgetRunnerGroup drops the cached ID of the named runner group in the
+// scope, eg. because the group was deleted and created again.
+func (h handler) forgetRunnerGroup(scope githubapi.Scope, name string) {
+	h.groups.forget(newRunnerGroupKey(scope, name))
+}
+
+// runnerGroupKey is a runner group in a scope. Names are kept in lower case,
+// since github compares them without regard to case.
+type runnerGroupKey struct {
+	scope githubapi.Scope
+	name  string
+}
+
+func newRunnerGroupKey(scope githubapi.Scope, name string) runnerGroupKey {
+	return runnerGroupKey{scope: scope, name: strings.ToLower(name)}
+}
+
+// runnerGroupCache holds the IDs of runner groups, so that github is not asked
+// for them every time a runner is registered. It is safe for concurrent use.
+type runnerGroupCache struct {
+	mu  sync.Mutex
+	ids map[runnerGroupKey]int64
+}
+
+func newRunnerGroupCache() *runnerGroupCache {
+	return &runnerGroupCache{ids: map[runnerGroupKey]int64{}}
+}
+
+func (c *runnerGroupCache) get(key runnerGroupKey) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.ids[key]
+
+	return id, ok
+}
+
+func (c *runnerGroupCache) set(key runnerGroupKey, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids[key] = id
+}
+
+func (c *runnerGroupCache) forget(key runnerGroupKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.ids, key)
+}
+
+// replace swaps every cached ID for ids.
+func (c *runnerGroupCache) replace(ids map[runnerGroupKey]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids = ids
+}
+
+// containsFold returns true if s is in list, without regard to case.
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+
+	return false
+}
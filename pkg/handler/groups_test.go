@@ -0,0 +1,239 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi/githubapitest"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+func TestCheckRunnerGroups(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		setup       func(cfg *config.Config, gh *githubapitest.Server)
+		expectedErr string
+	}{
+		{
+			name: "no runner groups, github is not asked",
+			setup: func(_ *config.Config, gh *githubapitest.Server) {
+				gh.Fail(http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "every group exists",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RunnerGroup = "builders"
+				cfg.Profiles = []config.Profile{{Name: "gpu", RunnerGroup: "gpus"}}
+
+				gh.AddRunnerGroup("orgs/foo", "builders")
+				gh.AddRunnerGroup("orgs/foo", "gpus")
+			},
+		},
+		{
+			name: "a group does not exist",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RunnerGroup = "builders"
+				cfg.Profiles = []config.Profile{{Name: "gpu", RunnerGroup: "gpus"}}
+
+				gh.AddRunnerGroup("orgs/foo", "builders")
+			},
+			expectedErr: `runner group "gpus" in orgs/foo: not found`,
+		},
+		{
+			name: "the repo is one of the group's selected repos",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RepoRunnerGroups = map[string]string{"foo/bar": "builders"}
+
+				gh.AddRunnerGroup("orgs/foo", "builders", "foo/bar")
+			},
+		},
+		{
+			name: "the repo is not one of the group's selected repos",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RepoRunnerGroups = map[string]string{"foo/bar": "builders"}
+
+				gh.AddRunnerGroup("orgs/foo", "builders", "foo/other")
+			},
+			expectedErr: `repo foo/bar is not one of the repos which may use runner group "builders" in orgs/foo`,
+		},
+		{
+			name: "repos allowed by a wildcard are not checked against selected repos, named ones are",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.AllowedRepos = []string{"foo/*"}
+				cfg.RunnerGroup = "builders"
+
+				gh.AddRunnerGroup("orgs/foo", "builders", "foo/other")
+			},
+			expectedErr: `repo foo/bar is not one of the repos`,
+		},
+		{
+			name: "enterprise groups are looked up in the enterprise",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RunnerScope = config.ScopeEnterprise
+				cfg.Enterprise = "acme"
+				cfg.RunnerGroup = "builders"
+
+				gh.AddRunnerGroup("enterprises/acme", "builders")
+			},
+		},
+		{
+			name: "github cannot be reached",
+			setup: func(cfg *config.Config, gh *githubapitest.Server) {
+				cfg.RunnerGroup = "builders"
+
+				gh.Fail(http.StatusInternalServerError)
+			},
+			expectedErr: "failed to list runner groups: github responded with 500",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.RunnerScope = config.ScopeOrg
+
+			ht := newHandlerTest(t, g, cfg)
+			tc.setup(cfg, ht.gh)
+
+			err := ht.CheckRunnerGroups(context.Background(), cfg)
+			if tc.expectedErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+}
+
+func TestHandleWebhookPost_RunnerGroups(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name          string
+		group         string
+		addGroup      bool
+		expectedGroup int64
+		dropped       bool
+	}{
+		{
+			name:          "no group, the runner goes in the default group",
+			expectedGroup: githubapi.DefaultRunnerGroupID,
+		},
+		{
+			name:     "the runner goes in its group",
+			group:    "builders",
+			addGroup: true,
+		},
+		{
+			name:    "the group is not in github, the job is dropped",
+			group:   "builders",
+			dropped: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.RunnerScope = config.ScopeOrg
+			cfg.RunnerGroup = tc.group
+
+			ht := newHandlerTest(t, g, cfg)
+			ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+			expectedGroup := tc.expectedGroup
+			if tc.addGroup {
+				expectedGroup = ht.gh.AddRunnerGroup("orgs/foo", tc.group)
+			}
+
+			g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+			g.Expect(ht.queue.Len()).To(BeZero())
+
+			runners := ht.gh.Runners("orgs/foo")
+			if tc.dropped {
+				g.Expect(runners).To(BeEmpty())
+				g.Expect(ht.flClient.CreateCallCount()).To(BeZero())
+
+				return
+			}
+
+			g.Expect(runners).To(HaveLen(1))
+			g.Expect(runners[0].GroupID).To(Equal(expectedGroup))
+		})
+	}
+}
+
+func TestHandleWebhookPost_RunnerGroupIDs(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.RunnerScope = config.ScopeOrg
+	cfg.RunnerGroup = "builders"
+
+	ht := newHandlerTest(t, g, cfg)
+	ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	builders := ht.gh.AddRunnerGroup("orgs/foo", "builders")
+	g.Expect(ht.testHandler.CheckRunnerGroups(context.Background(), cfg)).To(Succeed())
+
+	// the group is renamed in github, the ID found by the check is still used
+	ht.gh.RenameRunnerGroup("orgs/foo", "builders", "renamed")
+
+	g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(ht.queue.Len()).To(BeZero())
+
+	runners := ht.gh.Runners("orgs/foo")
+	g.Expect(runners).To(HaveLen(1))
+	g.Expect(runners[0].GroupID).To(Equal(builders))
+
+	// the group is created again, its new ID is looked up once github does not
+	// know the old one
+	ht.gh.RemoveRunnerGroup("orgs/foo", "renamed")
+	recreated := ht.gh.AddRunnerGroup("orgs/foo", "builders")
+
+	g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "foo", 2))).To(Equal(http.StatusAccepted))
+	g.Expect(ht.queue.Len()).To(BeZero())
+
+	runners = ht.gh.Runners("orgs/foo")
+	g.Expect(runners).To(HaveLen(2))
+	g.Expect(runners[1].GroupID).To(Equal(recreated))
+}
+
+func TestWarmPool_RunnerGroupMustMatch(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.RunnerScope = config.ScopeOrg
+	cfg.AllowedRepos = []string{"foo/*"}
+	cfg.RepoRunnerGroups = map[string]string{"foo/secret": "secret"}
+	cfg.WarmPoolSize = 1
+
+	w := newHandlerTest(t, g, cfg)
+	h, payloadService, flClient := w.testHandler, w.payloadService, w.flClient
+
+	w.gh.AddRunnerGroup("orgs/foo", "secret")
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	w.fill()
+	h.workers.Wait()
+	g.Expect(w.pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1}}))
+
+	// the warm runner is in the default group, which the job's repo does not use
+	secret := fakeEvent("queued", "foo", 1)
+	secret.Repository.FullName = "foo/secret"
+	g.Expect(send(h, payloadService, secret)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateArgsForCall(1).Id).To(Equal(expectedName("foo", 1)))
+	g.Expect(w.pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1}}))
+
+	// but a job from a repo which uses the default group takes it
+	g.Expect(send(h, payloadService, fakeEvent("queued", "bar", 2))).To(Equal(http.StatusAccepted))
+	g.Expect(warmpool.IsWarm(flClient.CreateArgsForCall(2).Id)).To(BeTrue())
+}
@@ -1,23 +1,36 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
 
 	"github.com/go-playground/webhooks/v6/github"
 	"github.com/sirupsen/logrus"
 	"github.com/warehouse-13/hammertime/pkg/client"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
 
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/dedupe"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/payload"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
 )
 
 const (
-	eventQueued    = "queued"
-	eventCompleted = "completed"
+	eventQueued     = "queued"
+	eventInProgress = "in_progress"
+	eventCompleted  = "completed"
 )
 
 type ClientFunc func(string) (client.FlintlockClient, error)
@@ -31,20 +44,44 @@ func NewFlintClient(addr string) (client.FlintlockClient, error) {
 
 type handler struct {
 	Params
+
+	// drain keeps drains of the pending queue to one at a time, and tracks the
+	// jobs they are creating runners for
+	drain *drainState
+	// groups caches the IDs of the runner groups runners are registered in
+	groups *runnerGroupCache
+	// templates caches the profiles' userdata templates
+	templates *templateCache
 }
 
 // Params groups the init opts for a New handler object
 type Params struct {
-	*config.Config
+	// Config is read every time it is used, so it can be reloaded while the
+	// handler is running
+	Config  *config.Live
 	Client  ClientFunc
 	Payload payload.Payload
 	// TODO interface instead?
 	HostManager *host.Manager
-	L           *logrus.Entry
+	Queue       *queue.Queue
+	Workers     *worker.Pool
+	Seen        *dedupe.Cache
+	Metrics     *metrics.Metrics
+	// GitHub is used to register runners, and to check whether jobs have
+	// completed
+	GitHub *githubapi.Client
+	// Warm keeps track of the runners booted ahead of time for jobs. It is
+	// optional, when nil no warm runners are created.
+	Warm *warmpool.Pool
+	L    *logrus.Entry
 }
 
 // New returns a new handler
 func New(p Params) (handler, error) {
+	if p.Config == nil {
+		return handler{}, errors.New("config not provided")
+	}
+
 	if p.Client == nil {
 		return handler{}, errors.New("func to generate FlintlockClient not provided")
 	}
@@ -61,139 +98,546 @@ func New(p Params) (handler, error) {
 		return handler{}, errors.New("host manager not provided")
 	}
 
+	if p.Queue == nil {
+		return handler{}, errors.New("pending job queue not provided")
+	}
+
+	if p.Workers == nil {
+		return handler{}, errors.New("worker pool not provided")
+	}
+
+	if p.Seen == nil {
+		return handler{}, errors.New("dedupe cache not provided")
+	}
+
+	if p.Metrics == nil {
+		return handler{}, errors.New("metrics not provided")
+	}
+
+	if p.GitHub == nil {
+		return handler{}, errors.New("github client not provided")
+	}
+
 	return handler{
-		Params: p,
+		Params:    p,
+		drain:     newDrainState(),
+		groups:    newRunnerGroupCache(),
+		templates: newTemplateCache(),
 	}, nil
 }
 
 // HandleWebhookPost will respond to calls to the /webhook endpoint
 // It will Parse the payload and will proceed if the payload contains a
-// WorkflowJobPayload. From there it will either act on "queued" or "completed"
-// events. Anything else is ignored.
+// WorkflowJobPayload. "queued" and "completed" events are handed to the worker
+// pool to be processed in the background, and the request is answered with 202
+// straight away so that slow flintlock hosts do not make GitHub time out.
+// The progress of the work can be followed at the /jobs endpoint.
+// "in_progress" events are only used to see which warm runner a job went to.
+// Events which have already been received, either as a redelivery of the same
+// webhook or as a different delivery for the same job, are ignored, as are
+// events for jobs whose runs-on labels do not match the configured labels.
+// Anything else is ignored.
 func (h handler) HandleWebhookPost(w http.ResponseWriter, r *http.Request) {
-	h.L.Debug("webhook received")
+	log := h.L
+	if id := r.Header.Get(deliveryHeader); id != "" {
+		log = log.WithField(fieldDelivery, id)
+	}
+
+	log.Debug("webhook received")
 
 	event, err := h.Payload.Parse(r)
 	if err != nil {
-		h.L.Errorf("%d failed to parse webhook payload: %s", http.StatusInternalServerError, err)
+		log.WithError(err).Errorf("%d failed to parse webhook payload", http.StatusInternalServerError)
+		h.Metrics.Webhook("", metrics.OutcomeError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	if event == nil {
-		h.L.Debug("payload type is unknown")
+		log.Debug("payload type is unknown")
+		h.Metrics.Webhook("", metrics.OutcomeIgnored)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	h.L.Debugf("workflow event found %s", event.WorkflowJob.RunURL)
+	log = jobLogger(log, *event)
+	log.Debugf("workflow event found %s", event.WorkflowJob.RunURL)
+
+	var process func(*logrus.Entry, github.WorkflowJobPayload) error
 
 	switch event.Action {
 	case eventQueued:
-		if err := h.processQueuedAction(*event); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		process = h.processQueuedAction
 	case eventCompleted:
-		if err := h.processCompletedAction(*event); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		process = h.processCompletedAction
+	case eventInProgress:
+		h.Metrics.Webhook(event.Action, h.processInProgressAction(log, *event))
+		w.WriteHeader(http.StatusOK)
+		return
 	default:
-		h.L.Debugf("event type is unknown: %s", event.Action)
+		log.Debug("event type is unknown")
+		h.Metrics.Webhook(event.Action, metrics.OutcomeIgnored)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !h.matchesLabels(event.WorkflowJob.Labels) {
+		log.Debugf("ignoring event for job with labels %v", event.WorkflowJob.Labels)
+		h.Metrics.Webhook(event.Action, metrics.OutcomeIgnored)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := checkRepo(h.Config.Get(), *event); err != nil {
+		log.WithError(err).Warnf("%d rejecting event", http.StatusForbidden)
+		h.Metrics.Webhook(event.Action, metrics.OutcomeRejected)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	keys := dedupeKeys(r, *event)
+	if h.Seen.Seen(keys...) {
+		log.Info("ignoring duplicate event")
+		h.Metrics.Webhook(event.Action, metrics.OutcomeDuplicate)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := taskID(r, *event)
+	p := *event
+
+	task := func() error {
+		err := process(log, p)
+		h.Metrics.EventAttempt(p.Action, err)
+
+		return err
+	}
+
+	// GitHub does not redeliver a failed event itself, but one redelivered by
+	// hand should not be mistaken for a duplicate
+	failed := func(error) {
+		h.Seen.Forget(keys...)
+	}
+
+	if err := h.Workers.SubmitWithFailure(id, task, failed); err != nil {
+		log.WithError(err).Errorf("%d failed to submit event for processing", http.StatusServiceUnavailable)
+		// GitHub will redeliver, which should not be mistaken for a duplicate
+		h.Seen.Forget(keys...)
+		h.Metrics.Webhook(event.Action, metrics.OutcomeRejected)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	log.Debugf("submitted event for processing, task id: %s", id)
+
+	h.Metrics.Webhook(event.Action, metrics.OutcomeAccepted)
+
+	w.Header().Set("Location", jobsPath+id)
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func (h handler) processQueuedAction(p github.WorkflowJobPayload) error {
-	h.L.Infof("proccessing queued action for workflow (job-id: %d) (step-id: %d)", p.WorkflowJob.RunID, p.WorkflowJob.ID)
+func (h handler) processQueuedAction(log *logrus.Entry, p github.WorkflowJobPayload) error {
+	log.Info("processing queued event")
 
 	name := generateName(p)
 
-	host, err := h.HostManager.Assign(name)
+	if h.claimWarmRunner(log, name, p) {
+		return nil
+	}
+
+	// jobs which are already pending go first, so the job joins the back of the
+	// queue, which is drained straight away
+	behind := h.Queue.Len() > 0
+
+	if !behind {
+		err := h.createRunner(log, name, p)
+
+		switch {
+		case err == nil:
+			return nil
+		case permanent(err):
+			log.WithError(err).Error("dropping job, a runner can never be created for it")
+			return nil
+		}
+
+		log.WithError(err).Warn("could not create runner, adding job to pending queue")
+	}
+
+	if err := h.Queue.Push(name, p); err != nil {
+		log.WithError(err).Error("failed to add job to pending queue")
+		return err
+	}
+
+	h.Metrics.PendingAdded()
+
+	log.Infof("job is pending, %d jobs in queue", h.Queue.Len())
+
+	if behind {
+		h.DrainQueue()
+	}
+
+	return nil
+}
+
+// createRunner creates a runner for the job, with the profile its labels
+// select.
+func (h handler) createRunner(log *logrus.Entry, name string, p github.WorkflowJobPayload) error {
+	profile, _ := config.SelectProfile(h.Config.Get().Profiles, p.WorkflowJob.Labels)
+	if profile.Name != "" {
+		log.Debugf("using profile %s", profile.Name)
+	}
+
+	return h.provision(log, name, p.Repository.FullName, p.WorkflowJob.Labels, profile)
+}
+
+// provision schedules the runner onto a host, registers it with github for the
+// repo, given as owner/name, and creates its MicroVM. If the MicroVM cannot be
+// created the host is freed up again.
+func (h handler) provision(log *logrus.Entry, name, repo string, labels []string, profile config.Profile) error {
+	mvm, err := microvm.New(name, profile)
+	if err != nil {
+		log.WithError(err).Error("failed to generate microvm spec")
+		return err
+	}
+
+	microvm.SetRepo(mvm, repo)
+
+	// the host is found first so that runners are only registered when there is
+	// room for them
+	host, err := h.HostManager.Assign(name, resourcesOf(mvm))
 	if err != nil {
-		h.L.Errorf("failed to assign host to runner: %s", err)
+		log.WithError(err).Error("failed to assign host to runner")
 		return err
 	}
 
+	log = log.WithField(fieldHost, host)
+
+	if err := h.startRunner(log, host, repo, profile, mvm, labels); err != nil {
+		if err := h.HostManager.Unassign(name); err != nil {
+			log.WithError(err).Error("failed to unassign host from runner")
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// startRunner registers the runner with github, in the runner group for the
+// repo and profile, and creates its MicroVM, which runs the runner with the
+// just in time config github returned. The MicroVM is never given the token.
+// If the MicroVM cannot be created the runner is removed from github again.
+func (h handler) startRunner(log *logrus.Entry, host, repo string, profile config.Profile, mvm *types.MicroVMSpec, labels []string) error {
+	var (
+		cfg   = h.Config.Get()
+		ctx   = context.Background()
+		scope = scopeFor(cfg, repo)
+	)
+
+	group := cfg.RunnerGroupFor(repo, profile)
+
+	groupID, err := h.runnerGroupID(ctx, scope, group)
+	if err != nil {
+		log.WithError(err).Error("failed to find runner group")
+		return err
+	}
+
+	jit, err := h.GitHub.GenerateJITConfig(ctx, scope, mvm.Id, groupID, microvm.Labels(labels))
+	if errors.Is(err, githubapi.ErrNotFound) && group != "" {
+		// the group may have been created again since its ID was cached
+		log.Warn("runner group not found, looking it up again")
+		h.forgetRunnerGroup(scope, group)
+
+		if groupID, err = h.runnerGroupID(ctx, scope, group); err == nil {
+			jit, err = h.GitHub.GenerateJITConfig(ctx, scope, mvm.Id, groupID, microvm.Labels(labels))
+		}
+	}
+
+	if errors.Is(err, githubapi.ErrConflict) {
+		// left behind by an earlier attempt which could not clean up after itself
+		log.Warn("runner is already registered, replacing it")
+
+		if r, err := h.runnerNamed(ctx, scope, mvm.Id); err != nil {
+			log.WithError(err).Warn("failed to find runner in github")
+		} else {
+			h.deleteRegisteredRunner(ctx, scope, log, r.ID)
+		}
+
+		jit, err = h.GitHub.GenerateJITConfig(ctx, scope, mvm.Id, groupID, microvm.Labels(labels))
+	}
+
+	if err != nil {
+		log.WithError(err).Error("failed to register runner with github")
+		return err
+	}
+
+	// kept so that the runner can be deregistered without looking for it
+	microvm.SetRunnerID(mvm, jit.Runner.ID)
+
+	bootstrap := microvm.Bootstrap{
+		JITConfig:         jit.EncodedJITConfig,
+		PublicKey:         cfg.SSHPublicKey,
+		RunnerDownloadURL: cfg.RunnerDownloadURL,
+	}
+
+	if cfg.CABundleFile != "" {
+		// read every time so that a renewed bundle reaches new MicroVMs
+		bootstrap.CABundle, err = os.ReadFile(cfg.CABundleFile)
+		if err != nil {
+			log.WithError(err).Error("failed to read ca bundle")
+			h.deleteRegisteredRunner(ctx, scope, log, jit.Runner.ID)
+
+			return err
+		}
+	}
+
+	bootstrap.Template, err = h.userDataTemplate(profile)
+	if err != nil {
+		log.WithError(err).Error("failed to load userdata template")
+		h.deleteRegisteredRunner(ctx, scope, log, jit.Runner.ID)
+
+		return err
+	}
+
+	if err := microvm.SetUserData(mvm, bootstrap); err != nil {
+		log.WithError(err).Error("failed to generate microvm userdata")
+		h.deleteRegisteredRunner(ctx, scope, log, jit.Runner.ID)
+
+		return err
+	}
+
+	if err := h.createMicrovm(log, host, mvm); err != nil {
+		h.deleteRegisteredRunner(ctx, scope, log, jit.Runner.ID)
+		return err
+	}
+
+	return nil
+}
+
+// deleteRegisteredRunner removes a runner which never started from github.
+func (h handler) deleteRegisteredRunner(ctx context.Context, scope githubapi.Scope, log *logrus.Entry, id int64) {
+	if err := h.GitHub.DeleteRunner(ctx, scope, id); err != nil {
+		log.WithError(err).Warn("failed to remove runner from github")
+	}
+}
+
+func (h handler) createMicrovm(log *logrus.Entry, host string, mvm *types.MicroVMSpec) error {
 	fl, err := h.Client(host)
 	if err != nil {
-		h.L.Errorf("failed to create flintlock client: %s", err)
+		log.WithError(err).Error("failed to create flintlock client")
 		return err
 	}
 
 	defer func() {
 		if err := fl.Close(); err != nil {
-			h.L.Errorf("failed to close connection to flintlock host to %s: %s", host, err)
+			log.WithError(err).Error("failed to close connection to flintlock host")
 		}
 	}()
 
-	mvm, err := microvm.New(h.APIToken, h.SSHPublicKey, h.Username, h.Repository, name)
+	log.Debug("creating microvm")
+
+	var created *v1alpha1.CreateMicroVMResponse
+
+	err = h.Metrics.ObserveFlintlock(metrics.OpCreate, func() error {
+		created, err = fl.Create(mvm)
+		return err
+	})
 	if err != nil {
-		h.L.Errorf("failed to generate microvm spec: %s", err)
+		log.WithError(err).Error("failed to create microvm")
 		return err
 	}
 
-	h.L.Debugf("creating microvm %s", name)
-	created, err := fl.Create(mvm)
+	log.WithField(fieldMicroVMUID, *created.Microvm.Spec.Uid).Info("created microvm")
+
+	return nil
+}
+
+func (h handler) processCompletedAction(log *logrus.Entry, p github.WorkflowJobPayload) error {
+	log.Info("processing completed event")
+
+	name := generateName(p)
+
+	// warm runners only ever run one job, so they are deleted along with it
+	if runner := p.WorkflowJob.RunnerName; warmpool.IsWarm(runner) {
+		return h.deleteWarmRunner(log, name, runner)
+	}
+
+	if h.Warm != nil && h.Warm.Release(name) {
+		log.Info("job completed before it was picked up by a warm runner, no microvm to delete")
+		return nil
+	}
+
+	removed, creating, err := h.drain.complete(h.Queue, name)
 	if err != nil {
-		h.L.Errorf("failed to create microvm: %s", err)
+		log.WithError(err).Error("failed to remove job from pending queue")
 		return err
 	}
 
-	h.L.Infof("created microvm, name: %s, uid: %s", name, *created.Microvm.Spec.Uid)
+	switch {
+	case creating != nil:
+		// a drain is giving the job a runner right now, which is deleted below
+		// once it has been created
+		<-creating
 
-	return nil
+		if !h.ownsRunner(name) {
+			log.Info("job completed before its runner could be created, no microvm to delete")
+			return nil
+		}
+	case removed:
+		log.Info("job completed while still pending, no microvm to delete")
+		return nil
+	}
+
+	runner := p.WorkflowJob.RunnerName
+
+	switch {
+	case runner == name:
+		// github removes the runner itself once it has run its one job
+		return h.deleteRunner(log, name)
+	case h.ownsRunner(runner):
+		// the runner was created for another job, which is left the job's own
+		// runner instead
+		log.Infof("job was run by runner %s", runner)
+		return h.deleteRunner(log.WithField(fieldRunner, runner), runner)
+	default:
+		// the job was cancelled before it started, or run by a runner the
+		// service does not own, so its own runner never ran it
+		return h.retireRunner(log, name)
+	}
 }
 
-func (h handler) processCompletedAction(p github.WorkflowJobPayload) error {
-	h.L.Infof("proccessing complete action for workflow (job-id: %d) (step-id: %d)", p.WorkflowJob.RunID, p.WorkflowJob.ID)
+// ownsRunner returns true if the runner's MicroVM was created by the service
+// and has not been deleted yet.
+func (h handler) ownsRunner(name string) bool {
+	if name == "" {
+		return false
+	}
 
-	name := generateName(p)
+	_, err := h.HostManager.Lookup(name)
+
+	return err == nil
+}
+
+// deleteRunner deletes the runner's MicroVM from the host it was assigned to
+// and frees up the host.
+func (h handler) deleteRunner(log *logrus.Entry, name string) error {
+	return h.deleteMicrovm(log, name, nil)
+}
+
+// retireRunner removes a runner which did not run its job from github and then
+// deletes its MicroVM. The MicroVM is only deleted once github has let go of
+// the runner, so a runner which has picked up another job in the meantime is
+// left for that job to clean up.
+func (h handler) retireRunner(log *logrus.Entry, name string) error {
+	if _, err := h.HostManager.Lookup(name); err != nil {
+		log.Debug("runner has no microvm, nothing to retire")
+		return nil
+	}
+
+	return h.deleteMicrovm(log, name, func(spec *types.MicroVMSpec) (bool, error) {
+		cfg := h.Config.Get()
+
+		repo, ok := repoOf(cfg, spec)
+		if !ok {
+			return true, nil
+		}
 
+		err := h.deregisterRunner(context.Background(), scopeFor(cfg, repo), spec)
+
+		switch {
+		case err == nil:
+			log.Info("deregistered runner")
+			return true, nil
+		case errors.Is(err, githubapi.ErrUnprocessable):
+			log.Info("runner is running another job, leaving it for that job to clean up")
+			return false, nil
+		case errors.Is(err, githubapi.ErrNotFound):
+			log.Info("runner has already left github, leaving it for the job it ran to clean up")
+			return false, nil
+		default:
+			log.WithError(err).Error("failed to deregister runner")
+			return false, err
+		}
+	})
+}
+
+// deleteMicrovm deletes the runner's MicroVM and frees up its host. If before
+// is not nil it is called with the MicroVM first, and the MicroVM is only
+// deleted if it returns true.
+func (h handler) deleteMicrovm(log *logrus.Entry, name string, before func(*types.MicroVMSpec) (bool, error)) error {
 	host, err := h.HostManager.Lookup(name)
 	if err != nil {
-		h.L.Errorf("failed to look up host for runner: %s", err)
+		log.WithError(err).Error("failed to look up host for runner")
 		return err
 	}
 
+	log = log.WithField(fieldHost, host)
+
 	fl, err := h.Client(host)
 	if err != nil {
-		h.L.Errorf("failed to create flintlock client %s", err)
+		log.WithError(err).Error("failed to create flintlock client")
 		return err
 	}
 
 	defer func() {
 		if err := fl.Close(); err != nil {
-			h.L.Errorf("failed to close connection to flintlock host %s: %s", "address", err)
+			log.WithError(err).Error("failed to close connection to flintlock host")
 		}
 	}()
 
-	h.L.Debugf("looking up microvm for action %s/%s", microvm.Namespace, name)
-	resp, err := fl.List(name, microvm.Namespace)
+	log.Debugf("looking up microvm %s/%s", microvm.Namespace, name)
+
+	var resp *v1alpha1.ListMicroVMsResponse
+
+	err = h.Metrics.ObserveFlintlock(metrics.OpList, func() error {
+		resp, err = fl.List(name, microvm.Namespace)
+		return err
+	})
 	if err != nil {
-		h.L.Errorf("failed to list microvms %s", err)
+		log.WithError(err).Error("failed to list microvms")
 		return err
 	}
 
 	if len(resp.Microvm) == 0 {
-		h.L.Debugf("no microvms found in %s/%s", microvm.Namespace, name)
-		return err
+		log.Debugf("no microvms found in %s/%s", microvm.Namespace, name)
+		return h.unassign(log, name)
+	}
+
+	if before != nil {
+		if ok, err := before(resp.Microvm[0].Spec); !ok || err != nil {
+			return err
+		}
 	}
 
 	// TODO this is only safe if I am totally sure the name is unique...
 	uid := resp.Microvm[0].Spec.Uid
 
-	h.L.Debugf("deleting microvm, name: %s, uid: %s", name, *uid)
-	if _, err := fl.Delete(*uid); err != nil {
-		h.L.Errorf("failed to delete microvm: %s", err)
+	log = log.WithField(fieldMicroVMUID, *uid)
+
+	log.Debug("deleting microvm")
+	err = h.Metrics.ObserveFlintlock(metrics.OpDelete, func() error {
+		_, err := fl.Delete(*uid)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to delete microvm")
 		return err
 	}
 
-	h.L.Infof("deleted microvm, name: %s, uid: %s", name, *uid)
+	log.Info("deleted microvm")
+
+	return h.unassign(log, name)
+}
+
+// unassign frees up the runner's host and then gives any pending jobs a chance
+// to use the space.
+func (h handler) unassign(log *logrus.Entry, name string) error {
+	if err := h.HostManager.Unassign(name); err != nil {
+		log.WithError(err).Error("failed to unassign host from runner")
+		return err
+	}
 
-	h.HostManager.Unassign(name)
+	h.DrainQueue()
 
 	return nil
 }
@@ -201,3 +645,41 @@ func (h handler) processCompletedAction(p github.WorkflowJobPayload) error {
 func generateName(p github.WorkflowJobPayload) string {
 	return fmt.Sprintf("%s-%d-%d", p.WorkflowJob.NodeID, p.WorkflowJob.ID, p.WorkflowJob.RunID)
 }
+
+// resourcesOf returns how much of a host the MicroVM will take up.
+func resourcesOf(mvm *types.MicroVMSpec) host.Resources {
+	return host.Resources{
+		VCPU:      int(mvm.Vcpu),
+		MemoryMiB: int(mvm.MemoryInMb),
+	}
+}
+
+// jobRef holds the workflow job details which are encoded in a runner's name.
+type jobRef struct {
+	NodeID string
+	ID     int64
+	RunID  int64
+}
+
+var nameRegex = regexp.MustCompile(`^(.+)-(\d+)-(\d+)$`)
+
+// parseName is the reverse of generateName. It returns false if the name could
+// not have been generated by this service.
+func parseName(name string) (jobRef, bool) {
+	match := nameRegex.FindStringSubmatch(name)
+	if match == nil {
+		return jobRef{}, false
+	}
+
+	id, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return jobRef{}, false
+	}
+
+	runID, err := strconv.ParseInt(match[3], 10, 64)
+	if err != nil {
+		return jobRef{}, false
+	}
+
+	return jobRef{NodeID: match[1], ID: id, RunID: runID}, true
+}
@@ -1,12 +1,16 @@
 package handler_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-playground/webhooks/v6/github"
 	. "github.com/onsi/gomega"
@@ -18,17 +22,30 @@ import (
 	"k8s.io/utils/pointer"
 
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/dedupe"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi/githubapitest"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler/fakes"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
 )
 
+func TestNew_WithoutConfigShouldError(t *testing.T) {
+	g := NewWithT(t)
+	_, err := handler.New(handler.Params{})
+	g.Expect(err).To(MatchError("config not provided"))
+}
+
 func TestNew_WithoutClientFuncShouldError(t *testing.T) {
 	g := NewWithT(t)
 	cfg := newTestConfig()
 	p := handler.Params{
-		Config: cfg,
+		Config: config.NewLive(cfg),
 	}
 	_, err := handler.New(p)
 	g.Expect(err).To(MatchError("func to generate FlintlockClient not provided"))
@@ -38,7 +55,7 @@ func TestNew_WithoutLoggerShouldError(t *testing.T) {
 	g := NewWithT(t)
 	cfg := newTestConfig()
 	p := handler.Params{
-		Config: cfg,
+		Config: config.NewLive(cfg),
 		Client: func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
 	}
 	_, err := handler.New(p)
@@ -49,7 +66,7 @@ func TestNew_WithoutPayloadShouldError(t *testing.T) {
 	g := NewWithT(t)
 	cfg := newTestConfig()
 	p := handler.Params{
-		Config: cfg,
+		Config: config.NewLive(cfg),
 		Client: func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
 		L:      nullLogger(),
 	}
@@ -61,7 +78,7 @@ func TestNew_WithoutHostManagerShouldError(t *testing.T) {
 	g := NewWithT(t)
 	cfg := newTestConfig()
 	p := handler.Params{
-		Config:  cfg,
+		Config:  config.NewLive(cfg),
 		Client:  func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
 		L:       nullLogger(),
 		Payload: &fakes.FakePayload{},
@@ -70,6 +87,106 @@ func TestNew_WithoutHostManagerShouldError(t *testing.T) {
 	g.Expect(err).To(MatchError("host manager not provided"))
 }
 
+func TestNew_WithoutQueueShouldError(t *testing.T) {
+	g := NewWithT(t)
+	cfg := newTestConfig()
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
+		L:           nullLogger(),
+		Payload:     &fakes.FakePayload{},
+		HostManager: manager,
+	}
+	_, err = handler.New(p)
+	g.Expect(err).To(MatchError("pending job queue not provided"))
+}
+
+func TestNew_WithoutWorkersShouldError(t *testing.T) {
+	g := NewWithT(t)
+	cfg := newTestConfig()
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
+		L:           nullLogger(),
+		Payload:     &fakes.FakePayload{},
+		HostManager: manager,
+		Queue:       newTestQueue(g, 0),
+	}
+	_, err = handler.New(p)
+	g.Expect(err).To(MatchError("worker pool not provided"))
+}
+
+func TestNew_WithoutDedupeCacheShouldError(t *testing.T) {
+	g := NewWithT(t)
+	cfg := newTestConfig()
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
+		L:           nullLogger(),
+		Payload:     &fakes.FakePayload{},
+		HostManager: manager,
+		Queue:       newTestQueue(g, 0),
+		Workers:     newTestWorkers(t),
+	}
+	_, err = handler.New(p)
+	g.Expect(err).To(MatchError("dedupe cache not provided"))
+}
+
+func TestNew_WithoutMetricsShouldError(t *testing.T) {
+	g := NewWithT(t)
+	cfg := newTestConfig()
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
+		L:           nullLogger(),
+		Payload:     &fakes.FakePayload{},
+		HostManager: manager,
+		Queue:       newTestQueue(g, 0),
+		Workers:     newTestWorkers(t),
+		Seen:        dedupe.New(time.Hour),
+	}
+	_, err = handler.New(p)
+	g.Expect(err).To(MatchError("metrics not provided"))
+}
+
+func TestNew_WithoutGitHubShouldError(t *testing.T) {
+	g := NewWithT(t)
+	cfg := newTestConfig()
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      func(string) (client.FlintlockClient, error) { return &fakes.FakeFlintlockClient{}, nil },
+		L:           nullLogger(),
+		Payload:     &fakes.FakePayload{},
+		HostManager: manager,
+		Queue:       newTestQueue(g, 0),
+		Workers:     newTestWorkers(t),
+		Seen:        dedupe.New(time.Hour),
+		Metrics:     metrics.New(),
+	}
+	_, err = handler.New(p)
+	g.Expect(err).To(MatchError("github client not provided"))
+}
+
 func TestHandleWebhookPost(t *testing.T) {
 	g := NewWithT(t)
 
@@ -89,6 +206,8 @@ func TestHandleWebhookPost(t *testing.T) {
 		fakesReturn    func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expected       func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expectedStatus int
+		expectedState  worker.State
+		expectedQueue  int
 	}{
 		{
 			name:     "payload service parse fails, processing any event fails",
@@ -129,7 +248,7 @@ func TestHandleWebhookPost(t *testing.T) {
 			expectedStatus: http.StatusOK,
 		},
 		{
-			name:     "client func fails, processing queued event fails",
+			name:     "client func fails, processing queued event adds the job to the pending queue",
 			event:    queued,
 			clientFn: newBadClient,
 			fakesReturn: func(payloadService *fakes.FakePayload, _ *fakes.FakeFlintlockClient) {
@@ -140,7 +259,9 @@ func TestHandleWebhookPost(t *testing.T) {
 				g.Expect(flClient.ListCallCount()).To(Equal(0))
 				g.Expect(flClient.DeleteCallCount()).To(Equal(0))
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateSucceeded,
+			expectedQueue:  1,
 		},
 		{
 			name:     "client func fails, processing completed event fails",
@@ -154,35 +275,25 @@ func TestHandleWebhookPost(t *testing.T) {
 				g.Expect(flClient.ListCallCount()).To(Equal(0))
 				g.Expect(flClient.DeleteCallCount()).To(Equal(0))
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateFailed,
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			var (
-				payloadService = &fakes.FakePayload{}
-				flClient       = fakes.FakeFlintlockClient{}
-				flClientFn     = tc.clientFn(&flClient)
-			)
-
-			p := handler.Params{
-				Config:      cfg,
-				Client:      flClientFn,
-				Payload:     payloadService,
-				HostManager: host.New(cfg.Hosts),
-				L:           nullLogger(),
-			}
-			h, err := handler.New(p)
-			g.Expect(err).NotTo(HaveOccurred())
+			ht := newHandlerTest(t, g, cfg, withClient(tc.clientFn))
 			r := httptest.NewRecorder()
 
-			tc.fakesReturn(payloadService, &flClient)
+			tc.fakesReturn(ht.payloadService, ht.flClient)
 
-			h.HandleWebhookPost(r, &http.Request{})
+			ht.HandleWebhookPost(r, newWebhookRequest(testDeliveryID))
+			ht.workers.Wait()
 
 			g.Expect(r.Result().StatusCode).To(Equal(tc.expectedStatus))
-			tc.expected(payloadService, &flClient)
+			expectTaskState(g, ht.workers, testDeliveryID, tc.expectedState)
+			g.Expect(ht.queue.Len()).To(Equal(tc.expectedQueue))
+			tc.expected(ht.payloadService, ht.flClient)
 		})
 	}
 }
@@ -204,6 +315,8 @@ func TestHandleWebhookPost_Queued(t *testing.T) {
 		fakesReturn    func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expected       func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expectedStatus int
+		expectedState  worker.State
+		expectedQueue  int
 	}{
 		{
 			name: "payload service parse fails, processing any event fails",
@@ -239,10 +352,11 @@ func TestHandleWebhookPost_Queued(t *testing.T) {
 				g.Expect(flClient.CreateArgsForCall(0).Id).To(Equal(expectedName(nodeId, runId)))
 				g.Expect(flClient.CreateArgsForCall(0).Namespace).To(Equal(microvm.Namespace))
 			},
-			expectedStatus: http.StatusOK,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateSucceeded,
 		},
 		{
-			name: "flintlock client create call fails, processing queued event fails",
+			name: "flintlock client create call fails, processing queued event adds the job to the pending queue",
 			fakesReturn: func(payloadService *fakes.FakePayload, flClient *fakes.FakeFlintlockClient) {
 				payloadService.ParseReturns(fakeEvent(queued, nodeId, runId), nil)
 				flClient.CreateReturns(nil, errors.New("fail"))
@@ -251,35 +365,26 @@ func TestHandleWebhookPost_Queued(t *testing.T) {
 				g.Expect(payloadService.ParseCallCount()).To(Equal(1))
 				g.Expect(flClient.CreateCallCount()).To(Equal(1))
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateSucceeded,
+			expectedQueue:  1,
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			var (
-				payloadService = &fakes.FakePayload{}
-				flClient       = fakes.FakeFlintlockClient{}
-				flClientFn     = newFakeClient(&flClient)
-			)
-
-			p := handler.Params{
-				Config:      cfg,
-				Client:      flClientFn,
-				Payload:     payloadService,
-				HostManager: host.New(cfg.Hosts),
-				L:           nullLogger(),
-			}
-			h, err := handler.New(p)
-			g.Expect(err).NotTo(HaveOccurred())
+			ht := newHandlerTest(t, g, cfg)
 			r := httptest.NewRecorder()
 
-			tc.fakesReturn(payloadService, &flClient)
+			tc.fakesReturn(ht.payloadService, ht.flClient)
 
-			h.HandleWebhookPost(r, &http.Request{})
+			ht.HandleWebhookPost(r, newWebhookRequest(testDeliveryID))
+			ht.workers.Wait()
 
 			g.Expect(r.Result().StatusCode).To(Equal(tc.expectedStatus))
-			tc.expected(payloadService, &flClient)
+			expectTaskState(g, ht.workers, testDeliveryID, tc.expectedState)
+			g.Expect(ht.queue.Len()).To(Equal(tc.expectedQueue))
+			tc.expected(ht.payloadService, ht.flClient)
 		})
 	}
 }
@@ -301,6 +406,7 @@ func TestHandleWebhookPost_Completed(t *testing.T) {
 		fakesReturn    func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expected       func(*fakes.FakePayload, *fakes.FakeFlintlockClient)
 		expectedStatus int
+		expectedState  worker.State
 	}{
 		{
 			name: "processing completed event succeeds",
@@ -320,7 +426,8 @@ func TestHandleWebhookPost_Completed(t *testing.T) {
 				g.Expect(flClient.DeleteCallCount()).To(Equal(1))
 				g.Expect(flClient.DeleteArgsForCall(0)).To(Equal(mvmUid))
 			},
-			expectedStatus: http.StatusOK,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateSucceeded,
 		},
 		{
 			name: "flintlock client list call fails, processing completed event fails",
@@ -333,7 +440,8 @@ func TestHandleWebhookPost_Completed(t *testing.T) {
 
 				g.Expect(flClient.ListCallCount()).To(Equal(1))
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateFailed,
 		},
 		{
 			name: "flintlock client delete call fails, processing completed event fails",
@@ -348,7 +456,8 @@ func TestHandleWebhookPost_Completed(t *testing.T) {
 				g.Expect(flClient.ListCallCount()).To(Equal(1))
 				g.Expect(flClient.DeleteCallCount()).To(Equal(1))
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateFailed,
 		},
 		{
 			name: "flintlock client list call returns no entries, processing completed event stops but does not fail",
@@ -362,39 +471,28 @@ func TestHandleWebhookPost_Completed(t *testing.T) {
 				g.Expect(flClient.ListCallCount()).To(Equal(1))
 				g.Expect(flClient.DeleteCallCount()).To(Equal(0))
 			},
-			expectedStatus: http.StatusOK,
+			expectedStatus: http.StatusAccepted,
+			expectedState:  worker.StateSucceeded,
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			var (
-				payloadService = &fakes.FakePayload{}
-				flClient       = fakes.FakeFlintlockClient{}
-				flClientFn     = newFakeClient(&flClient)
-			)
-
-			manager := host.New(cfg.Hosts)
-			manager.HostCount[expectedName(nodeId, runId)]++
-			manager.AssignedMap[expectedName(nodeId, runId)] = cfg.Hosts[0]
-
-			p := handler.Params{
-				Config:      cfg,
-				Client:      flClientFn,
-				Payload:     payloadService,
-				HostManager: manager,
-				L:           nullLogger(),
-			}
-			h, err := handler.New(p)
+			ht := newHandlerTest(t, g, cfg)
+
+			_, err := ht.manager.Assign(expectedName(nodeId, runId), host.Resources{})
 			g.Expect(err).NotTo(HaveOccurred())
+
 			r := httptest.NewRecorder()
 
-			tc.fakesReturn(payloadService, &flClient)
+			tc.fakesReturn(ht.payloadService, ht.flClient)
 
-			h.HandleWebhookPost(r, &http.Request{})
+			ht.HandleWebhookPost(r, newWebhookRequest(testDeliveryID))
+			ht.workers.Wait()
 
 			g.Expect(r.Result().StatusCode).To(Equal(tc.expectedStatus))
-			tc.expected(payloadService, &flClient)
+			expectTaskState(g, ht.workers, testDeliveryID, tc.expectedState)
+			tc.expected(ht.payloadService, ht.flClient)
 		})
 	}
 }
@@ -405,6 +503,16 @@ func fakeEvent(action, nodeID string, id int64) *github.WorkflowJobPayload {
 	job.WorkflowJob.ID = id
 	job.WorkflowJob.RunID = id
 	job.WorkflowJob.NodeID = nodeID
+	job.WorkflowJob.Labels = []string{"self-hosted"}
+	job.Repository.FullName = "foo/bar"
+	job.Repository.Name = "bar"
+	job.Repository.Owner.Login = "foo"
+	job.Organization.Login = "foo"
+
+	// a completed job ran on its own runner unless the test says otherwise
+	if action == "completed" {
+		job.WorkflowJob.RunnerName = expectedName(nodeID, id)
+	}
 
 	return &job
 }
@@ -439,13 +547,56 @@ func fakeMicrovmList(uid string) *v1alpha1.ListMicroVMsResponse {
 
 func newTestConfig() *config.Config {
 	return &config.Config{
-		Hosts:         []string{"host"},
+		Username:      "foo",
+		Repository:    "bar",
+		Hosts:         []config.Host{{Address: "host"}},
+		Labels:        []string{"self-hosted"},
 		APIToken:      "token",
 		SSHPublicKey:  "key",
 		WebhookSecret: "secret",
+		RunnerScope:   config.ScopeRepo,
 	}
 }
 
+// newTestWorkers returns a started worker pool which does not retry, so that
+// failures show up straight away.
+func newTestWorkers(t *testing.T) *worker.Pool {
+	workers := worker.New(10, 0, 0)
+	workers.Start(context.Background(), 1)
+	t.Cleanup(workers.Stop)
+
+	return workers
+}
+
+const testDeliveryID = "delivery-id"
+
+func newWebhookRequest(deliveryID string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+
+	return req
+}
+
+// expectTaskState checks the state of the task submitted for the delivery.
+// An empty state means no task should have been submitted.
+func expectTaskState(g *WithT, workers *worker.Pool, deliveryID string, state worker.State) {
+	status, ok := workers.Status(deliveryID)
+	if state == "" {
+		g.Expect(ok).To(BeFalse())
+		return
+	}
+
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.State).To(Equal(state))
+}
+
+func newTestQueue(g *WithT, maxLen int) *queue.Queue {
+	q, err := queue.New("", maxLen, time.Hour)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	return q
+}
+
 func nullLogger() *logrus.Entry {
 	l := logrus.New()
 	l.SetOutput(ioutil.Discard)
@@ -453,6 +604,121 @@ func nullLogger() *logrus.Entry {
 	return log
 }
 
+// handlerTest is a handler, with a warm pool, along with everything it uses.
+// Build one with newHandlerTest.
+type handlerTest struct {
+	testHandler
+	// fill fills the warm pool
+	fill           func()
+	payloadService *fakes.FakePayload
+	flClient       *fakes.FakeFlintlockClient
+	manager        *host.Manager
+	queue          *queue.Queue
+	pool           *warmpool.Pool
+	metrics        *metrics.Metrics
+	gh             *githubapitest.Server
+}
+
+// handlerTestOption changes how newHandlerTest builds the handler.
+type handlerTestOption func(*handlerTest, *handler.Params)
+
+// withClient connects to flintlock with the client func fn returns for the
+// test's fake client, eg. newBadClient.
+func withClient(fn func(client.FlintlockClient) handler.ClientFunc) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		p.Client = fn(w.flClient)
+	}
+}
+
+// withFlintlockClient connects to flintlock with fl rather than the test's own
+// fake client.
+func withFlintlockClient(fl *fakes.FakeFlintlockClient) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		w.flClient = fl
+		p.Client = newFakeClient(fl)
+	}
+}
+
+// withWorkers processes events on workers rather than on a single worker
+// which does not retry.
+func withWorkers(workers *worker.Pool) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		p.Workers = workers
+	}
+}
+
+// withQueue keeps pending jobs on q.
+func withQueue(q *queue.Queue) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		w.queue = q
+		p.Queue = q
+	}
+}
+
+// withLogger logs to log rather than discarding everything.
+func withLogger(log *logrus.Entry) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		p.L = log
+	}
+}
+
+// withGitHub talks to gh rather than the test's fake github.
+func withGitHub(gh *githubapi.Client) handlerTestOption {
+	return func(w *handlerTest, p *handler.Params) {
+		p.GitHub = gh
+	}
+}
+
+func newHandlerTest(t *testing.T, g *WithT, cfg *config.Config, opts ...handlerTestOption) handlerTest {
+	w := handlerTest{
+		payloadService: &fakes.FakePayload{},
+		flClient:       &fakes.FakeFlintlockClient{},
+		queue:          newTestQueue(g, 0),
+		pool:           warmpool.New(),
+		metrics:        metrics.New(),
+		gh:             newTestGitHub(t),
+	}
+
+	manager, err := host.New(cfg.Hosts, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	w.manager = manager
+
+	p := handler.Params{
+		Config:      config.NewLive(cfg),
+		Client:      newFakeClient(w.flClient),
+		Payload:     w.payloadService,
+		HostManager: manager,
+		Queue:       w.queue,
+		Workers:     newTestWorkers(t),
+		Seen:        dedupe.New(time.Hour),
+		Metrics:     w.metrics,
+		Warm:        w.pool,
+		GitHub:      w.gh.Client(),
+		L:           nullLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(&w, &p)
+	}
+
+	h, err := handler.New(p)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	w.testHandler = testHandler{h, p.Workers}
+	w.fill = h.FillWarmPool
+
+	return w
+}
+
+// newTestGitHub starts a fake github api which is stopped when the test ends.
+func newTestGitHub(t *testing.T) *githubapitest.Server {
+	gh := githubapitest.NewServer()
+	t.Cleanup(gh.Close)
+
+	return gh
+}
+
 func newFakeClient(c client.FlintlockClient) handler.ClientFunc {
 	return func(string) (client.FlintlockClient, error) {
 		return c, nil
@@ -464,3 +730,120 @@ func newBadClient(c client.FlintlockClient) handler.ClientFunc {
 		return nil, errors.New("fail")
 	}
 }
+
+func TestHandleWebhookPost_Concurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		cfg    = newTestConfig()
+		jobs   = 300
+		nodeId = "foo"
+	)
+
+	cfg.Hosts = []config.Host{{Address: "host1"}, {Address: "host2"}, {Address: "host3"}}
+
+	workers := worker.New(jobs*2, 0, 0)
+	workers.Start(context.Background(), 20)
+	t.Cleanup(workers.Stop)
+
+	var (
+		ht       = newHandlerTest(t, g, cfg, withWorkers(workers))
+		h        = ht.testHandler
+		flClient = ht.flClient
+		manager  = ht.manager
+	)
+
+	// the fake parser works out which event to return from the request headers,
+	// so every concurrent request can carry a different job
+	ht.payloadService.ParseStub = func(r *http.Request) (*github.WorkflowJobPayload, error) {
+		id, err := strconv.ParseInt(r.Header.Get("X-Test-Job"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		return fakeEvent(r.Header.Get("X-Test-Action"), nodeId, id), nil
+	}
+
+	flClient.CreateStub = func(spec *types.MicroVMSpec) (*v1alpha1.CreateMicroVMResponse, error) {
+		return fakeMicrovm(spec.Id), nil
+	}
+	flClient.ListStub = func(name, _ string) (*v1alpha1.ListMicroVMsResponse, error) {
+		return fakeMicrovmList(name), nil
+	}
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	send := func(action string, ids ...int) []int {
+		var (
+			wg       sync.WaitGroup
+			statuses = make([]int, len(ids))
+		)
+
+		for i, id := range ids {
+			wg.Add(1)
+
+			go func(i, id int) {
+				defer wg.Done()
+
+				req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+				req.Header.Set("X-Test-Action", action)
+				req.Header.Set("X-Test-Job", strconv.Itoa(id))
+
+				r := httptest.NewRecorder()
+				h.HandleWebhookPost(r, req)
+				statuses[i] = r.Result().StatusCode
+			}(i, id)
+		}
+
+		wg.Wait()
+		workers.Wait()
+
+		return statuses
+	}
+
+	ids := func(from, to int) []int {
+		out := []int{}
+		for i := from; i < to; i++ {
+			out = append(out, i)
+		}
+
+		return out
+	}
+
+	// a burst of queued jobs should be spread evenly across the hosts
+	for _, status := range send("queued", ids(0, jobs)...) {
+		g.Expect(status).To(Equal(http.StatusAccepted))
+	}
+
+	g.Expect(flClient.CreateCallCount()).To(Equal(jobs))
+	g.Expect(manager.Assignments()).To(HaveLen(jobs))
+
+	for _, addr := range manager.Hosts() {
+		g.Expect(manager.Count(addr)).To(Equal(jobs / len(cfg.Hosts)))
+	}
+
+	// then complete half of them while more are queued
+	var (
+		wg        sync.WaitGroup
+		completed []int
+		queued    []int
+	)
+
+	wg.Add(2)
+	go func() { defer wg.Done(); completed = send("completed", ids(0, jobs/2)...) }()
+	go func() { defer wg.Done(); queued = send("queued", ids(jobs, jobs+jobs/2)...) }()
+	wg.Wait()
+
+	for _, status := range append(completed, queued...) {
+		g.Expect(status).To(Equal(http.StatusAccepted))
+	}
+
+	g.Expect(flClient.DeleteCallCount()).To(Equal(jobs / 2))
+	g.Expect(manager.Assignments()).To(HaveLen(jobs))
+
+	total := 0
+	for _, addr := range manager.Hosts() {
+		total += manager.Count(addr)
+	}
+
+	g.Expect(total).To(Equal(jobs))
+}
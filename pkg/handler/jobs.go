@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+const (
+	// jobsPath is where the status of each submitted event can be found
+	jobsPath = "/jobs/"
+	// deliveryHeader carries the unique ID GitHub gives each webhook delivery
+	deliveryHeader = "X-GitHub-Delivery"
+)
+
+// taskID returns the ID to track the processing of an event with. This is the
+// delivery ID GitHub sent with the event, or if there is none, one built from
+// the job and action.
+func taskID(r *http.Request, p github.WorkflowJobPayload) string {
+	if id := r.Header.Get(deliveryHeader); id != "" {
+		return id
+	}
+
+	return fmt.Sprintf("%s-%s", generateName(p), p.Action)
+}
+
+// dedupeKeys returns the keys which identify an event. Both the delivery ID and
+// the job are used, so that a redelivery of the same webhook and a second
+// webhook for the same job (eg. from a repo and an org level hook) are both
+// caught.
+func dedupeKeys(r *http.Request, p github.WorkflowJobPayload) []string {
+	keys := []string{fmt.Sprintf("job/%d/%s", p.WorkflowJob.ID, p.Action)}
+
+	if id := r.Header.Get(deliveryHeader); id != "" {
+		keys = append(keys, "delivery/"+id)
+	}
+
+	return keys
+}
+
+// HandleJobGet will respond to calls to the /jobs/<id> endpoint with the
+// processing status of the webhook event submitted with that ID.
+func (h handler) HandleJobGet(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, jobsPath)
+
+	status, ok := h.Workers.Status(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.L.Errorf("failed to write job status: %s", err)
+	}
+}
@@ -0,0 +1,147 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
+)
+
+func TestHandleJobGet(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		ht             = newHandlerTest(t, g, newTestConfig())
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+	)
+
+	payloadService.ParseReturns(fakeEvent("queued", "foo", 1234), nil)
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	r := httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest(testDeliveryID))
+	workers.Wait()
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+	location := r.Result().Header.Get("Location")
+	g.Expect(location).To(Equal("/jobs/" + testDeliveryID))
+
+	r = httptest.NewRecorder()
+	h.HandleJobGet(r, httptest.NewRequest(http.MethodGet, location, nil))
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusOK))
+
+	var status worker.Status
+	g.Expect(json.NewDecoder(r.Body).Decode(&status)).To(Succeed())
+	g.Expect(status.ID).To(Equal(testDeliveryID))
+	g.Expect(status.State).To(Equal(worker.StateSucceeded))
+
+	r = httptest.NewRecorder()
+	h.HandleJobGet(r, httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil))
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusNotFound))
+}
+
+func TestHandleWebhookPost_WorkerPoolFull(t *testing.T) {
+	g := NewWithT(t)
+
+	// nothing takes events off this pool
+	ht := newHandlerTest(t, g, newTestConfig(), withWorkers(worker.New(1, 0, 0)))
+	h, payloadService := ht.testHandler, ht.payloadService
+
+	payloadService.ParseReturns(fakeEvent("queued", "foo", 1), nil)
+
+	r := httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest("first"))
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+
+	payloadService.ParseReturns(fakeEvent("queued", "foo", 2), nil)
+
+	// when GitHub redelivers the rejected event, it should not be mistaken for
+	// a duplicate
+	for range []int{1, 2} {
+		r = httptest.NewRecorder()
+		h.HandleWebhookPost(r, newWebhookRequest("second"))
+		g.Expect(r.Result().StatusCode).To(Equal(http.StatusServiceUnavailable))
+	}
+}
+
+func TestHandleWebhookPost_Duplicates(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		ht             = newHandlerTest(t, g, newTestConfig())
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+	)
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	post := func(event *github.WorkflowJobPayload, delivery string) int {
+		payloadService.ParseReturns(event, nil)
+
+		r := httptest.NewRecorder()
+		h.HandleWebhookPost(r, newWebhookRequest(delivery))
+		workers.Wait()
+
+		return r.Result().StatusCode
+	}
+
+	queued := fakeEvent("queued", "foo", 1234)
+	completed := fakeEvent("completed", "foo", 1234)
+
+	g.Expect(post(queued, "delivery-1")).To(Equal(http.StatusAccepted))
+	// redelivery of the same webhook
+	g.Expect(post(queued, "delivery-1")).To(Equal(http.StatusOK))
+	// a different delivery for the same job
+	g.Expect(post(queued, "delivery-2")).To(Equal(http.StatusOK))
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+
+	// the completed event for the same job is not a duplicate
+	g.Expect(post(completed, "delivery-3")).To(Equal(http.StatusAccepted))
+	g.Expect(post(completed, "delivery-3")).To(Equal(http.StatusOK))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(1))
+}
+
+func TestHandleWebhookPost_RedeliveredAfterFailing(t *testing.T) {
+	g := NewWithT(t)
+
+	ht := newHandlerTest(t, g, newTestConfig())
+	h, payloadService, flClient := ht.testHandler, ht.payloadService, ht.flClient
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(nil, errors.New("fail"))
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1234))).To(Equal(http.StatusAccepted))
+
+	completed := fakeEvent("completed", "foo", 1234)
+
+	g.Expect(send(h, payloadService, completed)).To(Equal(http.StatusAccepted))
+	expectTaskState(g, h.workers, deliveryID(completed), worker.StateFailed)
+
+	// the failed event is processed again when it is redelivered
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	g.Expect(send(h, payloadService, completed)).To(Equal(http.StatusAccepted))
+	expectTaskState(g, h.workers, deliveryID(completed), worker.StateSucceeded)
+	g.Expect(flClient.DeleteCallCount()).To(Equal(2))
+
+	// but not once it has succeeded
+	g.Expect(send(h, payloadService, completed)).To(Equal(http.StatusOK))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(2))
+}
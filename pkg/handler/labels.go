@@ -0,0 +1,48 @@
+package handler
+
+import "strings"
+
+// defaultRunnerLabels are the labels GitHub gives every self-hosted runner
+// set up with config.sh, so jobs may ask for them without them being
+// configured. Runners registered with a just in time config only get the
+// labels they are registered with, so cold runners are registered with their
+// job's labels and warm runners with these as well, see warmLabels.
+var defaultRunnerLabels = []string{"self-hosted", "linux", "x64"}
+
+// matchesLabels returns true if this service can create a runner for a job
+// with the given runs-on labels. Every label must be either one of the
+// configured labels, a label which selects a profile, or one of
+// defaultRunnerLabels.
+// Labels are compared without regard to case, as GitHub does.
+func (h handler) matchesLabels(labels []string) bool {
+	if len(labels) == 0 {
+		return false
+	}
+
+	var (
+		cfg     = h.Config.Get()
+		allowed = map[string]bool{}
+	)
+
+	for _, l := range cfg.Labels {
+		allowed[strings.ToLower(l)] = true
+	}
+
+	for _, l := range defaultRunnerLabels {
+		allowed[strings.ToLower(l)] = true
+	}
+
+	for _, p := range cfg.Profiles {
+		for _, l := range p.SelectedBy() {
+			allowed[strings.ToLower(l)] = true
+		}
+	}
+
+	for _, l := range labels {
+		if !allowed[strings.ToLower(l)] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,201 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+func TestHandleWebhookPost_Labels(t *testing.T) {
+	tt := []struct {
+		name           string
+		configured     []string
+		labels         []string
+		expectedStatus int
+		expectedCreate int
+	}{
+		{
+			name:           "job asks only for the default label, a runner is created",
+			configured:     []string{"self-hosted"},
+			labels:         []string{"self-hosted"},
+			expectedStatus: http.StatusAccepted,
+			expectedCreate: 1,
+		},
+		{
+			name:           "job asks for labels every self-hosted runner has, a runner is created",
+			configured:     []string{"microvm"},
+			labels:         []string{"self-hosted", "Linux", "X64", "microvm"},
+			expectedStatus: http.StatusAccepted,
+			expectedCreate: 1,
+		},
+		{
+			name:           "job asks for a configured label in a different case, a runner is created",
+			configured:     []string{"GPU"},
+			labels:         []string{"self-hosted", "gpu"},
+			expectedStatus: http.StatusAccepted,
+			expectedCreate: 1,
+		},
+		{
+			name:           "job asks for a github hosted runner, it is ignored",
+			configured:     []string{"self-hosted"},
+			labels:         []string{"ubuntu-latest"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "job asks for a label which is not configured, it is ignored",
+			configured:     []string{"microvm"},
+			labels:         []string{"self-hosted", "microvm", "arm64"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "job has no labels, it is ignored",
+			configured:     []string{"self-hosted"},
+			labels:         []string{},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cfg := newTestConfig()
+			cfg.Labels = tc.configured
+
+			var (
+				ht             = newHandlerTest(t, g, cfg)
+				h              = ht.testHandler
+				payloadService = ht.payloadService
+				flClient       = ht.flClient
+				workers        = ht.workers
+			)
+
+			flClient.CreateReturns(fakeMicrovm("uid"), nil)
+			flClient.ListReturns(fakeMicrovmList("uid"), nil)
+			flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+			for _, action := range []string{"queued", "completed"} {
+				event := fakeEvent(action, "foo", 1234)
+				event.WorkflowJob.Labels = tc.labels
+				payloadService.ParseReturns(event, nil)
+
+				r := httptest.NewRecorder()
+				h.HandleWebhookPost(r, newWebhookRequest(deliveryID(event)))
+				workers.Wait()
+
+				g.Expect(r.Result().StatusCode).To(Equal(tc.expectedStatus))
+			}
+
+			g.Expect(flClient.CreateCallCount()).To(Equal(tc.expectedCreate))
+			g.Expect(flClient.DeleteCallCount()).To(Equal(tc.expectedCreate))
+		})
+	}
+}
+
+func TestHandleWebhookPost_RegistersRunnerWithJobLabels(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Labels = []string{"microvm"}
+	cfg.APIToken = "ghp_secret"
+
+	var (
+		ht             = newHandlerTest(t, g, cfg)
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+		gh             = ht.gh
+	)
+
+	event := fakeEvent("queued", "foo", 1234)
+	event.WorkflowJob.Labels = []string{"self-hosted", "microvm"}
+	payloadService.ParseReturns(event, nil)
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	r := httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest(testDeliveryID))
+	workers.Wait()
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+
+	runners := gh.Runners("repos/foo/bar")
+	g.Expect(runners).To(HaveLen(1))
+	g.Expect(runners[0].Name).To(Equal(expectedName("foo", 1234)))
+	g.Expect(runners[0].Labels).To(Equal([]string{"self-hosted", "microvm", microvm.RunnerLabel}))
+
+	// the MicroVM only gets the runner's single use config, never the token
+	data := userData(g, flClient.CreateArgsForCall(0))
+	g.Expect(data).To(ContainSubstring(runners[0].JITConfig))
+	g.Expect(data).NotTo(ContainSubstring(cfg.APIToken))
+}
+
+// userData returns the decoded userdata of the spec. The setup script is in
+// there as a quoted yaml string.
+func userData(g *WithT, spec *types.MicroVMSpec) string {
+	data, err := base64.StdEncoding.DecodeString(spec.Metadata["user-data"])
+	g.Expect(err).NotTo(HaveOccurred())
+
+	return string(data)
+}
+
+func TestHandleWebhookPost_Profiles(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Hosts = []config.Host{{Address: "host", VCPU: 8}}
+	cfg.Profiles = []config.Profile{
+		{Name: "small", VCPU: 1},
+		{Name: "large", Labels: []string{"big"}, VCPU: 8, MemoryMiB: 16384},
+	}
+
+	var (
+		ht             = newHandlerTest(t, g, cfg)
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+		manager        = ht.manager
+	)
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	// the profile's labels do not need to be configured separately
+	event := fakeEvent("queued", "foo", 1)
+	event.WorkflowJob.Labels = []string{"self-hosted", "big"}
+	payloadService.ParseReturns(event, nil)
+
+	r := httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest(deliveryID(event)))
+	workers.Wait()
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+
+	spec := flClient.CreateArgsForCall(0)
+	g.Expect(spec.Vcpu).To(BeEquivalentTo(8))
+	g.Expect(spec.MemoryInMb).To(BeEquivalentTo(16384))
+
+	// the host is now full, so a job for the small profile has to wait
+	event = fakeEvent("queued", "foo", 2)
+	event.WorkflowJob.Labels = []string{"self-hosted", "small"}
+	payloadService.ParseReturns(event, nil)
+
+	r = httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest(deliveryID(event)))
+	workers.Wait()
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(manager.Used("host")).To(Equal(host.Resources{VCPU: 8, MemoryMiB: 16384}))
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"github.com/go-playground/webhooks/v6/github"
+	"github.com/sirupsen/logrus"
+)
+
+// Fields put on log lines so that everything logged about one job can be found
+// together, across both its queued and completed events.
+const (
+	fieldDelivery   = "delivery_id"
+	fieldAction     = "action"
+	fieldJobID      = "job_id"
+	fieldRunID      = "run_id"
+	fieldRepo       = "repo"
+	fieldRunner     = "runner"
+	fieldHost       = "host"
+	fieldMicroVMUID = "microvm_uid"
+	fieldProfile    = "profile"
+	fieldScope      = "scope"
+)
+
+// jobLogger returns a logger which adds the details of the job to every line.
+func jobLogger(log *logrus.Entry, p github.WorkflowJobPayload) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		fieldAction: p.Action,
+		fieldJobID:  p.WorkflowJob.ID,
+		fieldRunID:  p.WorkflowJob.RunID,
+		fieldRepo:   p.Repository.FullName,
+		fieldRunner: generateName(p),
+	})
+}
@@ -0,0 +1,92 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestHandleWebhookPost_LogFields(t *testing.T) {
+	g := NewWithT(t)
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	var (
+		cfg            = newTestConfig()
+		ht             = newHandlerTest(t, g, cfg, withLogger(logrus.NewEntry(logger)))
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+	)
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	post := func(event *github.WorkflowJobPayload, delivery string) {
+		event.Repository.FullName = "foo/bar"
+		payloadService.ParseReturns(event, nil)
+
+		r := httptest.NewRecorder()
+		h.HandleWebhookPost(r, newWebhookRequest(delivery))
+		workers.Wait()
+
+		g.Expect(r.Result().StatusCode).To(Equal(http.StatusAccepted))
+	}
+
+	post(fakeEvent("queued", "foo", 1234), "delivery-1")
+	post(fakeEvent("completed", "foo", 1234), "delivery-2")
+
+	entries := hook.AllEntries()
+	g.Expect(entries).NotTo(BeEmpty())
+
+	for _, e := range entries {
+		g.Expect(e.Data).To(HaveKey("delivery_id"), e.Message)
+
+		if e.Message == "webhook received" {
+			continue
+		}
+
+		// every line about the job can be traced back to it
+		g.Expect(e.Data).To(HaveKeyWithValue("job_id", int64(1234)), e.Message)
+		g.Expect(e.Data).To(HaveKeyWithValue("run_id", int64(1234)), e.Message)
+		g.Expect(e.Data).To(HaveKeyWithValue("repo", "foo/bar"), e.Message)
+		g.Expect(e.Data).To(HaveKeyWithValue("runner", expectedName("foo", 1234)), e.Message)
+	}
+
+	created := findEntry(g, hook, "created microvm")
+	g.Expect(created.Data).To(HaveKeyWithValue("delivery_id", "delivery-1"))
+	g.Expect(created.Data).To(HaveKeyWithValue("action", "queued"))
+	g.Expect(created.Data).To(HaveKeyWithValue("host", cfg.Hosts[0].Address))
+	g.Expect(created.Data).To(HaveKeyWithValue("microvm_uid", "uid"))
+
+	deleted := findEntry(g, hook, "deleted microvm")
+	g.Expect(deleted.Data).To(HaveKeyWithValue("delivery_id", "delivery-2"))
+	g.Expect(deleted.Data).To(HaveKeyWithValue("action", "completed"))
+	g.Expect(deleted.Data).To(HaveKeyWithValue("host", cfg.Hosts[0].Address))
+	g.Expect(deleted.Data).To(HaveKeyWithValue("microvm_uid", "uid"))
+}
+
+func findEntry(g *WithT, hook *logtest.Hook, message string) *logrus.Entry {
+	var messages []string
+
+	for _, e := range hook.AllEntries() {
+		if e.Message == message {
+			return e
+		}
+
+		messages = append(messages, e.Message)
+	}
+
+	g.Expect(messages).To(ContainElement(message))
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package handler_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestHandleWebhookPost_Metrics(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		ht             = newHandlerTest(t, g, newTestConfig())
+		h              = ht.testHandler
+		payloadService = ht.payloadService
+		flClient       = ht.flClient
+		workers        = ht.workers
+		m              = ht.metrics
+	)
+
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	post := func(event *github.WorkflowJobPayload, delivery string) int {
+		payloadService.ParseReturns(event, nil)
+
+		r := httptest.NewRecorder()
+		h.HandleWebhookPost(r, newWebhookRequest(delivery))
+		workers.Wait()
+
+		return r.Result().StatusCode
+	}
+
+	unknownLabels := fakeEvent("queued", "bar", 5678)
+	unknownLabels.WorkflowJob.Labels = []string{"ubuntu-latest"}
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	g.Expect(post(fakeEvent("queued", "foo", 1234), "delivery-1")).To(Equal(http.StatusAccepted))
+	g.Expect(post(fakeEvent("queued", "foo", 1234), "delivery-1")).To(Equal(http.StatusOK))
+	g.Expect(post(unknownLabels, "delivery-2")).To(Equal(http.StatusOK))
+	g.Expect(post(fakeEvent("completed", "foo", 1234), "delivery-3")).To(Equal(http.StatusAccepted))
+
+	// a job which cannot be created straight away goes on the pending queue
+	flClient.CreateReturns(nil, errors.New("fail"))
+	g.Expect(post(fakeEvent("queued", "baz", 9012), "delivery-4")).To(Equal(http.StatusAccepted))
+
+	expected := `
+# HELP microvm_action_runner_webhooks_total Webhooks received, by workflow job action and what was done with them.
+# TYPE microvm_action_runner_webhooks_total counter
+microvm_action_runner_webhooks_total{action="completed",outcome="accepted"} 1
+microvm_action_runner_webhooks_total{action="queued",outcome="accepted"} 2
+microvm_action_runner_webhooks_total{action="queued",outcome="duplicate"} 1
+microvm_action_runner_webhooks_total{action="queued",outcome="ignored"} 1
+# HELP microvm_action_runner_event_attempts_total Attempts at processing accepted webhook events, including retries, by action and outcome.
+# TYPE microvm_action_runner_event_attempts_total counter
+microvm_action_runner_event_attempts_total{action="completed",outcome="success"} 1
+microvm_action_runner_event_attempts_total{action="queued",outcome="success"} 2
+# HELP microvm_action_runner_pending_jobs_added_total Jobs which were added to the pending queue because a runner could not be created straight away.
+# TYPE microvm_action_runner_pending_jobs_added_total counter
+microvm_action_runner_pending_jobs_added_total 1
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected),
+		"microvm_action_runner_webhooks_total",
+		"microvm_action_runner_event_attempts_total",
+		"microvm_action_runner_pending_jobs_added_total",
+	)).To(Succeed())
+
+	// create succeeded and failed, the completed event listed and deleted
+	g.Expect(testutil.GatherAndCount(m.Gatherer(), "microvm_action_runner_flintlock_request_duration_seconds")).To(Equal(4))
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+)
+
+// DrainQueue tries to create runners for pending jobs, oldest first. A job
+// which does not fit on any host right now is skipped for the jobs behind it,
+// and a job whose runner can never be created is dropped. A job is only taken
+// off the queue once its runner has been created. Jobs which have been waiting
+// for longer than the queue's max wait are dropped. Drains run one at a time:
+// asking for one while another is running has the running one go again once it
+// is done, rather than waiting for it. Once the queue is empty the warm pool is
+// topped up.
+func (h handler) DrainQueue() {
+	if !h.drain.begin() {
+		return
+	}
+
+	for {
+		emptied := h.drainQueue()
+
+		if h.drain.end() {
+			if emptied {
+				h.FillWarmPool()
+			}
+
+			return
+		}
+	}
+}
+
+// drainQueue does the work of DrainQueue, returning whether the queue was
+// emptied.
+func (h handler) drainQueue() bool {
+	expired, err := h.Queue.Prune()
+	if err != nil {
+		h.L.Errorf("failed to save pending queue after dropping expired jobs: %s", err)
+	}
+
+	h.Metrics.PendingExpired(len(expired))
+
+	for _, job := range expired {
+		jobLogger(h.L, job.Payload).Warnf("dropping job, it has been pending since %s", job.QueuedAt.Format(time.RFC3339))
+	}
+
+	for _, job := range h.Queue.Jobs() {
+		done, ok := h.drain.claim(h.Queue, job.Name)
+		if !ok {
+			// completed since the queue was read
+			continue
+		}
+
+		log := jobLogger(h.L, job.Payload)
+
+		err := h.createRunner(log, job.Name, job.Payload)
+
+		switch {
+		case errors.Is(err, host.ErrNoCapacity):
+			log.WithError(err).Debug("runner still cannot be created, trying the jobs behind it")
+			done()
+
+			continue
+		case err != nil && !permanent(err):
+			log.WithError(err).Debugf("runner still cannot be created, %d jobs in queue", h.Queue.Len())
+			done()
+
+			return false
+		}
+
+		if _, err := h.Queue.Remove(job.Name); err != nil {
+			log.WithError(err).Error("failed to save pending queue")
+		}
+
+		done()
+
+		if err != nil {
+			log.WithError(err).Errorf("dropping pending job, a runner can never be created for it, %d jobs in queue", h.Queue.Len())
+			continue
+		}
+
+		log.Infof("created runner for pending job, %d jobs in queue", h.Queue.Len())
+	}
+
+	return h.Queue.Len() == 0
+}
+
+// permanent returns true if creating a runner failed in a way which trying
+// again will not fix, eg. the runner would not fit on any host or github
+// refused to register it.
+func permanent(err error) bool {
+	return errors.Is(err, host.ErrNeverFits) ||
+		errors.Is(err, githubapi.ErrNotFound) ||
+		errors.Is(err, githubapi.ErrUnprocessable)
+}
+
+// drainState keeps drains of the pending queue to one at a time, and records
+// which jobs are having their runners created by the drain, so that a job
+// which completes meanwhile can wait for its runner and delete it. It is safe
+// for concurrent use.
+type drainState struct {
+	mu       sync.Mutex
+	running  bool
+	again    bool
+	creating map[string]chan struct{}
+}
+
+func newDrainState() *drainState {
+	return &drainState{creating: map[string]chan struct{}{}}
+}
+
+// begin returns true if the caller should drain the queue, or false if a drain
+// is already running, in which case that drain goes again.
+func (d *drainState) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.running {
+		d.again = true
+		return false
+	}
+
+	d.running = true
+
+	return true
+}
+
+// end returns true if the drain is finished, or false if it was asked to go
+// again while it was running.
+func (d *drainState) end() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.again {
+		d.again = false
+		return false
+	}
+
+	d.running = false
+
+	return true
+}
+
+// claim records that the named job is having its runner created, as long as
+// it is still pending. done must be called once the runner has been created or
+// has failed to be.
+func (d *drainState) claim(q *queue.Queue, name string) (func(), bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !q.Has(name) {
+		return nil, false
+	}
+
+	ch := make(chan struct{})
+	d.creating[name] = ch
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		delete(d.creating, name)
+		close(ch)
+	}, true
+}
+
+// complete takes the named job off the queue, returning whether it was pending
+// and, if its runner is being created right now, a channel which is closed
+// once that is done.
+func (d *drainState) complete(q *queue.Queue, name string) (bool, <-chan struct{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	removed, err := q.Remove(name)
+
+	return removed, d.creating[name], err
+}
+
+type queueStatus struct {
+	Depth int          `json:"depth"`
+	Jobs  []pendingJob `json:"jobs"`
+}
+
+type pendingJob struct {
+	Name     string    `json:"name"`
+	RunURL   string    `json:"runURL"`
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+// HandleQueueGet will respond to calls to the /queue endpoint with the number
+// of pending jobs and their details.
+func (h handler) HandleQueueGet(w http.ResponseWriter, r *http.Request) {
+	jobs := h.Queue.Jobs()
+
+	status := queueStatus{
+		Depth: len(jobs),
+		Jobs:  make([]pendingJob, len(jobs)),
+	}
+
+	for i, job := range jobs {
+		status.Jobs[i] = pendingJob{
+			Name:     job.Name,
+			RunURL:   job.Payload.WorkflowJob.RunURL,
+			QueuedAt: job.QueuedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.L.Errorf("failed to write queue status: %s", err)
+	}
+}
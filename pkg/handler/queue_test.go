@@ -0,0 +1,356 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler/fakes"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
+)
+
+func TestPendingQueue_DrainedWhenCapacityFreesUp(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		running = fakeEvent("completed", "running", 1)
+		waiting = fakeEvent("queued", "waiting", 2)
+	)
+
+	h, payloadService, flClient, manager, pending := newCapacityLimitedHandler(t, g, 1)
+
+	_, err := manager.Assign(expectedName("running", 1), host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the host is full, so the job has to wait
+	g.Expect(send(h, payloadService, waiting)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(0))
+	g.Expect(pending.Len()).To(Equal(1))
+
+	// once the running job finishes, the waiting job gets its runner
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+	flClient.CreateReturns(fakeMicrovm("uid2"), nil)
+
+	g.Expect(send(h, payloadService, running)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(1))
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(flClient.CreateArgsForCall(0).Id).To(Equal(expectedName("waiting", 2)))
+	g.Expect(pending.Len()).To(Equal(0))
+
+	found, err := manager.Lookup(expectedName("waiting", 2))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal("host"))
+}
+
+func TestPendingQueue_NeverFits(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Hosts = []config.Host{{Address: "host", VCPU: 4}}
+	cfg.Profiles = []config.Profile{{Name: "large", VCPU: 8}}
+
+	ht := newHandlerTest(t, g, cfg)
+	ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	large := fakeEvent("queued", "large", 1)
+	large.WorkflowJob.Labels = []string{"self-hosted", "large"}
+
+	// a job whose runner could never be created is dropped rather than queued
+	g.Expect(send(ht.testHandler, ht.payloadService, large)).To(Equal(http.StatusAccepted))
+	g.Expect(ht.flClient.CreateCallCount()).To(BeZero())
+	g.Expect(ht.queue.Len()).To(BeZero())
+
+	// and one which was already pending does not hold up the jobs behind it
+	g.Expect(ht.queue.Push(expectedName("large", 1), *large)).To(Succeed())
+	g.Expect(ht.queue.Push(expectedName("small", 2), *fakeEvent("queued", "small", 2))).To(Succeed())
+
+	ht.DrainQueue()
+
+	g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(ht.flClient.CreateArgsForCall(0).Id).To(Equal(expectedName("small", 2)))
+	g.Expect(ht.queue.Len()).To(BeZero())
+}
+
+func TestPendingQueue_SkipsJobsWhichDoNotFitYet(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Hosts = []config.Host{{Address: "host", VCPU: 4}}
+	cfg.Profiles = []config.Profile{{Name: "large", VCPU: 4}}
+
+	ht := newHandlerTest(t, g, cfg)
+	ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	_, err := ht.manager.Assign("existing", host.Resources{VCPU: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	large := fakeEvent("queued", "large", 1)
+	large.WorkflowJob.Labels = []string{"self-hosted", "large"}
+
+	g.Expect(ht.queue.Push(expectedName("large", 1), *large)).To(Succeed())
+	g.Expect(ht.queue.Push(expectedName("small", 2), *fakeEvent("queued", "small", 2))).To(Succeed())
+
+	ht.DrainQueue()
+
+	// the large job waits for the whole host, the small one fits now
+	g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(ht.flClient.CreateArgsForCall(0).Id).To(Equal(expectedName("small", 2)))
+	g.Expect(ht.queue.Has(expectedName("large", 1))).To(BeTrue())
+}
+
+func TestPendingQueue_OlderJobsGoFirst(t *testing.T) {
+	g := NewWithT(t)
+
+	h, payloadService, flClient, manager, pending := newCapacityLimitedHandler(t, g, 0)
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	_, err := manager.Assign("existing", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "older", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(pending.Len()).To(Equal(1))
+
+	// the host frees up without the queue being drained
+	g.Expect(manager.Unassign("existing")).To(Succeed())
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "newer", 2))).To(Equal(http.StatusAccepted))
+
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(flClient.CreateArgsForCall(0).Id).To(Equal(expectedName("older", 1)))
+	g.Expect(pending.Len()).To(Equal(1))
+	g.Expect(pending.Has(expectedName("newer", 2))).To(BeTrue())
+}
+
+func TestPendingQueue_FullQueueFails(t *testing.T) {
+	g := NewWithT(t)
+
+	h, payloadService, flClient, manager, pending := newCapacityLimitedHandler(t, g, 1)
+
+	_, err := manager.Assign("existing", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 2))).To(Equal(http.StatusAccepted))
+	expectTaskState(g, h.workers, deliveryID(fakeEvent("queued", "foo", 2)), worker.StateFailed)
+
+	g.Expect(flClient.CreateCallCount()).To(Equal(0))
+	g.Expect(pending.Len()).To(Equal(1))
+}
+
+func TestPendingQueue_CompletedWhilePending(t *testing.T) {
+	g := NewWithT(t)
+
+	h, payloadService, flClient, manager, pending := newCapacityLimitedHandler(t, g, 1)
+
+	_, err := manager.Assign("existing", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(pending.Len()).To(Equal(1))
+
+	// eg. the job was cancelled before it ever got a runner
+	g.Expect(send(h, payloadService, fakeEvent("completed", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(pending.Len()).To(Equal(0))
+	g.Expect(flClient.ListCallCount()).To(Equal(0))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(0))
+}
+
+func TestPendingQueue_DrainsRunOneAtATime(t *testing.T) {
+	g := NewWithT(t)
+
+	ht := newHandlerTest(t, g, newTestConfig())
+
+	ht.flClient.CreateStub = func(*types.MicroVMSpec) (*v1alpha1.CreateMicroVMResponse, error) {
+		time.Sleep(10 * time.Millisecond)
+		return fakeMicrovm("uid"), nil
+	}
+
+	job := fakeEvent("queued", "foo", 1)
+	g.Expect(ht.queue.Push(expectedName("foo", 1), *job)).To(Succeed())
+
+	// eg. a completion, the retry ticker and a reload all at once
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			ht.DrainQueue()
+		}()
+	}
+
+	wg.Wait()
+
+	g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(ht.queue.Len()).To(Equal(0))
+}
+
+func TestPendingQueue_CompletedWhileDraining(t *testing.T) {
+	g := NewWithT(t)
+
+	ht := newHandlerTest(t, g, newTestConfig())
+
+	completed := fakeEvent("completed", "foo", 1)
+	ht.payloadService.ParseReturns(completed, nil)
+
+	ht.flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	ht.flClient.DeleteReturns(&emptypb.Empty{}, nil)
+	ht.flClient.CreateStub = func(*types.MicroVMSpec) (*v1alpha1.CreateMicroVMResponse, error) {
+		// the job completes while its runner is being created
+		ht.HandleWebhookPost(httptest.NewRecorder(), newWebhookRequest(deliveryID(completed)))
+		time.Sleep(10 * time.Millisecond)
+
+		return fakeMicrovm("uid"), nil
+	}
+
+	g.Expect(ht.queue.Push(expectedName("foo", 1), *fakeEvent("queued", "foo", 1))).To(Succeed())
+
+	ht.DrainQueue()
+	ht.workers.Wait()
+
+	// so the runner which was just created for it is deleted again
+	g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+	g.Expect(ht.flClient.DeleteCallCount()).To(Equal(1))
+	g.Expect(ht.queue.Len()).To(Equal(0))
+
+	_, err := ht.manager.Lookup(expectedName("foo", 1))
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestPendingQueue_OtherJobCompletesWhileDraining(t *testing.T) {
+	g := NewWithT(t)
+
+	ht := newHandlerTest(t, g, newTestConfig())
+
+	_, err := ht.manager.Assign(expectedName("other", 2), host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	completed := fakeEvent("completed", "other", 2)
+	ht.payloadService.ParseReturns(completed, nil)
+
+	deleted := make(chan struct{})
+
+	ht.flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	ht.flClient.DeleteStub = func(string) (*emptypb.Empty, error) {
+		close(deleted)
+		return &emptypb.Empty{}, nil
+	}
+	ht.flClient.CreateStub = func(*types.MicroVMSpec) (*v1alpha1.CreateMicroVMResponse, error) {
+		// another job completes while the runner is being created, and is not
+		// held up by it
+		ht.HandleWebhookPost(httptest.NewRecorder(), newWebhookRequest(deliveryID(completed)))
+
+		select {
+		case <-deleted:
+			return fakeMicrovm("uid"), nil
+		case <-time.After(time.Second):
+			return nil, errors.New("completion waited for the drain")
+		}
+	}
+
+	g.Expect(ht.queue.Push(expectedName("foo", 1), *fakeEvent("queued", "foo", 1))).To(Succeed())
+
+	ht.DrainQueue()
+	ht.workers.Wait()
+
+	g.Expect(ht.queue.Len()).To(Equal(0))
+	g.Expect(ht.flClient.DeleteCallCount()).To(Equal(1))
+
+	_, err = ht.manager.Lookup(expectedName("foo", 1))
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+func TestHandleQueueGet(t *testing.T) {
+	g := NewWithT(t)
+
+	h, payloadService, _, manager, _ := newCapacityLimitedHandler(t, g, 5)
+
+	_, err := manager.Assign("existing", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	event := fakeEvent("queued", "foo", 1)
+	event.WorkflowJob.RunURL = "https://example.com/run"
+	g.Expect(send(h, payloadService, event)).To(Equal(http.StatusAccepted))
+
+	r := httptest.NewRecorder()
+	h.HandleQueueGet(r, httptest.NewRequest(http.MethodGet, "/queue", nil))
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusOK))
+	g.Expect(r.Result().Header.Get("Content-Type")).To(Equal("application/json"))
+
+	var status struct {
+		Depth int `json:"depth"`
+		Jobs  []struct {
+			Name   string `json:"name"`
+			RunURL string `json:"runURL"`
+		} `json:"jobs"`
+	}
+	g.Expect(json.NewDecoder(r.Body).Decode(&status)).To(Succeed())
+
+	g.Expect(status.Depth).To(Equal(1))
+	g.Expect(status.Jobs[0].Name).To(Equal(expectedName("foo", 1)))
+	g.Expect(status.Jobs[0].RunURL).To(Equal(event.WorkflowJob.RunURL))
+}
+
+// newCapacityLimitedHandler returns a handler with a single host which can
+// only run one microvm at a time.
+func newCapacityLimitedHandler(t *testing.T, g *WithT, maxPending int) (testHandler, *fakes.FakePayload, *fakes.FakeFlintlockClient, *host.Manager, *queue.Queue) {
+	cfg := newTestConfig()
+	cfg.Hosts = []config.Host{{Address: "host", MaxMicroVMs: 1}}
+
+	ht := newHandlerTest(t, g, cfg, withQueue(newTestQueue(g, maxPending)))
+
+	return ht.testHandler, ht.payloadService, ht.flClient, ht.manager, ht.queue
+}
+
+// testHandler pairs a handler with the worker pool processing its events.
+type testHandler struct {
+	handlerUnderTest
+	workers *worker.Pool
+}
+
+type handlerUnderTest interface {
+	HandleWebhookPost(http.ResponseWriter, *http.Request)
+	HandleQueueGet(http.ResponseWriter, *http.Request)
+	HandleJobGet(http.ResponseWriter, *http.Request)
+	DrainQueue()
+	Reconcile() error
+	Reap(context.Context) error
+	SweepRunners(context.Context) error
+	CheckRunnerGroups(context.Context, *config.Config) error
+	SetUserDataTemplates(handler.UserDataTemplates)
+}
+
+// send posts the event to the handler and waits for it to be processed. Each
+// event is sent with its own delivery ID, see deliveryID.
+func send(h testHandler, payloadService *fakes.FakePayload, event *github.WorkflowJobPayload) int {
+	payloadService.ParseReturns(event, nil)
+
+	r := httptest.NewRecorder()
+	h.HandleWebhookPost(r, newWebhookRequest(deliveryID(event)))
+	h.workers.Wait()
+
+	return r.Result().StatusCode
+}
+
+func deliveryID(event *github.WorkflowJobPayload) string {
+	return fmt.Sprintf("%s-%s", expectedName(event.WorkflowJob.NodeID, event.WorkflowJob.ID), event.Action)
+}
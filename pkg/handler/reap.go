@@ -0,0 +1,316 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+// Why the reaper deleted a MicroVM
+const (
+	reasonExpired      = "expired"
+	reasonJobCompleted = "job_completed"
+	reasonFailed       = "failed"
+)
+
+const (
+	fieldReason      = "reason"
+	fieldAge         = "age"
+	fieldMaxLifetime = "max_lifetime"
+)
+
+// Reap looks for MicroVMs which should already have been deleted, eg. because
+// the completed webhook for their job was lost or the job has hung, and
+// deletes them. A MicroVM is reaped when it has been running for longer than
+// the max lifetime of its profile, when github says its job has completed, or
+// when flintlock says it has failed. The runners of reaped MicroVMs are also
+// removed from github, in case they never ran a job. Warm runners are only
+// reaped for running too long, since their job is not known. In dry run mode
+// they are only logged.
+//
+// MicroVMs which the service has no record of are logged, but are not reaped
+// for that alone since they may belong to a job which is still running on a
+// host which could not be reconciled.
+func (h handler) Reap(ctx context.Context) error {
+	cfg := h.Config.Get()
+
+	var (
+		failed []string
+		reaped int
+	)
+
+	for _, addr := range h.HostManager.Hosts() {
+		n, err := h.reapHost(ctx, cfg, addr)
+		if err != nil {
+			h.L.WithField(fieldHost, addr).WithError(err).Error("failed to reap host")
+			failed = append(failed, addr)
+		}
+
+		reaped += n
+	}
+
+	// the space which was freed up may be enough for some pending jobs
+	if reaped > 0 {
+		h.DrainQueue()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to reap hosts: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// reapHost reaps the MicroVMs on one host and returns how many were deleted.
+func (h handler) reapHost(ctx context.Context, cfg *config.Config, addr string) (int, error) {
+	log := h.L.WithField(fieldHost, addr)
+
+	fl, err := h.Client(addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create flintlock client: %w", err)
+	}
+
+	defer func() {
+		if err := fl.Close(); err != nil {
+			log.WithError(err).Error("failed to close connection to flintlock host")
+		}
+	}()
+
+	var resp *v1alpha1.ListMicroVMsResponse
+
+	err = h.Metrics.ObserveFlintlock(metrics.OpList, func() error {
+		resp, err = fl.List("", microvm.Namespace)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list microvms: %w", err)
+	}
+
+	var (
+		reaped int
+		failed int
+	)
+
+	for _, mvm := range resp.Microvm {
+		if mvm.Spec == nil || mvm.Spec.Uid == nil || deleting(mvm) {
+			continue
+		}
+
+		name := mvm.Spec.Id
+
+		warm := warmpool.IsWarm(name)
+
+		ref, ok := parseName(name)
+		if !ok && !warm {
+			continue
+		}
+
+		log := log.WithFields(logrus.Fields{
+			fieldRunner:     name,
+			fieldMicroVMUID: *mvm.Spec.Uid,
+		})
+
+		if !warm {
+			log = log.WithFields(logrus.Fields{fieldJobID: ref.ID, fieldRunID: ref.RunID})
+		}
+
+		if profile := mvm.Spec.Labels[microvm.ProfileLabel]; profile != "" {
+			log = log.WithField(fieldProfile, profile)
+		}
+
+		assigned, err := h.HostManager.Lookup(name)
+		known := err == nil && assigned == addr
+
+		if !known {
+			log.Warn("found microvm which the service has no record of")
+		}
+
+		reason, err := h.reapReason(ctx, cfg, mvm, ref)
+		if err != nil {
+			log.WithError(err).Warn("failed to check whether microvm should be reaped")
+			continue
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		log = log.WithField(fieldReason, reason)
+
+		if cfg.ReapDryRun {
+			log.Info("would reap microvm, but this is a dry run")
+			continue
+		}
+
+		repo, hasRepo := repoOf(cfg, mvm.Spec)
+
+		// the runner may have picked up another job since its own completed, in
+		// which case github will not let go of it until that job is done
+		if reason == reasonJobCompleted && hasRepo {
+			err := h.deregisterRunner(ctx, scopeFor(cfg, repo), mvm.Spec)
+
+			switch {
+			case err == nil:
+				log.Info("deregistered runner")
+			case errors.Is(err, githubapi.ErrUnprocessable):
+				log.Info("runner is running another job, leaving it for that job to clean up")
+				continue
+			case !errors.Is(err, githubapi.ErrNotFound):
+				log.WithError(err).Warn("failed to deregister runner, leaving it until the next reap")
+				continue
+			}
+		}
+
+		uid := *mvm.Spec.Uid
+
+		err = h.Metrics.ObserveFlintlock(metrics.OpDelete, func() error {
+			_, err := fl.Delete(uid)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).Error("failed to reap microvm")
+			failed++
+
+			continue
+		}
+
+		h.Metrics.Reaped(reason)
+
+		switch reason {
+		case reasonExpired:
+			log.WithFields(logrus.Fields{
+				fieldAge:         age(mvm.Spec).Round(time.Second).String(),
+				fieldMaxLifetime: cfg.MaxLifetimeFor(mvm.Spec.Labels[microvm.ProfileLabel]).String(),
+			}).Warn("forcibly terminated microvm which ran for longer than its max lifetime, its job may have hung")
+		case reasonFailed:
+			log.Warn("reaped microvm which failed")
+		default:
+			log.Info("reaped microvm")
+		}
+
+		// github only removes a runner once it has run a job
+		if hasRepo && reason != reasonJobCompleted {
+			err := h.deregisterRunner(ctx, scopeFor(cfg, repo), mvm.Spec)
+
+			switch {
+			case err == nil:
+				log.Info("deregistered runner")
+			case errors.Is(err, githubapi.ErrNotFound):
+				log.Debug("runner was not registered, nothing to deregister")
+			default:
+				log.WithError(err).Warn("failed to deregister runner")
+			}
+		}
+
+		reaped++
+
+		if warm && h.Warm != nil {
+			h.Warm.Remove(name)
+		}
+
+		if known {
+			if err := h.HostManager.Unassign(name); err != nil {
+				log.WithError(err).Error("failed to unassign host from runner")
+			}
+		}
+	}
+
+	if failed > 0 {
+		return reaped, fmt.Errorf("failed to delete %d microvms", failed)
+	}
+
+	return reaped, nil
+}
+
+// reapReason returns why the MicroVM should be reaped, or an empty string if it
+// should be left alone. github is not asked about MicroVMs without a job, ie.
+// warm runners.
+func (h handler) reapReason(ctx context.Context, cfg *config.Config, mvm *types.MicroVM, ref jobRef) (string, error) {
+	if mvm.Status != nil && mvm.Status.State == types.MicroVMStatus_FAILED {
+		return reasonFailed, nil
+	}
+
+	spec := mvm.Spec
+
+	lifetime := cfg.MaxLifetimeFor(spec.Labels[microvm.ProfileLabel])
+	if lifetime > 0 && age(spec) > lifetime {
+		return reasonExpired, nil
+	}
+
+	repo, ok := repoOf(cfg, spec)
+
+	if cfg.ReapCheckGitHub && ref.ID != 0 && ok {
+		owner, name, _ := strings.Cut(repo, "/")
+
+		status, err := h.GitHub.JobStatus(ctx, owner, name, ref.ID)
+		if err != nil {
+			return "", err
+		}
+
+		if status == githubapi.JobCompleted {
+			return reasonJobCompleted, nil
+		}
+	}
+
+	return "", nil
+}
+
+// deregisterRunner removes the MicroVM's runner from the scope in github, so
+// that it does not linger as an offline runner. The runner is found by the ID
+// recorded on the MicroVM, or by name for MicroVMs created before it was.
+func (h handler) deregisterRunner(ctx context.Context, scope githubapi.Scope, spec *types.MicroVMSpec) error {
+	id, ok := microvm.RunnerID(spec)
+	if !ok {
+		r, err := h.runnerNamed(ctx, scope, spec.Id)
+		if err != nil {
+			return err
+		}
+
+		id = r.ID
+	}
+
+	return h.GitHub.DeleteRunner(ctx, scope, id)
+}
+
+// runnerNamed returns the runner in the scope with the name, or
+// githubapi.ErrNotFound if there is none.
+func (h handler) runnerNamed(ctx context.Context, scope githubapi.Scope, name string) (githubapi.Runner, error) {
+	runners, err := h.GitHub.ListRunners(ctx, scope)
+	if err != nil {
+		return githubapi.Runner{}, err
+	}
+
+	for _, r := range runners {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+
+	return githubapi.Runner{}, fmt.Errorf("runner %s in %s: %w", name, scope, githubapi.ErrNotFound)
+}
+
+// age returns how long ago the MicroVM was created, or 0 if that is not known.
+func age(spec *types.MicroVMSpec) time.Duration {
+	if spec.CreatedAt == nil {
+		return 0
+	}
+
+	return time.Since(spec.CreatedAt.AsTime())
+}
+
+// deleting returns true if flintlock is already deleting the MicroVM.
+func deleting(mvm *types.MicroVM) bool {
+	return mvm.Spec.DeletedAt != nil || (mvm.Status != nil && mvm.Status.State == types.MicroVMStatus_DELETING)
+}
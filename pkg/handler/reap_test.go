@@ -0,0 +1,369 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/utils/pointer"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler/fakes"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+func TestReap(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		young    = expectedName("young", 1)
+		old      = expectedName("old", 2)
+		finished = expectedName("finished", 3)
+		unknown  = expectedName("unknown", 4)
+	)
+
+	// job 3 has completed, every other job is still running
+	jobStatuses := map[string]string{
+		"1": githubapi.JobInProgress,
+		"2": githubapi.JobInProgress,
+		"3": githubapi.JobCompleted,
+		"4": githubapi.JobInProgress,
+	}
+
+	list := &v1alpha1.ListMicroVMsResponse{
+		Microvm: []*types.MicroVM{
+			reapableMicrovm(young, "uid-young", time.Minute),
+			reapableMicrovm(old, "uid-old", 2*time.Hour),
+			reapableMicrovm(finished, "uid-finished", time.Minute),
+			reapableMicrovm(unknown, "uid-unknown", 2*time.Hour),
+			// not created by this service
+			reapableMicrovm("not-a-runner", "uid-other", 2*time.Hour),
+		},
+	}
+
+	tt := []struct {
+		name             string
+		maxLifetime      time.Duration
+		checkGitHub      bool
+		dryRun           bool
+		expectedDeleted  []string
+		expectedAssigned []string
+	}{
+		{
+			name:             "no max lifetime and github is not checked, nothing is reaped",
+			expectedAssigned: []string{young, old, finished},
+		},
+		{
+			name:             "microvms older than the max lifetime are reaped",
+			maxLifetime:      time.Hour,
+			expectedDeleted:  []string{"uid-old", "uid-unknown"},
+			expectedAssigned: []string{young, finished},
+		},
+		{
+			name:             "microvms whose job has completed are reaped",
+			checkGitHub:      true,
+			expectedDeleted:  []string{"uid-finished"},
+			expectedAssigned: []string{young, old},
+		},
+		{
+			name:             "both checks at once",
+			maxLifetime:      time.Hour,
+			checkGitHub:      true,
+			expectedDeleted:  []string{"uid-old", "uid-finished", "uid-unknown"},
+			expectedAssigned: []string{young},
+		},
+		{
+			name:             "dry run, nothing is reaped",
+			maxLifetime:      time.Hour,
+			checkGitHub:      true,
+			dryRun:           true,
+			expectedAssigned: []string{young, old, finished},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+				fmt.Fprintf(w, `{"status": %q}`, jobStatuses[id])
+			}))
+			defer gh.Close()
+
+			cfg := newTestConfig()
+			cfg.MaxLifetime = tc.maxLifetime
+			cfg.ReapCheckGitHub = tc.checkGitHub
+			cfg.ReapDryRun = tc.dryRun
+
+			flClient := &fakes.FakeFlintlockClient{}
+			flClient.ListReturns(list, nil)
+			flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+			ht := newHandlerTest(t, g, cfg, withFlintlockClient(flClient), withGitHub(githubapi.New(gh.URL, githubapi.StaticToken(func() string { return "token" }), nil)))
+			h, manager, m := ht.testHandler, ht.manager, ht.metrics
+
+			for _, runner := range []string{young, old, finished} {
+				_, err := manager.Assign(runner, host.Resources{})
+				g.Expect(err).NotTo(HaveOccurred())
+			}
+
+			g.Expect(h.Reap(context.Background())).To(Succeed())
+
+			deleted := []string{}
+			for i := 0; i < flClient.DeleteCallCount(); i++ {
+				deleted = append(deleted, flClient.DeleteArgsForCall(i))
+			}
+
+			g.Expect(deleted).To(ConsistOf(tc.expectedDeleted))
+			g.Expect(manager.Assignments()).To(HaveLen(len(tc.expectedAssigned)))
+
+			for _, runner := range tc.expectedAssigned {
+				g.Expect(manager.Assignments()).To(HaveKey(runner))
+			}
+
+			g.Expect(testutil.GatherAndCount(m.Gatherer(), "microvm_action_runner_reaped_microvms_total")).To(Equal(reasons(tc.maxLifetime, tc.checkGitHub, tc.dryRun)))
+		})
+	}
+}
+
+func TestReap_ProfileMaxLifetime(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		short   = expectedName("short", 1)
+		noLimit = expectedName("nolimit", 2)
+		global  = expectedName("global", 3)
+
+		deregistered []string
+	)
+
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `{"total_count": 2, "runners": [{"id": 7, "name": %q}, {"id": 8, "name": "someone-else"}]}`, short)
+		case http.MethodDelete:
+			deregistered = append(deregistered, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer gh.Close()
+
+	// only the short profile has a max lifetime
+	cfg := newTestConfig()
+	cfg.Username = "foo"
+	cfg.Repository = "bar"
+	cfg.Profiles = []config.Profile{
+		{Name: "short", MaxLifetime: time.Hour},
+		{Name: "long"},
+	}
+
+	list := &v1alpha1.ListMicroVMsResponse{
+		Microvm: []*types.MicroVM{
+			withProfile(reapableMicrovm(short, "uid-short", 2*time.Hour), "short"),
+			withProfile(reapableMicrovm(noLimit, "uid-nolimit", 2*time.Hour), "long"),
+			reapableMicrovm(global, "uid-global", 2*time.Hour),
+		},
+	}
+
+	flClient := &fakes.FakeFlintlockClient{}
+	flClient.ListReturns(list, nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	logger, hook := logtest.NewNullLogger()
+
+	ht := newHandlerTest(t, g, cfg, withFlintlockClient(flClient), withGitHub(githubapi.New(gh.URL, githubapi.StaticToken(func() string { return "token" }), nil)), withLogger(logrus.NewEntry(logger)))
+	h, manager := ht.testHandler, ht.manager
+
+	_, err := manager.Assign(short, host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(h.Reap(context.Background())).To(Succeed())
+
+	g.Expect(flClient.DeleteCallCount()).To(Equal(1))
+	g.Expect(flClient.DeleteArgsForCall(0)).To(Equal("uid-short"))
+	g.Expect(manager.Assignments()).NotTo(HaveKey(short))
+	g.Expect(deregistered).To(Equal([]string{"/repos/foo/bar/actions/runners/7"}))
+
+	// the forced termination is explained
+	terminated := findEntry(g, hook, "forcibly terminated microvm which ran for longer than its max lifetime, its job may have hung")
+	g.Expect(terminated.Level).To(Equal(logrus.WarnLevel))
+	g.Expect(terminated.Data).To(HaveKeyWithValue("runner", short))
+	g.Expect(terminated.Data).To(HaveKeyWithValue("profile", "short"))
+	g.Expect(terminated.Data).To(HaveKeyWithValue("max_lifetime", "1h0m0s"))
+	g.Expect(terminated.Data).To(HaveKeyWithValue("age", "2h0m0s"))
+
+	// a global max lifetime applies to everything without its own
+	cfg.MaxLifetime = 90 * time.Minute
+	flClient.ListReturns(list, nil)
+
+	g.Expect(h.Reap(context.Background())).To(Succeed())
+	g.Expect(flClient.DeleteCallCount()).To(Equal(4))
+}
+
+func TestReap_DeregistersRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		running  = expectedName("running", 1)
+		failed   = expectedName("failed", 2)
+		finished = expectedName("finished", 3)
+		reused   = expectedName("reused", 4)
+	)
+
+	gh := newTestGitHub(t)
+	gh.SetJobStatus(1, githubapi.JobInProgress)
+	gh.SetJobStatus(2, githubapi.JobQueued)
+	gh.SetJobStatus(3, githubapi.JobCompleted)
+	gh.SetJobStatus(4, githubapi.JobCompleted)
+
+	// none of the runners have run their own job, so github has not removed
+	// them
+	for _, runner := range []string{running, failed, finished, reused} {
+		gh.AddRunner("repos/foo/bar", runner)
+	}
+
+	// the job ran on another runner, and its own picked up a different job
+	gh.SetRunnerStatus("repos/foo/bar", reused, githubapi.RunnerOnline, true)
+
+	crashed := reapableMicrovm(failed, "uid-failed", time.Minute)
+	crashed.Status = &types.MicroVMStatus{State: types.MicroVMStatus_FAILED}
+
+	flClient := &fakes.FakeFlintlockClient{}
+	flClient.ListReturns(&v1alpha1.ListMicroVMsResponse{Microvm: []*types.MicroVM{
+		reapableMicrovm(running, "uid-running", time.Minute),
+		crashed,
+		reapableMicrovm(finished, "uid-finished", time.Minute),
+		reapableMicrovm(reused, "uid-reused", time.Minute),
+	}}, nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	cfg := newTestConfig()
+	cfg.ReapCheckGitHub = true
+
+	ht := newHandlerTest(t, g, cfg, withFlintlockClient(flClient), withGitHub(gh.Client()))
+	h, m := ht.testHandler, ht.metrics
+
+	g.Expect(h.Reap(context.Background())).To(Succeed())
+
+	g.Expect(flClient.DeleteCallCount()).To(Equal(2))
+	g.Expect([]string{flClient.DeleteArgsForCall(0), flClient.DeleteArgsForCall(1)}).To(ConsistOf("uid-failed", "uid-finished"))
+
+	names := []string{}
+	for _, r := range gh.Runners("repos/foo/bar") {
+		names = append(names, r.Name)
+	}
+
+	g.Expect(names).To(ConsistOf(running, reused))
+
+	expected := `
+# HELP microvm_action_runner_reaped_microvms_total MicroVMs deleted by the reaper, by why they were deleted.
+# TYPE microvm_action_runner_reaped_microvms_total counter
+microvm_action_runner_reaped_microvms_total{reason="failed"} 1
+microvm_action_runner_reaped_microvms_total{reason="job_completed"} 1
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected), "microvm_action_runner_reaped_microvms_total")).To(Succeed())
+}
+
+func TestReap_SkipsMicrovmsWhichAreBeingDeleted(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.MaxLifetime = time.Hour
+
+	deleting := reapableMicrovm(expectedName("foo", 1), "uid-1", 2*time.Hour)
+	deleting.Status = &types.MicroVMStatus{State: types.MicroVMStatus_DELETING}
+
+	deleted := reapableMicrovm(expectedName("foo", 2), "uid-2", 2*time.Hour)
+	deleted.Spec.DeletedAt = timestamppb.Now()
+
+	flClient := &fakes.FakeFlintlockClient{}
+	flClient.ListReturns(&v1alpha1.ListMicroVMsResponse{Microvm: []*types.MicroVM{deleting, deleted}}, nil)
+
+	h := newHandlerTest(t, g, cfg, withFlintlockClient(flClient))
+
+	g.Expect(h.Reap(context.Background())).To(Succeed())
+	g.Expect(flClient.DeleteCallCount()).To(Equal(0))
+}
+
+func TestReap_Errors(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.MaxLifetime = time.Hour
+
+	t.Run("list fails, the host is reported", func(t *testing.T) {
+		flClient := &fakes.FakeFlintlockClient{}
+		flClient.ListReturns(nil, errors.New("fail"))
+
+		h := newHandlerTest(t, g, cfg, withFlintlockClient(flClient))
+
+		g.Expect(h.Reap(context.Background())).To(MatchError("failed to reap hosts: host"))
+	})
+
+	t.Run("delete fails, the runner keeps its host", func(t *testing.T) {
+		runner := expectedName("foo", 1)
+
+		flClient := &fakes.FakeFlintlockClient{}
+		flClient.ListReturns(&v1alpha1.ListMicroVMsResponse{Microvm: []*types.MicroVM{reapableMicrovm(runner, "uid", 2*time.Hour)}}, nil)
+		flClient.DeleteReturns(nil, errors.New("fail"))
+
+		ht := newHandlerTest(t, g, cfg, withFlintlockClient(flClient))
+		h, manager := ht.testHandler, ht.manager
+
+		_, err := manager.Assign(runner, host.Resources{})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Expect(h.Reap(context.Background())).To(HaveOccurred())
+		g.Expect(manager.Assignments()).To(HaveKey(runner))
+	})
+}
+
+// reasons returns how many reasons for reaping are expected to be counted.
+func reasons(maxLifetime time.Duration, checkGitHub, dryRun bool) int {
+	if dryRun {
+		return 0
+	}
+
+	n := 0
+	if maxLifetime > 0 {
+		n++
+	}
+
+	if checkGitHub {
+		n++
+	}
+
+	return n
+}
+
+func withProfile(mvm *types.MicroVM, profile string) *types.MicroVM {
+	mvm.Spec.Labels = map[string]string{microvm.ProfileLabel: profile}
+
+	return mvm
+}
+
+func reapableMicrovm(name, uid string, age time.Duration) *types.MicroVM {
+	return &types.MicroVM{
+		Spec: &types.MicroVMSpec{
+			Id:        name,
+			Namespace: microvm.Namespace,
+			Uid:       pointer.String(uid),
+			CreatedAt: timestamppb.New(time.Now().Add(-age)),
+		},
+	}
+}
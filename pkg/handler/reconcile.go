@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+// Reconcile rebuilds the HostManager's records from the MicroVMs which are
+// actually running on each host. It should be called on startup so that runners
+// created before a crash or restart are still cleaned up when their jobs complete.
+//
+// Hosts which cannot be reached keep whatever records the HostManager already
+// had for them. Warm runners are put back in the warm pool. MicroVMs whose
+// names cannot be mapped back to a workflow job are logged and left alone.
+func (h handler) Reconcile() error {
+	var failed []string
+
+	for _, addr := range h.HostManager.Hosts() {
+		if err := h.reconcileHost(addr); err != nil {
+			h.L.WithField(fieldHost, addr).WithError(err).Error("failed to reconcile host")
+			failed = append(failed, addr)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to reconcile hosts: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (h handler) reconcileHost(addr string) error {
+	log := h.L.WithField(fieldHost, addr)
+
+	fl, err := h.Client(addr)
+	if err != nil {
+		return fmt.Errorf("failed to create flintlock client: %w", err)
+	}
+
+	defer func() {
+		if err := fl.Close(); err != nil {
+			log.WithError(err).Error("failed to close connection to flintlock host")
+		}
+	}()
+
+	var resp *v1alpha1.ListMicroVMsResponse
+
+	// an empty name lists every microvm in the namespace
+	err = h.Metrics.ObserveFlintlock(metrics.OpList, func() error {
+		resp, err = fl.List("", microvm.Namespace)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list microvms: %w", err)
+	}
+
+	var (
+		cfg     = h.Config.Get()
+		runners = map[string]host.Resources{}
+	)
+
+	for _, mvm := range resp.Microvm {
+		if mvm.Spec == nil {
+			continue
+		}
+
+		name := mvm.Spec.Id
+
+		if warmpool.IsWarm(name) {
+			if h.Warm != nil {
+				h.Warm.Add(name, mvm.Spec.Labels[microvm.ProfileLabel])
+			}
+
+			runners[name] = foundResources(cfg, mvm.Spec)
+
+			continue
+		}
+
+		if _, ok := parseName(name); !ok {
+			log.Warnf("found microvm %s/%s which does not map to a workflow job, ignoring", microvm.Namespace, name)
+			continue
+		}
+
+		runners[name] = foundResources(cfg, mvm.Spec)
+	}
+
+	if err := h.HostManager.Restore(addr, runners); err != nil {
+		return err
+	}
+
+	log.Infof("reconciled host, found %d runners", len(runners))
+
+	return nil
+}
+
+// foundResources returns what a MicroVM found on a host takes up. Anything the
+// listed spec leaves out is taken from the profile the MicroVM was created
+// with, or the default MicroVM, so that the host is not overcommitted.
+func foundResources(cfg *config.Config, spec *types.MicroVMSpec) host.Resources {
+	res := resourcesOf(spec)
+
+	shape, err := microvm.New(spec.Id, cfg.ProfileNamed(spec.Labels[microvm.ProfileLabel]))
+	if err != nil {
+		return res
+	}
+
+	if res.VCPU == 0 {
+		res.VCPU = int(shape.Vcpu)
+	}
+
+	if res.MemoryMiB == 0 {
+		res.MemoryMiB = int(shape.MemoryInMb)
+	}
+
+	return res
+}
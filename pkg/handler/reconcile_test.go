@@ -0,0 +1,118 @@
+package handler_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/weaveworks-liquidmetal/flintlock/api/services/microvm/v1alpha1"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+func TestReconcile(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		cfg      = newTestConfig()
+		ht       = newHandlerTest(t, g, cfg)
+		h        = ht.testHandler
+		flClient = ht.flClient
+		manager  = ht.manager
+		runner   = expectedName("foo", 1234)
+	)
+
+	flClient.ListReturns(fakeNamedMicrovmList(runner, "not-a-runner"), nil)
+
+	// a stale record which no longer exists on the host should be dropped
+	_, err := manager.Assign("stale-1-1", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(h.Reconcile()).To(Succeed())
+
+	g.Expect(flClient.ListCallCount()).To(Equal(1))
+	name, namespace := flClient.ListArgsForCall(0)
+	g.Expect(name).To(BeEmpty())
+	g.Expect(namespace).To(Equal(microvm.Namespace))
+
+	found, err := manager.Lookup(runner)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal(cfg.Hosts[0].Address))
+
+	_, err = manager.Lookup("not-a-runner")
+	g.Expect(err).To(HaveOccurred())
+	_, err = manager.Lookup("stale-1-1")
+	g.Expect(err).To(HaveOccurred())
+
+	g.Expect(manager.Count(cfg.Hosts[0].Address)).To(Equal(1))
+}
+
+func TestReconcile_UnreachableHostKeepsRecords(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		cfg     = newTestConfig()
+		ht      = newHandlerTest(t, g, cfg, withClient(newBadClient))
+		h       = ht.testHandler
+		manager = ht.manager
+		runner  = expectedName("foo", 1234)
+	)
+
+	_, err := manager.Assign(runner, host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(h.Reconcile()).To(MatchError(ContainSubstring(cfg.Hosts[0].Address)))
+
+	found, err := manager.Lookup(runner)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal(cfg.Hosts[0].Address))
+}
+
+func TestReconcile_AdoptedRunnersTakeUpCapacity(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		cfg   = newTestConfig()
+		large = expectedName("foo", 1)
+		sized = expectedName("foo", 2)
+	)
+
+	cfg.Hosts = []config.Host{{Address: "host", VCPU: 16}}
+	cfg.Profiles = []config.Profile{{Name: "large", VCPU: 8, MemoryMiB: 16384}}
+
+	ht := newHandlerTest(t, g, cfg)
+	h, flClient, manager := ht.testHandler, ht.flClient, ht.manager
+
+	// neither runner is in the state file, and the first one's spec does not
+	// say how big it is
+	list := fakeNamedMicrovmList(large, sized)
+	list.Microvm[0].Spec.Labels = map[string]string{microvm.ProfileLabel: "large"}
+	list.Microvm[1].Spec.Vcpu = 2
+	list.Microvm[1].Spec.MemoryInMb = 2048
+	flClient.ListReturns(list, nil)
+
+	g.Expect(h.Reconcile()).To(Succeed())
+
+	g.Expect(manager.Used("host")).To(Equal(host.Resources{VCPU: 10, MemoryMiB: 18432}))
+
+	// so the host has no room for another large runner
+	_, err := manager.Assign("next", host.Resources{VCPU: 8})
+	g.Expect(err).To(MatchError(host.ErrNoCapacity))
+}
+
+func fakeNamedMicrovmList(names ...string) *v1alpha1.ListMicroVMsResponse {
+	list := &v1alpha1.ListMicroVMsResponse{}
+
+	for _, name := range names {
+		list.Microvm = append(list.Microvm, &types.MicroVM{
+			Spec: &types.MicroVMSpec{
+				Id:        name,
+				Namespace: microvm.Namespace,
+			},
+		})
+	}
+
+	return list
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+	"github.com/weaveworks-liquidmetal/flintlock/api/types"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+// checkRepo returns why runners cannot be created for jobs from the event's
+// repo, or nil if they can.
+func checkRepo(cfg *config.Config, p github.WorkflowJobPayload) error {
+	repo := p.Repository.FullName
+
+	if !cfg.RepoAllowed(repo) {
+		return fmt.Errorf("repo %q is not allowed", repo)
+	}
+
+	if cfg.RunnerScope == config.ScopeOrg && p.Organization.Login == "" {
+		return fmt.Errorf("repo %s is not owned by an org, so its jobs cannot have org runners", repo)
+	}
+
+	return nil
+}
+
+// scopeFor returns where the runners for jobs from the repo, given as
+// owner/name, are registered.
+func scopeFor(cfg *config.Config, repo string) githubapi.Scope {
+	owner, name, _ := strings.Cut(repo, "/")
+
+	switch cfg.RunnerScope {
+	case config.ScopeOrg:
+		return githubapi.OrgScope(owner)
+	case config.ScopeEnterprise:
+		return githubapi.EnterpriseScope(cfg.Enterprise)
+	default:
+		return githubapi.RepoScope(owner, name)
+	}
+}
+
+// repoOf returns the repo, as owner/name, which the MicroVM's runner was
+// registered for. MicroVMs created before repos were recorded belong to the
+// repo given by the user and repo settings, if there is one.
+func repoOf(cfg *config.Config, spec *types.MicroVMSpec) (string, bool) {
+	if repo := spec.Labels[microvm.RepoLabel]; repo != "" {
+		return repo, true
+	}
+
+	if cfg.Username != "" && cfg.Repository != "" {
+		return cfg.Username + "/" + cfg.Repository, true
+	}
+
+	return "", false
+}
+
+// sweepScopes returns every scope the service's runners may be registered in.
+// Repos which are allowed by a wildcard cannot be listed, so they are left out
+// unless runners are registered with their org or the enterprise.
+func sweepScopes(cfg *config.Config) []githubapi.Scope {
+	var (
+		scopes []githubapi.Scope
+		seen   = map[githubapi.Scope]bool{}
+	)
+
+	for _, repo := range cfg.Repos() {
+		if cfg.RunnerScope == config.ScopeRepo && strings.HasSuffix(repo, "/*") {
+			continue
+		}
+
+		scope := scopeFor(cfg, repo)
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
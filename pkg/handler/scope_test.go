@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+func TestHandleWebhookPost_Repos(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name           string
+		allowedRepos   []string
+		scope          string
+		enterprise     string
+		event          func(e *github.WorkflowJobPayload)
+		expectedStatus int
+		expectedScope  string
+	}{
+		{
+			name:           "the configured repo, the runner is registered with it",
+			scope:          config.ScopeRepo,
+			expectedStatus: http.StatusAccepted,
+			expectedScope:  "repos/foo/bar",
+		},
+		{
+			name:         "an allowed repo, the runner is registered with it",
+			allowedRepos: []string{"baz/qux"},
+			scope:        config.ScopeRepo,
+			event: func(e *github.WorkflowJobPayload) {
+				e.Repository.FullName = "Baz/Qux"
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedScope:  "repos/Baz/Qux",
+		},
+		{
+			name:         "a repo allowed by a wildcard, the runner is registered with it",
+			allowedRepos: []string{"foo/*"},
+			scope:        config.ScopeRepo,
+			event: func(e *github.WorkflowJobPayload) {
+				e.Repository.FullName = "foo/other"
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedScope:  "repos/foo/other",
+		},
+		{
+			name:  "a repo which is not allowed, the event is rejected",
+			scope: config.ScopeRepo,
+			event: func(e *github.WorkflowJobPayload) {
+				e.Repository.FullName = "someone/else"
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "org scope, the runner is registered with the org",
+			scope:          config.ScopeOrg,
+			expectedStatus: http.StatusAccepted,
+			expectedScope:  "orgs/foo",
+		},
+		{
+			name:  "org scope but the repo is not owned by an org, the event is rejected",
+			scope: config.ScopeOrg,
+			event: func(e *github.WorkflowJobPayload) {
+				e.Organization.Login = ""
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "enterprise scope, the runner is registered with the enterprise",
+			scope:          config.ScopeEnterprise,
+			enterprise:     "acme",
+			expectedStatus: http.StatusAccepted,
+			expectedScope:  "enterprises/acme",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.AllowedRepos = tc.allowedRepos
+			cfg.RunnerScope = tc.scope
+			cfg.Enterprise = tc.enterprise
+
+			ht := newHandlerTest(t, g, cfg)
+			ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+			event := fakeEvent("queued", "foo", 1)
+			if tc.event != nil {
+				tc.event(event)
+			}
+
+			g.Expect(send(ht.testHandler, ht.payloadService, event)).To(Equal(tc.expectedStatus))
+
+			if tc.expectedStatus != http.StatusAccepted {
+				g.Expect(ht.flClient.CreateCallCount()).To(BeZero())
+				return
+			}
+
+			g.Expect(ht.flClient.CreateCallCount()).To(Equal(1))
+			g.Expect(ht.gh.Runners(tc.expectedScope)).To(HaveLen(1))
+
+			// the repo is kept on the microvm, so that it can be deregistered later
+			spec := ht.flClient.CreateArgsForCall(0)
+			g.Expect(spec.Labels).To(HaveKeyWithValue(microvm.RepoLabel, event.Repository.FullName))
+		})
+	}
+}
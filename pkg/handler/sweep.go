@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+// SweepRunners removes runners from github which were registered by the
+// service, ie. carry microvm.RunnerLabel, but have been left behind, eg.
+// because their MicroVM crashed or was deleted by hand before they ran a
+// job. A runner is swept when it is offline
+// and the service has no record of its MicroVM, so runners whose MicroVMs are
+// still booting are left alone. Every scope the service registers runners in
+// is swept. In dry run mode they are only logged.
+func (h handler) SweepRunners(ctx context.Context) error {
+	var (
+		cfg     = h.Config.Get()
+		failed  = 0
+		listErr error
+	)
+
+	// one scope failing to list does not stop the others being swept
+	for _, scope := range sweepScopes(cfg) {
+		n, err := h.sweepScope(ctx, scope, cfg.ReapDryRun)
+		if err != nil && listErr == nil {
+			listErr = err
+		}
+
+		failed += n
+	}
+
+	if listErr != nil {
+		return listErr
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to deregister %d runners", failed)
+	}
+
+	return nil
+}
+
+// sweepScope removes the left behind runners from the scope, returning how
+// many could not be removed.
+func (h handler) sweepScope(ctx context.Context, scope githubapi.Scope, dryRun bool) (int, error) {
+	runners, err := h.GitHub.ListRunners(ctx, scope)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+
+	for _, r := range runners {
+		if r.Status != githubapi.RunnerOffline || r.Busy || !r.HasLabel(microvm.RunnerLabel) {
+			continue
+		}
+
+		if _, err := h.HostManager.Lookup(r.Name); err == nil {
+			continue
+		}
+
+		log := h.L.WithFields(logrus.Fields{fieldRunner: r.Name, fieldScope: scope.String()})
+
+		if dryRun {
+			log.Info("would deregister offline runner which has no microvm, but this is a dry run")
+			continue
+		}
+
+		err := h.GitHub.DeleteRunner(ctx, scope, r.ID)
+		if err != nil && !errors.Is(err, githubapi.ErrNotFound) {
+			log.WithError(err).Warn("failed to deregister offline runner")
+			failed++
+
+			continue
+		}
+
+		log.Info("deregistered offline runner which has no microvm")
+	}
+
+	return failed, nil
+}
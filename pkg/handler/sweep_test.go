@@ -0,0 +1,89 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/githubapi"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+func TestSweepRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		crashed = expectedName("crashed", 1)
+		online  = expectedName("online", 2)
+		busy    = expectedName("busy", 3)
+		booting = expectedName("booting", 4)
+		warm    = "warm-0000abcd"
+		// registered by someone else with a name the service could have used
+		foreign = expectedName("foreign", 5)
+	)
+
+	tt := []struct {
+		name            string
+		dryRun          bool
+		expectedRunners []string
+	}{
+		{
+			name:            "offline runners without a microvm are deregistered",
+			expectedRunners: []string{online, busy, booting, foreign, "someone-else"},
+		},
+		{
+			name:            "dry run, nothing is deregistered",
+			dryRun:          true,
+			expectedRunners: []string{crashed, online, busy, booting, warm, foreign, "someone-else"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gh := newTestGitHub(t)
+
+			for _, name := range []string{crashed, online, busy, booting, warm} {
+				gh.AddRunner("repos/foo/bar", name, "self-hosted", microvm.RunnerLabel)
+			}
+
+			gh.AddRunner("repos/foo/bar", foreign, "self-hosted")
+			gh.AddRunner("repos/foo/bar", "someone-else", "self-hosted")
+
+			gh.SetRunnerStatus("repos/foo/bar", online, githubapi.RunnerOnline, false)
+			gh.SetRunnerStatus("repos/foo/bar", busy, githubapi.RunnerOffline, true)
+
+			cfg := newTestConfig()
+			cfg.ReapDryRun = tc.dryRun
+
+			ht := newHandlerTest(t, g, cfg, withGitHub(gh.Client()))
+			h, manager := ht.testHandler, ht.manager
+
+			// the runner is registered before its microvm has booted
+			_, err := manager.Assign(booting, host.Resources{})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			g.Expect(h.SweepRunners(context.Background())).To(Succeed())
+
+			names := []string{}
+			for _, r := range gh.Runners("repos/foo/bar") {
+				names = append(names, r.Name)
+			}
+
+			g.Expect(names).To(ConsistOf(tc.expectedRunners))
+		})
+	}
+}
+
+func TestSweepRunners_GitHubFails(t *testing.T) {
+	g := NewWithT(t)
+
+	gh := newTestGitHub(t)
+	gh.Fail(http.StatusInternalServerError)
+
+	h := newHandlerTest(t, g, newTestConfig(), withGitHub(gh.Client()))
+
+	g.Expect(h.SweepRunners(context.Background())).To(MatchError(ContainSubstring("failed to list runners")))
+}
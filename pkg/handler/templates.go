@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+)
+
+// UserDataTemplates are parsed userdata templates by the file they were read
+// from.
+type UserDataTemplates map[string]*template.Template
+
+// LoadUserDataTemplates loads the userdata template of every profile which has
+// its own, so that a broken template is found before a runner needs it. They
+// are only used once given to SetUserDataTemplates.
+func LoadUserDataTemplates(cfg *config.Config) (UserDataTemplates, error) {
+	templates := UserDataTemplates{}
+
+	for _, p := range cfg.Profiles {
+		if p.UserDataTemplateFile == "" {
+			continue
+		}
+
+		tmpl, err := loadUserDataTemplate(p.UserDataTemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+
+		templates[p.UserDataTemplateFile] = tmpl
+	}
+
+	return templates, nil
+}
+
+// SetUserDataTemplates swaps the templates runners are created with, so an
+// edited template is only used once the config is reloaded.
+func (h handler) SetUserDataTemplates(templates UserDataTemplates) {
+	h.templates.replace(templates)
+}
+
+// userDataTemplate returns the profile's userdata template, or nil if the
+// MicroVM should use the embedded one.
+func (h handler) userDataTemplate(p config.Profile) (*template.Template, error) {
+	if p.UserDataTemplateFile == "" {
+		return nil, nil
+	}
+
+	if tmpl, ok := h.templates.get(p.UserDataTemplateFile); ok {
+		return tmpl, nil
+	}
+
+	// only the templates of profiles which were checked are cached
+	tmpl, err := loadUserDataTemplate(p.UserDataTemplateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	h.templates.set(p.UserDataTemplateFile, tmpl)
+
+	return tmpl, nil
+}
+
+func loadUserDataTemplate(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read userdata template: %w", err)
+	}
+
+	return microvm.ParseTemplate(path, string(text))
+}
+
+// templateCache holds parsed userdata templates by the file they were read
+// from. It is safe for concurrent use.
+type templateCache struct {
+	mu        sync.Mutex
+	templates UserDataTemplates
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: UserDataTemplates{}}
+}
+
+func (c *templateCache) get(path string) (*template.Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpl, ok := c.templates[path]
+
+	return tmpl, ok
+}
+
+func (c *templateCache) set(path string, tmpl *template.Template) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.templates[path] = tmpl
+}
+
+// replace swaps every cached template for templates.
+func (c *templateCache) replace(templates UserDataTemplates) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.templates = templates
+}
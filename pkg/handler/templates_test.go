@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/handler"
+)
+
+func TestLoadUserDataTemplates(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.sh.tmpl")
+	g.Expect(os.WriteFile(good, []byte(`./run.sh --jitconfig "{{ .JITConfig }}"`), 0o600)).To(Succeed())
+
+	bad := filepath.Join(dir, "bad.sh.tmpl")
+	g.Expect(os.WriteFile(bad, []byte(`./config.sh --token "{{ .Token }}"`), 0o600)).To(Succeed())
+
+	tt := []struct {
+		name        string
+		file        string
+		expectedErr string
+	}{
+		{
+			name: "no template, the embedded one is used",
+		},
+		{
+			name: "a template which renders",
+			file: good,
+		},
+		{
+			name:        "a template which refers to a value there is not",
+			file:        bad,
+			expectedErr: "profile gpu: failed to render userdata template",
+		},
+		{
+			name:        "a template which is not there",
+			file:        filepath.Join(dir, "missing.sh.tmpl"),
+			expectedErr: "profile gpu: failed to read userdata template",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.Profiles = []config.Profile{{Name: "gpu", UserDataTemplateFile: tc.file}}
+
+			_, err := handler.LoadUserDataTemplates(cfg)
+			if tc.expectedErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+}
+
+func TestHandleWebhookPost_UserDataTemplate(t *testing.T) {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "gpu.sh.tmpl")
+	g.Expect(os.WriteFile(path, []byte(`echo "gpu runner {{ .Name }}"`), 0o600)).To(Succeed())
+
+	cfg := newTestConfig()
+	cfg.Profiles = []config.Profile{{Name: "gpu", UserDataTemplateFile: path}}
+
+	ht := newHandlerTest(t, g, cfg)
+	ht.flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	setUserDataTemplates(g, ht.testHandler, cfg)
+
+	// jobs for the profile get its template, the rest get the embedded one
+	gpu := fakeEvent("queued", "foo", 1)
+	gpu.WorkflowJob.Labels = []string{"self-hosted", "gpu"}
+	g.Expect(send(ht.testHandler, ht.payloadService, gpu)).To(Equal(http.StatusAccepted))
+	g.Expect(send(ht.testHandler, ht.payloadService, fakeEvent("queued", "bar", 2))).To(Equal(http.StatusAccepted))
+
+	g.Expect(userData(g, ht.flClient.CreateArgsForCall(0))).To(ContainSubstring(`echo "gpu runner ` + expectedName("foo", 1) + `"`))
+	g.Expect(userData(g, ht.flClient.CreateArgsForCall(1))).To(ContainSubstring("JIT_CONFIG="))
+
+	// an edited template is only used once it is reloaded, and a broken one
+	// is not reloaded at all
+	g.Expect(os.WriteFile(path, []byte(`{{ .Token }}`), 0o600)).To(Succeed())
+	_, err := handler.LoadUserDataTemplates(cfg)
+	g.Expect(err).To(HaveOccurred())
+
+	gpu = fakeEvent("queued", "baz", 3)
+	gpu.WorkflowJob.Labels = []string{"self-hosted", "gpu"}
+	g.Expect(send(ht.testHandler, ht.payloadService, gpu)).To(Equal(http.StatusAccepted))
+	g.Expect(userData(g, ht.flClient.CreateArgsForCall(2))).To(ContainSubstring(`echo "gpu runner ` + expectedName("baz", 3) + `"`))
+
+	g.Expect(os.WriteFile(path, []byte(`echo "edited {{ .Name }}"`), 0o600)).To(Succeed())
+	setUserDataTemplates(g, ht.testHandler, cfg)
+
+	gpu = fakeEvent("queued", "qux", 4)
+	gpu.WorkflowJob.Labels = []string{"self-hosted", "gpu"}
+	g.Expect(send(ht.testHandler, ht.payloadService, gpu)).To(Equal(http.StatusAccepted))
+	g.Expect(userData(g, ht.flClient.CreateArgsForCall(3))).To(ContainSubstring(`echo "edited ` + expectedName("qux", 4) + `"`))
+}
+
+func setUserDataTemplates(g *WithT, h handlerUnderTest, cfg *config.Config) {
+	templates, err := handler.LoadUserDataTemplates(cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	h.SetUserDataTemplates(templates)
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+// FillWarmPool creates warm runners until every profile has as many idle ones
+// as its warm pool size. The MicroVMs are created in the background by the
+// worker pool. Pending jobs come first, so nothing is created while the queue
+// is not empty.
+func (h handler) FillWarmPool() {
+	if h.Warm == nil {
+		return
+	}
+
+	h.Warm.SetSizes(h.Config.Get().WarmPoolSizes())
+
+	if h.Queue.Len() > 0 {
+		return
+	}
+
+	for _, r := range h.Warm.Reserve() {
+		r := r
+
+		log := h.L.WithField(fieldRunner, r.Name)
+		if r.Profile != "" {
+			log = log.WithField(fieldProfile, r.Profile)
+		}
+
+		// a runner which cannot be created is not retried, it is reserved again
+		// the next time the pool is filled
+		task := func() error {
+			if err := h.createWarmRunner(log, r); err != nil {
+				h.Warm.Remove(r.Name)
+
+				if errors.Is(err, host.ErrNoCapacity) {
+					log.Debug("no room for warm runner")
+				} else {
+					log.WithError(err).Warn("failed to create warm runner")
+				}
+			}
+
+			return nil
+		}
+
+		if err := h.Workers.Submit(r.Name, task); err != nil {
+			log.WithError(err).Warn("failed to submit warm runner for creation")
+			h.Warm.Remove(r.Name)
+		}
+	}
+}
+
+func (h handler) createWarmRunner(log *logrus.Entry, r warmpool.Reservation) error {
+	cfg := h.Config.Get()
+
+	profile := cfg.ProfileNamed(r.Profile)
+	if profile.Name != r.Profile {
+		return fmt.Errorf("profile %s no longer exists", r.Profile)
+	}
+
+	// warm runners have no job to take a repo from, so they go wherever every
+	// allowed repo's runners are registered
+	repo, ok := cfg.WarmPoolRepo()
+	if !ok {
+		return errors.New("allowed repos do not all register their runners in the same place")
+	}
+
+	log.Debug("creating warm runner")
+
+	if err := h.provision(log, r.Name, repo, warmLabels(cfg, profile), profile); err != nil {
+		return err
+	}
+
+	h.Warm.Created(r.Name)
+
+	log.Info("created warm runner")
+
+	return nil
+}
+
+// claimWarmRunner takes an idle warm runner for the job, if there is one which
+// github could give it to. The pool is then topped up again.
+func (h handler) claimWarmRunner(log *logrus.Entry, name string, p github.WorkflowJobPayload) bool {
+	if h.Warm == nil {
+		return false
+	}
+
+	cfg := h.Config.Get()
+	profile, _ := config.SelectProfile(cfg.Profiles, p.WorkflowJob.Labels)
+
+	hit := covers(warmLabels(cfg, profile), p.WorkflowJob.Labels) &&
+		warmGroupFits(cfg, p.Repository.FullName, profile) &&
+		h.Warm.Claim(name, profile.Name)
+
+	if cfg.WarmPoolSizes()[profile.Name] > 0 || hit {
+		h.Metrics.WarmPoolRequest(profile.Name, hit)
+	}
+
+	if !hit {
+		return false
+	}
+
+	log.Info("job claimed a warm runner, no microvm to create")
+
+	h.FillWarmPool()
+
+	return true
+}
+
+// processInProgressAction settles the job's claim on a warm runner now that
+// github has said which runner picked it up. It returns the outcome for the
+// webhook metrics.
+func (h handler) processInProgressAction(log *logrus.Entry, p github.WorkflowJobPayload) string {
+	if h.Warm == nil {
+		return metrics.OutcomeIgnored
+	}
+
+	runner := p.WorkflowJob.RunnerName
+
+	if !h.Warm.Started(generateName(p), runner) {
+		log.Debugf("job was picked up by runner %s which is not a warm runner", runner)
+		return metrics.OutcomeIgnored
+	}
+
+	log.WithField(fieldRunner, runner).Info("job was picked up by a warm runner")
+
+	return metrics.OutcomeAccepted
+}
+
+// deleteWarmRunner deletes the warm runner which ran the job.
+func (h handler) deleteWarmRunner(log *logrus.Entry, name, runner string) error {
+	log = log.WithField(fieldRunner, runner)
+
+	if h.Warm != nil {
+		h.Warm.Release(name)
+		h.Warm.Remove(runner)
+	}
+
+	return h.deleteRunner(log, runner)
+}
+
+// warmLabels returns the labels a warm runner with the profile is registered
+// with: the configured labels, those which select the profile and
+// defaultRunnerLabels, since its job is not known yet.
+func warmLabels(cfg *config.Config, profile config.Profile) []string {
+	labels := append([]string{}, cfg.Labels...)
+
+	if profile.Name != "" {
+		labels = append(labels, profile.SelectedBy()...)
+	}
+
+	for _, l := range defaultRunnerLabels {
+		if !containsFold(labels, l) {
+			labels = append(labels, l)
+		}
+	}
+
+	return labels
+}
+
+// warmGroupFits returns true if the job's runner would go in the same runner
+// group as the profile's warm runners, so that github could give it to them.
+func warmGroupFits(cfg *config.Config, repo string, profile config.Profile) bool {
+	warmRepo, _ := cfg.WarmPoolRepo()
+
+	return cfg.RunnerGroupFor(repo, profile) == cfg.RunnerGroupFor(warmRepo, profile)
+}
+
+// covers returns true if github would give a job with the wanted labels to a
+// runner with the given labels. Labels are compared without regard to case.
+func covers(labels, wanted []string) bool {
+	has := map[string]bool{}
+
+	for _, l := range labels {
+		has[strings.ToLower(l)] = true
+	}
+
+	for _, l := range wanted {
+		if !has[strings.ToLower(l)] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,220 @@
+package handler_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+func TestWarmPool(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.WarmPoolSize = 1
+
+	var (
+		w              = newHandlerTest(t, g, cfg)
+		h              = w.testHandler
+		payloadService = w.payloadService
+		flClient       = w.flClient
+		manager        = w.manager
+		pool           = w.pool
+	)
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+	flClient.ListReturns(fakeMicrovmList("uid"), nil)
+	flClient.DeleteReturns(&emptypb.Empty{}, nil)
+
+	w.fill()
+	h.workers.Wait()
+
+	g.Expect(flClient.CreateCallCount()).To(Equal(1))
+	warm := flClient.CreateArgsForCall(0).Id
+	g.Expect(warmpool.IsWarm(warm)).To(BeTrue())
+	g.Expect(manager.Lookup(warm)).To(Equal("host"))
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1}}))
+
+	// the job takes the warm runner, and another is created to replace it
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(2))
+	replacement := flClient.CreateArgsForCall(1).Id
+	g.Expect(warmpool.IsWarm(replacement)).To(BeTrue())
+	g.Expect(replacement).NotTo(Equal(warm))
+
+	started := fakeEvent("in_progress", "foo", 1)
+	started.WorkflowJob.RunnerName = warm
+	g.Expect(send(h, payloadService, started)).To(Equal(http.StatusOK))
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1, Busy: 1}}))
+
+	// the warm runner only runs one job
+	completed := fakeEvent("completed", "foo", 1)
+	completed.WorkflowJob.RunnerName = warm
+	g.Expect(send(h, payloadService, completed)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(1))
+	name, _ := flClient.ListArgsForCall(0)
+	g.Expect(name).To(Equal(warm))
+	_, err := manager.Lookup(warm)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1}}))
+
+	// every warm runner is registered with github as soon as it is created
+	g.Expect(w.gh.Runners("repos/foo/bar")).To(HaveLen(2))
+
+	// the next job gets the replacement
+	g.Expect(send(h, payloadService, fakeEvent("queued", "bar", 2))).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(3))
+	g.Expect(warmpool.IsWarm(flClient.CreateArgsForCall(2).Id)).To(BeTrue())
+
+	expected := `
+# HELP microvm_action_runner_warm_pool_requests_total Queued jobs for profiles with a warm pool, by profile and whether a warm runner was free for them.
+# TYPE microvm_action_runner_warm_pool_requests_total counter
+microvm_action_runner_warm_pool_requests_total{profile="default",result="hit"} 2
+`
+
+	g.Expect(testutil.GatherAndCompare(w.metrics.Gatherer(), strings.NewReader(expected), "microvm_action_runner_warm_pool_requests_total")).To(Succeed())
+}
+
+func TestWarmPool_Miss(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.WarmPoolSize = 1
+	cfg.Profiles = []config.Profile{{Name: "gpu"}}
+
+	w := newHandlerTest(t, g, cfg)
+	h, payloadService, flClient := w.testHandler, w.payloadService, w.flClient
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	// the pool has not been filled yet, so the job gets its own runner
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateArgsForCall(0).Id).To(Equal(expectedName("foo", 1)))
+
+	// jobs for profiles without a warm pool are not counted
+	gpu := fakeEvent("queued", "bar", 2)
+	gpu.WorkflowJob.Labels = []string{"self-hosted", "gpu"}
+	g.Expect(send(h, payloadService, gpu)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateArgsForCall(1).Id).To(Equal(expectedName("bar", 2)))
+
+	expected := `
+# HELP microvm_action_runner_warm_pool_requests_total Queued jobs for profiles with a warm pool, by profile and whether a warm runner was free for them.
+# TYPE microvm_action_runner_warm_pool_requests_total counter
+microvm_action_runner_warm_pool_requests_total{profile="default",result="miss"} 1
+`
+
+	g.Expect(testutil.GatherAndCompare(w.metrics.Gatherer(), strings.NewReader(expected), "microvm_action_runner_warm_pool_requests_total")).To(Succeed())
+}
+
+func TestWarmPool_JobLabelsMustBeCovered(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Profiles = []config.Profile{
+		{Name: "large", Labels: []string{"large"}, WarmPool: 1},
+		{Name: "gpu", Labels: []string{"gpu"}},
+	}
+
+	w := newHandlerTest(t, g, cfg)
+	h, payloadService, flClient := w.testHandler, w.payloadService, w.flClient
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	w.fill()
+	h.workers.Wait()
+
+	spec := flClient.CreateArgsForCall(0)
+	g.Expect(spec.Labels).To(HaveKeyWithValue(microvm.ProfileLabel, "large"))
+
+	runners := w.gh.Runners("repos/foo/bar")
+	g.Expect(runners).To(HaveLen(1))
+	g.Expect(runners[0].Labels).To(Equal([]string{"self-hosted", "large", "linux", "x64", microvm.RunnerLabel}))
+
+	// the job selects the large profile, but the warm runner does not have the
+	// gpu label so github would never give it this job
+	job := fakeEvent("queued", "foo", 1)
+	job.WorkflowJob.Labels = []string{"self-hosted", "large", "gpu"}
+
+	g.Expect(send(h, payloadService, job)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(2))
+	g.Expect(flClient.CreateArgsForCall(1).Id).To(Equal(expectedName("foo", 1)))
+}
+
+func TestWarmPool_DefaultRunnerLabels(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.WarmPoolSize = 1
+
+	w := newHandlerTest(t, g, cfg)
+	h, payloadService, flClient := w.testHandler, w.payloadService, w.flClient
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	w.fill()
+	h.workers.Wait()
+
+	warm := flClient.CreateArgsForCall(0).Id
+
+	// a just in time runner only has the labels it is registered with, so
+	// the warm runner must have these for github to give it the job
+	job := fakeEvent("queued", "foo", 1)
+	job.WorkflowJob.Labels = []string{"self-hosted", "linux", "x64"}
+
+	g.Expect(send(h, payloadService, job)).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.CreateCallCount()).To(Equal(2))
+	g.Expect(warmpool.IsWarm(flClient.CreateArgsForCall(1).Id)).To(BeTrue())
+
+	started := fakeEvent("in_progress", "foo", 1)
+	started.WorkflowJob.RunnerName = warm
+	g.Expect(send(h, payloadService, started)).To(Equal(http.StatusOK))
+	g.Expect(w.pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 1, Busy: 1}}))
+}
+
+func TestWarmPool_CompletedBeforeStarting(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.WarmPoolSize = 1
+
+	w := newHandlerTest(t, g, cfg)
+	h, payloadService, flClient, pool := w.testHandler, w.payloadService, w.flClient, w.pool
+
+	flClient.CreateReturns(fakeMicrovm("uid"), nil)
+
+	w.fill()
+	h.workers.Wait()
+
+	g.Expect(send(h, payloadService, fakeEvent("queued", "foo", 1))).To(Equal(http.StatusAccepted))
+
+	// eg. the job was cancelled, so the warm runner it claimed is free again
+	g.Expect(send(h, payloadService, fakeEvent("completed", "foo", 1))).To(Equal(http.StatusAccepted))
+	g.Expect(flClient.DeleteCallCount()).To(Equal(0))
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Size: 1, Idle: 2}}))
+}
+
+func TestReconcile_WarmRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := newTestConfig()
+	cfg.Profiles = []config.Profile{{Name: "large"}}
+
+	ht := newHandlerTest(t, g, cfg)
+	h, flClient, manager, pool := ht.testHandler, ht.flClient, ht.manager, ht.pool
+
+	list := fakeNamedMicrovmList("warm-00000001", "warm-00000002")
+	list.Microvm[1].Spec.Labels = map[string]string{microvm.ProfileLabel: "large"}
+	flClient.ListReturns(list, nil)
+
+	g.Expect(h.Reconcile()).To(Succeed())
+
+	g.Expect(manager.Lookup("warm-00000001")).To(Equal("host"))
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Idle: 1}, {Profile: "large", Idle: 1}}))
+}
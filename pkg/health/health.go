@@ -0,0 +1,196 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/warehouse-13/hammertime/pkg/dialler"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// CheckFunc checks whether the flintlock host at addr can be used.
+type CheckFunc func(ctx context.Context, addr string) error
+
+// GRPCCheck asks the flintlock host for its status with the standard gRPC
+// health check service. Anything other than SERVING is an error.
+func GRPCCheck(ctx context.Context, addr string) error {
+	noAuthYet := ""
+
+	conn, err := dialler.New(addr, noAuthYet)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("host is %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Status is the result of the last check of a host.
+type Status struct {
+	// Address is the address of the host
+	Address string `json:"address"`
+	// Healthy is true if the last check passed
+	Healthy bool `json:"healthy"`
+	// Error is why the last check failed
+	Error string `json:"error,omitempty"`
+	// CheckedAt is when the host was last checked
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Checker regularly checks every host, and reports the service as ready while
+// at least one of them is healthy. It is safe for concurrent use.
+type Checker struct {
+	hosts   func() []string
+	check   CheckFunc
+	timeout time.Duration
+
+	mu       sync.Mutex
+	statuses map[string]Status
+}
+
+// New returns a new Checker. hosts is called before every round of checks, so
+// that hosts which are added or removed while running are picked up. Each
+// check is given up to timeout to respond.
+func New(hosts func() []string, check CheckFunc, timeout time.Duration) *Checker {
+	return &Checker{
+		hosts:    hosts,
+		check:    check,
+		timeout:  timeout,
+		statuses: map[string]Status{},
+	}
+}
+
+// Run checks every host straight away and then every interval until ctx is
+// done.
+func (c *Checker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every host at once and waits for the results.
+func (c *Checker) CheckAll(ctx context.Context) {
+	var (
+		hosts    = c.hosts()
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = make(map[string]Status, len(hosts))
+	)
+
+	for _, addr := range hosts {
+		wg.Add(1)
+
+		go func(addr string) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			s := Status{Address: addr, Healthy: true}
+
+			if err := c.check(checkCtx, addr); err != nil {
+				s.Healthy = false
+				s.Error = err.Error()
+			}
+
+			s.CheckedAt = time.Now()
+
+			mu.Lock()
+			statuses[addr] = s
+			mu.Unlock()
+		}(addr)
+	}
+
+	wg.Wait()
+
+	c.mu.Lock()
+	c.statuses = statuses
+	c.mu.Unlock()
+}
+
+// Statuses returns the result of the last check of every host, sorted by
+// address.
+func (c *Checker) Statuses() []Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]Status, 0, len(c.statuses))
+	for _, s := range c.statuses {
+		statuses = append(statuses, s)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+
+	return statuses
+}
+
+// Ready returns true if at least one host passed its last check.
+func (c *Checker) Ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.statuses {
+		if s.Healthy {
+			return true
+		}
+	}
+
+	return false
+}
+
+type readyResponse struct {
+	Ready bool     `json:"ready"`
+	Hosts []Status `json:"hosts"`
+}
+
+// HandleHealthz will respond to calls to the /healthz endpoint. It only shows
+// that the service is running, so it can be used as a liveness probe.
+func (c *Checker) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// HandleReadyz will respond to calls to the /readyz endpoint with the status
+// of every host. It responds with 503 if no host is healthy, so that the
+// service is not sent webhooks it cannot act on.
+func (c *Checker) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readyResponse{
+		Ready: c.Ready(),
+		Hosts: c.Statuses(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,193 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/health"
+)
+
+type readyz struct {
+	Ready bool            `json:"ready"`
+	Hosts []health.Status `json:"hosts"`
+}
+
+func TestHandleReadyz(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name           string
+		down           map[string]bool
+		expectedStatus int
+		expectedReady  bool
+	}{
+		{
+			name:           "every host is healthy, the service is ready",
+			down:           map[string]bool{},
+			expectedStatus: http.StatusOK,
+			expectedReady:  true,
+		},
+		{
+			name:           "some hosts are healthy, the service is ready",
+			down:           map[string]bool{"host1": true},
+			expectedStatus: http.StatusOK,
+			expectedReady:  true,
+		},
+		{
+			name:           "no hosts are healthy, the service is not ready",
+			down:           map[string]bool{"host1": true, "host2": true},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReady:  false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := health.New(staticHosts("host2", "host1"), func(_ context.Context, addr string) error {
+				if tc.down[addr] {
+					return errors.New("connection refused")
+				}
+
+				return nil
+			}, time.Second)
+
+			checker.CheckAll(context.Background())
+
+			resp := getReadyz(g, checker)
+
+			g.Expect(resp.StatusCode).To(Equal(tc.expectedStatus))
+
+			var body readyz
+			g.Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+			g.Expect(body.Ready).To(Equal(tc.expectedReady))
+			g.Expect(body.Hosts).To(HaveLen(2))
+
+			for i, addr := range []string{"host1", "host2"} {
+				g.Expect(body.Hosts[i].Address).To(Equal(addr))
+				g.Expect(body.Hosts[i].Healthy).To(Equal(!tc.down[addr]))
+				g.Expect(body.Hosts[i].CheckedAt).NotTo(BeZero())
+
+				if tc.down[addr] {
+					g.Expect(body.Hosts[i].Error).To(Equal("connection refused"))
+				}
+			}
+		})
+	}
+}
+
+func TestHandleReadyz_BeforeFirstCheck(t *testing.T) {
+	g := NewWithT(t)
+
+	checker := health.New(staticHosts("host1"), func(context.Context, string) error { return nil }, time.Second)
+
+	g.Expect(getReadyz(g, checker).StatusCode).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestHandleHealthz(t *testing.T) {
+	g := NewWithT(t)
+
+	// liveness does not depend on the hosts
+	checker := health.New(staticHosts("host1"), func(context.Context, string) error { return errors.New("down") }, time.Second)
+	checker.CheckAll(context.Background())
+
+	r := httptest.NewRecorder()
+	checker.HandleHealthz(r, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusOK))
+}
+
+func TestCheckAll_FollowsHosts(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		mu    sync.Mutex
+		hosts = []string{"host1", "host2"}
+	)
+
+	checker := health.New(func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return hosts
+	}, func(context.Context, string) error { return nil }, time.Second)
+
+	checker.CheckAll(context.Background())
+	g.Expect(checker.Statuses()).To(HaveLen(2))
+
+	mu.Lock()
+	hosts = []string{"host3"}
+	mu.Unlock()
+
+	checker.CheckAll(context.Background())
+
+	statuses := checker.Statuses()
+	g.Expect(statuses).To(HaveLen(1))
+	g.Expect(statuses[0].Address).To(Equal("host3"))
+}
+
+func TestCheckAll_Timeout(t *testing.T) {
+	g := NewWithT(t)
+
+	checker := health.New(staticHosts("host1"), func(ctx context.Context, _ string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 10*time.Millisecond)
+
+	checker.CheckAll(context.Background())
+
+	g.Expect(checker.Ready()).To(BeFalse())
+	g.Expect(checker.Statuses()[0].Error).To(Equal(context.DeadlineExceeded.Error()))
+}
+
+func TestGRPCCheck(t *testing.T) {
+	g := NewWithT(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	srv := grpc.NewServer()
+	hs := grpchealth.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, hs)
+
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	t.Cleanup(srv.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	g.Expect(health.GRPCCheck(ctx, ln.Addr().String())).To(Succeed())
+
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	g.Expect(health.GRPCCheck(ctx, ln.Addr().String())).To(MatchError("host is NOT_SERVING"))
+}
+
+func getReadyz(g *WithT, checker *health.Checker) *http.Response {
+	r := httptest.NewRecorder()
+	checker.HandleReadyz(r, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	g.Expect(r.Result().Header.Get("Content-Type")).To(Equal("application/json"))
+
+	return r.Result()
+}
+
+func staticHosts(hosts ...string) func() []string {
+	return func() []string {
+		return hosts
+	}
+}
@@ -4,90 +4,399 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
 )
 
-// Manager is an object which assigns, records and unassigns the hosts to each runner
+// ErrNoCapacity is returned by Assign when none of the hosts have enough room
+// left for the runner.
+var ErrNoCapacity = errors.New("no host has enough capacity for runner")
+
+// ErrNeverFits is returned by Assign when the runner needs more than any of the
+// hosts has, even with nothing else running on them.
+var ErrNeverFits = errors.New("runner is larger than any host")
+
+// Resources is what a single runner MicroVM takes up on a host.
+type Resources struct {
+	// VCPU is the number of vCPUs given to the MicroVM
+	VCPU int `json:"vcpu"`
+	// MemoryMiB is the memory in MiB given to the MicroVM
+	MemoryMiB int `json:"memoryMiB"`
+}
+
+// Assignment is the record of which host a runner was scheduled onto.
+type Assignment struct {
+	// Host is the address of the host
+	Host string `json:"host"`
+	// Resources is what the runner takes up on the host
+	Resources Resources `json:"resources"`
+}
+
+// usage is the running total of everything assigned to a host.
+type usage struct {
+	runners int
+	Resources
+}
+
+// Manager is an object which assigns, records and unassigns the hosts to each
+// runner. It is safe for concurrent use.
 type Manager struct {
-	hosts []string
-	// AssignedMap is a record of each runner and its assigned host
-	AssignedMap map[string]string
-	// HostCount is a counter for each host to keep track of which is most in use
-	HostCount map[string]int
+	store Store
+
+	mu sync.Mutex
+	// hosts is the pool which new runners are assigned from
+	hosts []config.Host
+	// draining is the hosts which have been taken out of the pool but still
+	// have runners on them
+	draining map[string]bool
+	// assigned is a record of each runner and its assigned host
+	assigned map[string]Assignment
+	// used keeps track of how much of each host is in use
+	used map[string]*usage
 }
 
-// New returns a new HostManager
-func New(hosts []string) *Manager {
-	var (
-		hc = map[string]int{}
-		am = map[string]string{}
-	)
+// New returns a new HostManager. Any assignments already saved in the store
+// are loaded so that runners created before a restart can still be found.
+// If store is nil, assignments are only kept in memory.
+func New(hosts []config.Host, store Store) (*Manager, error) {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	m := &Manager{
+		hosts:    hosts,
+		store:    store,
+		draining: map[string]bool{},
+		assigned: map[string]Assignment{},
+		used:     map[string]*usage{},
+	}
 
 	for _, h := range hosts {
-		hc[h] = 0
+		m.used[h.Address] = &usage{}
 	}
 
-	return &Manager{
-		hosts:       hosts,
-		HostCount:   hc,
-		AssignedMap: am,
+	saved, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host assignments: %w", err)
 	}
+
+	for runner, a := range saved {
+		m.saveHost(runner, a)
+	}
+
+	return m, nil
 }
 
-// Assign will very naively find the "least busy" host to schedule an runner onto.
-// The record is stored in memory and thus will not survive restarting the service,
-// so if you start an action, kill the service, then restart it, the tool will
-// not be able to discover where it was scheduled. Cleanup will then
-// have to be manual.
-func (m *Manager) Assign(name string) (string, error) {
-	var host string
-	switch len(m.hosts) {
-	case 0:
+// Assign will find the "least busy" host which still has room for a runner
+// needing the given resources. If no host can fit the runner, ErrNoCapacity is
+// returned rather than overcommitting a host, or ErrNeverFits if no host could
+// fit it even when empty.
+// Picking the host and reserving it for the runner happens atomically, so
+// concurrent calls will never pick using stale counts. Assigning a runner which
+// already has a host returns that host again.
+// The record is written to the Manager's Store, so whether it survives
+// restarting the service depends on the Store the Manager was created with.
+func (m *Manager) Assign(name string, req Resources) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if a, ok := m.assigned[name]; ok {
+		return a.Host, nil
+	}
+
+	if len(m.hosts) == 0 {
 		// technically this will never happen since at least one host is required by
 		// the command, but just in case...
 		return "", errors.New("no host found")
-	case 1:
-		host = m.hosts[0]
-	default:
-		host = m.findAvailableHost()
 	}
 
-	m.saveHost(host, name)
+	host, ok := m.findAvailableHost(req)
+	if !ok {
+		for _, h := range m.hosts {
+			if fits(h, &usage{}, req) {
+				return "", ErrNoCapacity
+			}
+		}
+
+		return "", ErrNeverFits
+	}
+
+	m.saveHost(name, Assignment{Host: host, Resources: req})
+
+	if err := m.store.Save(m.snapshot()); err != nil {
+		m.removeHost(name)
+		return "", fmt.Errorf("failed to save host assignment: %w", err)
+	}
 
 	return host, nil
 }
 
 // Lookup will find the host assigned to the runner.
 func (m *Manager) Lookup(name string) (string, error) {
-	h, ok := m.AssignedMap[name]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.assigned[name]
 	if !ok {
 		return "", fmt.Errorf("host for runner %s not found", name)
 	}
 
-	return h, nil
+	return a.Host, nil
+}
+
+// Unassign will remove the record of the runner from the Manager, freeing up
+// the resources it was using on the host.
+func (m *Manager) Unassign(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.assigned[name]
+	if !ok {
+		return nil
+	}
+
+	m.removeHost(name)
+	m.forgetIfDrained(a.Host)
+
+	if err := m.store.Save(m.snapshot()); err != nil {
+		return fmt.Errorf("failed to save host assignment: %w", err)
+	}
+
+	return nil
+}
+
+// SetHosts replaces the pool of hosts. New hosts can be assigned runners
+// straight away, and changed limits apply from the next Assign. A host which
+// is taken out of the pool while it still has runners is drained: it is not
+// given any new runners, but its existing runners can still be looked up until
+// they are unassigned, at which point the host is forgotten.
+func (m *Manager) SetHosts(hosts []config.Host) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inPool := map[string]bool{}
+
+	for _, h := range hosts {
+		inPool[h.Address] = true
+		delete(m.draining, h.Address)
+
+		if _, ok := m.used[h.Address]; !ok {
+			m.used[h.Address] = &usage{}
+		}
+	}
+
+	for _, h := range m.hosts {
+		if !inPool[h.Address] {
+			m.draining[h.Address] = true
+			m.forgetIfDrained(h.Address)
+		}
+	}
+
+	m.hosts = hosts
+
+	// runners loaded for hosts which were not in the pool before were not
+	// counted, so count everything again now that the pool has changed
+	for _, u := range m.used {
+		*u = usage{}
+	}
+
+	for runner, a := range m.assigned {
+		m.saveHost(runner, a)
+	}
+}
+
+// Hosts returns the addresses of all hosts in the pool, followed by any hosts
+// which are being drained.
+func (m *Manager) Hosts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hosts := make([]string, 0, len(m.hosts)+len(m.draining))
+	for _, h := range m.hosts {
+		hosts = append(hosts, h.Address)
+	}
+
+	return append(hosts, m.drainingHosts()...)
+}
+
+// Draining returns the addresses of the hosts which have been taken out of the
+// pool but still have runners on them.
+func (m *Manager) Draining() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.drainingHosts()
+}
+
+// Count returns the number of runners currently assigned to the host.
+func (m *Manager) Count(host string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.used[host]; ok {
+		return u.runners
+	}
+
+	return 0
 }
 
-// Unassign will remove the record of the runner from the Manager
-func (m *Manager) Unassign(name string) {
-	h, _ := m.Lookup(name)
-	delete(m.AssignedMap, name)
-	m.HostCount[h]--
+// Used returns the total resources of the runners currently assigned to the host.
+func (m *Manager) Used(host string) Resources {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.used[host]; ok {
+		return u.Resources
+	}
+
+	return Resources{}
+}
+
+// Assignments returns a copy of every runner and the host it is assigned to.
+func (m *Manager) Assignments() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	assigned := make(map[string]string, len(m.assigned))
+	for runner, a := range m.assigned {
+		assigned[runner] = a.Host
+	}
+
+	return assigned
 }
 
-func (m *Manager) findAvailableHost() string {
-	keys := make([]string, 0, len(m.HostCount))
+// Restore replaces everything the Manager knows about a host with the given
+// runners. It is used to rebuild the records from what is actually running on
+// the host, so any runner previously assigned to the host which is not in the
+// list is forgotten.
+func (m *Manager) Restore(host string, runners map[string]Resources) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	for key := range m.HostCount {
-		keys = append(keys, key)
+	for runner, a := range m.assigned {
+		if a.Host == host {
+			m.removeHost(runner)
+		}
 	}
 
-	sort.SliceStable(keys, func(i, j int) bool {
-		return m.HostCount[keys[i]] < m.HostCount[keys[j]]
-	})
+	for runner, res := range runners {
+		if _, ok := m.assigned[runner]; ok {
+			m.removeHost(runner)
+		}
 
-	return keys[0]
+		m.saveHost(runner, Assignment{Host: host, Resources: res})
+	}
+
+	m.forgetIfDrained(host)
+
+	if err := m.store.Save(m.snapshot()); err != nil {
+		return fmt.Errorf("failed to save host assignment: %w", err)
+	}
+
+	return nil
+}
+
+// findAvailableHost returns the first host in the pool with the fewest runners
+// which can still fit the requested resources. The caller must hold the lock.
+func (m *Manager) findAvailableHost(req Resources) (string, bool) {
+	var (
+		host  string
+		found bool
+	)
+
+	for _, h := range m.hosts {
+		u := m.used[h.Address]
+		if !fits(h, u, req) {
+			continue
+		}
+
+		if !found || u.runners < m.used[host].runners {
+			host = h.Address
+			found = true
+		}
+	}
+
+	return host, found
 }
 
-func (m *Manager) saveHost(host, runner string) {
-	m.AssignedMap[runner] = host
-	m.HostCount[host]++
+// fits reports whether a runner needing req can be added to a host which is
+// already using u. Limits which are not set on the host are ignored.
+func fits(h config.Host, u *usage, req Resources) bool {
+	if h.MaxMicroVMs > 0 && u.runners+1 > h.MaxMicroVMs {
+		return false
+	}
+
+	if h.VCPU > 0 && u.VCPU+req.VCPU > h.VCPU {
+		return false
+	}
+
+	if h.MemoryMiB > 0 && u.MemoryMiB+req.MemoryMiB > h.MemoryMiB {
+		return false
+	}
+
+	return true
+}
+
+// saveHost records the runner against the host. Hosts which are not in the
+// pool (eg. loaded from an old state file) are not counted, otherwise they
+// could be picked for new runners. The caller must hold the lock.
+func (m *Manager) saveHost(runner string, a Assignment) {
+	m.assigned[runner] = a
+
+	if u, ok := m.used[a.Host]; ok {
+		u.runners++
+		u.VCPU += a.Resources.VCPU
+		u.MemoryMiB += a.Resources.MemoryMiB
+	}
+}
+
+// removeHost deletes the record of the runner. The caller must hold the lock.
+func (m *Manager) removeHost(runner string) {
+	a := m.assigned[runner]
+	delete(m.assigned, runner)
+
+	if u, ok := m.used[a.Host]; ok {
+		u.runners--
+		u.VCPU -= a.Resources.VCPU
+		u.MemoryMiB -= a.Resources.MemoryMiB
+	}
+}
+
+// forgetIfDrained stops keeping track of a draining host once it has no
+// runners left. The caller must hold the lock.
+func (m *Manager) forgetIfDrained(host string) {
+	if !m.draining[host] {
+		return
+	}
+
+	if u, ok := m.used[host]; ok && u.runners > 0 {
+		return
+	}
+
+	delete(m.draining, host)
+	delete(m.used, host)
+}
+
+// drainingHosts returns the draining hosts in a stable order. The caller must
+// hold the lock.
+func (m *Manager) drainingHosts() []string {
+	hosts := make([]string, 0, len(m.draining))
+	for h := range m.draining {
+		hosts = append(hosts, h)
+	}
+
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+// snapshot returns a copy of the assignments. The caller must hold the lock.
+func (m *Manager) snapshot() map[string]Assignment {
+	assigned := make(map[string]Assignment, len(m.assigned))
+	for runner, a := range m.assigned {
+		assigned[runner] = a
+	}
+
+	return assigned
 }
@@ -1,10 +1,13 @@
 package host_test
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	. "github.com/onsi/gomega"
 
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
 )
 
@@ -50,19 +53,20 @@ func Test_HostAssign(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			manager := host.New(tc.hosts)
+			manager, err := host.New(newHosts(tc.hosts...), nil)
+			g.Expect(err).NotTo(HaveOccurred())
 
 			for _, r := range tc.runners {
-				assigned, err := manager.Assign(r)
+				assigned, err := manager.Assign(r, host.Resources{})
 				if tc.expectedErr {
 					g.Expect(err).To(HaveOccurred())
 					return
 				}
 
-				found, ok := manager.AssignedMap[r]
-				g.Expect(ok).To(BeTrue())
+				found, err := manager.Lookup(r)
+				g.Expect(err).NotTo(HaveOccurred())
 				g.Expect(found).To(Equal(assigned))
-				g.Expect(manager.HostCount[found]).To(Equal(1))
+				g.Expect(manager.Count(found)).To(Equal(1))
 			}
 		})
 	}
@@ -76,8 +80,10 @@ func Test_HostLookup(t *testing.T) {
 		runnerOne = "runner1"
 	)
 
-	manager := host.New([]string{host1})
-	assigned, err := manager.Assign(runnerOne)
+	manager, err := host.New(newHosts(host1), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	assigned, err := manager.Assign(runnerOne, host.Resources{})
 	g.Expect(err).NotTo(HaveOccurred())
 
 	found, err := manager.Lookup(runnerOne)
@@ -93,8 +99,10 @@ func Test_HostLookupFails(t *testing.T) {
 		runnerOne = "runner1"
 	)
 
-	manager := host.New([]string{host1})
-	_, err := manager.Lookup(runnerOne)
+	manager, err := host.New(newHosts(host1), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = manager.Lookup(runnerOne)
 	g.Expect(err).To(HaveOccurred())
 }
 
@@ -106,12 +114,293 @@ func Test_HostUnassign(t *testing.T) {
 		runnerName = "runner1"
 	)
 
-	manager := host.New([]string{host1})
-	assigned, err := manager.Assign(runnerName)
+	manager, err := host.New(newHosts(host1), nil)
 	g.Expect(err).NotTo(HaveOccurred())
 
-	manager.Unassign(runnerName)
-	_, ok := manager.AssignedMap[runnerName]
-	g.Expect(ok).To(BeFalse())
-	g.Expect(manager.HostCount[assigned]).To(Equal(0))
+	assigned, err := manager.Assign(runnerName, host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(manager.Unassign(runnerName)).To(Succeed())
+	_, err = manager.Lookup(runnerName)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(manager.Count(assigned)).To(Equal(0))
+}
+
+func Test_HostRestore(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		host1 = "host1"
+		host2 = "host2"
+	)
+
+	manager, err := host.New(newHosts(host1, host2), fakeStore{
+		Store: host.NewMemoryStore(),
+		assigned: map[string]host.Assignment{
+			"gone":  {Host: host1},
+			"other": {Host: host2},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(manager.Restore(host1, map[string]host.Resources{
+		"runner1": {VCPU: 2, MemoryMiB: 1024},
+		"runner2": {VCPU: 2, MemoryMiB: 1024},
+	})).To(Succeed())
+
+	g.Expect(manager.Assignments()).To(Equal(map[string]string{
+		"runner1": host1,
+		"runner2": host1,
+		"other":   host2,
+	}))
+	g.Expect(manager.Count(host1)).To(Equal(2))
+	g.Expect(manager.Count(host2)).To(Equal(1))
+	g.Expect(manager.Used(host1)).To(Equal(host.Resources{VCPU: 4, MemoryMiB: 2048}))
+}
+
+func Test_HostSetHosts(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		host1 = "host1"
+		host2 = "host2"
+		host3 = "host3"
+	)
+
+	manager, err := host.New(newHosts(host1, host2), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	assigned, err := manager.Assign("runner1", host.Resources{VCPU: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(assigned).To(Equal(host1))
+
+	// host1 still has a runner so it is drained, host2 is empty so it goes
+	manager.SetHosts(newHosts(host3))
+
+	g.Expect(manager.Hosts()).To(Equal([]string{host3, host1}))
+	g.Expect(manager.Draining()).To(Equal([]string{host1}))
+
+	g.Expect(manager.Lookup("runner1")).To(Equal(host1))
+	g.Expect(manager.Count(host1)).To(Equal(1))
+
+	assigned, err = manager.Assign("runner2", host.Resources{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(assigned).To(Equal(host3))
+
+	// reconciling a draining host keeps it draining
+	g.Expect(manager.Restore(host1, map[string]host.Resources{"runner1": {VCPU: 2}})).To(Succeed())
+	g.Expect(manager.Draining()).To(Equal([]string{host1}))
+	g.Expect(manager.Count(host1)).To(Equal(1))
+
+	// the drained host is forgotten once its last runner has gone
+	g.Expect(manager.Unassign("runner1")).To(Succeed())
+
+	g.Expect(manager.Hosts()).To(Equal([]string{host3}))
+	g.Expect(manager.Draining()).To(BeEmpty())
+	g.Expect(manager.Count(host1)).To(Equal(0))
+}
+
+func Test_HostSetHosts_ReAdd(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		host1 = "host1"
+		host2 = "host2"
+	)
+
+	manager, err := host.New(newHosts(host1, host2), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = manager.Assign("runner1", host.Resources{VCPU: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	manager.SetHosts(newHosts(host2))
+	g.Expect(manager.Draining()).To(Equal([]string{host1}))
+
+	// a draining host which is put back keeps its runners and new limits are
+	// applied to them
+	manager.SetHosts([]config.Host{{Address: host1, VCPU: 2}, {Address: host2, VCPU: 2}})
+
+	g.Expect(manager.Draining()).To(BeEmpty())
+	g.Expect(manager.Hosts()).To(Equal([]string{host1, host2}))
+	g.Expect(manager.Used(host1)).To(Equal(host.Resources{VCPU: 2}))
+
+	assigned, err := manager.Assign("runner2", host.Resources{VCPU: 2})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(assigned).To(Equal(host2))
+
+	_, err = manager.Assign("runner3", host.Resources{VCPU: 2})
+	g.Expect(err).To(MatchError(host.ErrNoCapacity))
+}
+
+func Test_HostSetHosts_CountsSavedRunners(t *testing.T) {
+	g := NewWithT(t)
+
+	// runners saved against a host which was not in the pool are not counted
+	// until the host is added
+	manager, err := host.New(newHosts("host1"), fakeStore{
+		Store: host.NewMemoryStore(),
+		assigned: map[string]host.Assignment{
+			"runner1": {Host: "host2", Resources: host.Resources{VCPU: 2}},
+		},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(manager.Count("host2")).To(Equal(0))
+
+	manager.SetHosts(newHosts("host1", "host2"))
+
+	g.Expect(manager.Count("host2")).To(Equal(1))
+	g.Expect(manager.Used("host2")).To(Equal(host.Resources{VCPU: 2}))
+}
+
+func Test_HostAssignConcurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		hosts   = []string{"host1", "host2", "host3", "host4"}
+		runners = 400
+		wg      sync.WaitGroup
+	)
+
+	manager, err := host.New(newHosts(hosts...), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	for i := 0; i < runners; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("runner%d", i)
+
+			_, err := manager.Assign(name, host.Resources{})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			_, err = manager.Lookup(name)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			// assigning the same runner twice should not take up another slot
+			_, err = manager.Assign(name, host.Resources{})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			if i%2 == 0 {
+				g.Expect(manager.Unassign(name)).To(Succeed())
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	g.Expect(manager.Assignments()).To(HaveLen(runners / 2))
+
+	total := 0
+	for _, h := range hosts {
+		total += manager.Count(h)
+	}
+
+	g.Expect(total).To(Equal(runners / 2))
+}
+
+func Test_HostAssignWithCapacity(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		small = host.Resources{VCPU: 2, MemoryMiB: 2048}
+		large = host.Resources{VCPU: 8, MemoryMiB: 16384}
+	)
+
+	tt := []struct {
+		name         string
+		hosts        []config.Host
+		existing     map[string]host.Resources
+		request      host.Resources
+		expectedHost string
+		expectedErr  error
+	}{
+		{
+			name:         "when no limits are set, the host is never full",
+			hosts:        []config.Host{{Address: "host1"}},
+			existing:     map[string]host.Resources{"a": large, "b": large},
+			request:      large,
+			expectedHost: "host1",
+		},
+		{
+			name:        "when the host has no vcpu left, returns ErrNoCapacity",
+			hosts:       []config.Host{{Address: "host1", VCPU: 10}},
+			existing:    map[string]host.Resources{"a": large},
+			request:     host.Resources{VCPU: 3},
+			expectedErr: host.ErrNoCapacity,
+		},
+		{
+			name:        "when the host has no memory left, returns ErrNoCapacity",
+			hosts:       []config.Host{{Address: "host1", MemoryMiB: 4096}},
+			existing:    map[string]host.Resources{"a": small},
+			request:     host.Resources{MemoryMiB: 4096},
+			expectedErr: host.ErrNoCapacity,
+		},
+		{
+			name: "when no host could fit the runner even if it was empty, returns ErrNeverFits",
+			hosts: []config.Host{
+				{Address: "host1", VCPU: 4},
+				{Address: "host2", MemoryMiB: 8192},
+			},
+			request:     large,
+			expectedErr: host.ErrNeverFits,
+		},
+		{
+			name:        "when the host is running its max number of microvms, returns ErrNoCapacity",
+			hosts:       []config.Host{{Address: "host1", MaxMicroVMs: 1}},
+			existing:    map[string]host.Resources{"a": small},
+			request:     small,
+			expectedErr: host.ErrNoCapacity,
+		},
+		{
+			name:         "when the request exactly fills the host, returns that host",
+			hosts:        []config.Host{{Address: "host1", VCPU: 4, MemoryMiB: 4096, MaxMicroVMs: 2}},
+			existing:     map[string]host.Resources{"a": small},
+			request:      small,
+			expectedHost: "host1",
+		},
+		{
+			name: "when the least busy host cannot fit the runner, returns a host which can",
+			hosts: []config.Host{
+				{Address: "host1", VCPU: 16},
+				{Address: "host2", VCPU: 4},
+			},
+			existing:     map[string]host.Resources{"a": small, "b": small},
+			request:      large,
+			expectedHost: "host1",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			manager, err := host.New(tc.hosts, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			g.Expect(manager.Restore(tc.hosts[0].Address, tc.existing)).To(Succeed())
+
+			assigned, err := manager.Assign("runner", tc.request)
+			if tc.expectedErr != nil {
+				g.Expect(err).To(MatchError(tc.expectedErr))
+
+				_, err = manager.Lookup("runner")
+				g.Expect(err).To(HaveOccurred())
+
+				return
+			}
+
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(assigned).To(Equal(tc.expectedHost))
+		})
+	}
+}
+
+func newHosts(addrs ...string) []config.Host {
+	hosts := make([]config.Host, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = config.Host{Address: addr}
+	}
+
+	return hosts
 }
@@ -0,0 +1,71 @@
+package host
+
+import "github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/filestore"
+
+// Store persists the runner to host assignments recorded by a Manager so that
+// they survive a restart of the service.
+type Store interface {
+	// Load returns all previously saved assignments, keyed by runner name.
+	Load() (map[string]Assignment, error)
+	// Save replaces everything in the store with the given assignments.
+	Save(map[string]Assignment) error
+}
+
+// NewMemoryStore returns a Store which keeps nothing. Assignments will only
+// live as long as the Manager which holds them.
+func NewMemoryStore() Store {
+	return memoryStore{}
+}
+
+type memoryStore struct{}
+
+func (memoryStore) Load() (map[string]Assignment, error) {
+	return map[string]Assignment{}, nil
+}
+
+func (memoryStore) Save(map[string]Assignment) error {
+	return nil
+}
+
+// FileStore is a Store which writes assignments as JSON to a file on disk.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a new FileStore which reads and writes the given path.
+// The file does not need to exist yet.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads the assignments from disk. A missing file is not an error, it
+// just means nothing has been saved yet. A file saved before resources were
+// recorded, which maps runner names straight to hosts, is loaded with no
+// resources for each runner, which are filled in again when the hosts are
+// reconciled.
+func (s *FileStore) Load() (map[string]Assignment, error) {
+	assigned := map[string]Assignment{}
+
+	err := filestore.ReadJSON(s.path, &assigned)
+	if err == nil {
+		return assigned, nil
+	}
+
+	hosts := map[string]string{}
+	if filestore.ReadJSON(s.path, &hosts) != nil {
+		return nil, err
+	}
+
+	assigned = make(map[string]Assignment, len(hosts))
+
+	for runner, host := range hosts {
+		assigned[runner] = Assignment{Host: host}
+	}
+
+	return assigned, nil
+}
+
+// Save writes the assignments to disk, replacing whatever was there before.
+func (s *FileStore) Save(assigned map[string]Assignment) error {
+	return filestore.WriteJSON(s.path, assigned)
+}
@@ -0,0 +1,136 @@
+package host_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+)
+
+func Test_FileStoreLoad_MissingFile(t *testing.T) {
+	g := NewWithT(t)
+
+	store := host.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	assigned, err := store.Load()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(assigned).To(BeEmpty())
+}
+
+func Test_FileStoreLoad_CorruptFile(t *testing.T) {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	g.Expect(os.WriteFile(path, []byte("{not json"), 0o600)).To(Succeed())
+
+	_, err := host.NewFileStore(path).Load()
+	g.Expect(err).To(HaveOccurred())
+}
+
+func Test_FileStoreLoad_OldFormat(t *testing.T) {
+	g := NewWithT(t)
+
+	// the file as it was saved before runners' resources were recorded
+	path := filepath.Join(t.TempDir(), "state.json")
+	g.Expect(os.WriteFile(path, []byte(`{"runner1":"host1","runner2":"host2"}`), 0o600)).To(Succeed())
+
+	loaded, err := host.NewFileStore(path).Load()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(loaded).To(Equal(map[string]host.Assignment{
+		"runner1": {Host: "host1"},
+		"runner2": {Host: "host2"},
+	}))
+
+	manager, err := host.New([]config.Host{{Address: "host1"}, {Address: "host2"}}, host.NewFileStore(path))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	found, err := manager.Lookup("runner1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal("host1"))
+}
+
+func Test_FileStoreSaveAndLoad(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		dir      = t.TempDir()
+		path     = filepath.Join(dir, "state.json")
+		assigned = map[string]host.Assignment{
+			"runner1": {Host: "host1", Resources: host.Resources{VCPU: 2, MemoryMiB: 2048}},
+			"runner2": {Host: "host2"},
+		}
+	)
+
+	g.Expect(host.NewFileStore(path).Save(assigned)).To(Succeed())
+
+	loaded, err := host.NewFileStore(path).Load()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(loaded).To(Equal(assigned))
+
+	entries, err := os.ReadDir(dir)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(entries).To(HaveLen(1), "temporary files should be cleaned up")
+}
+
+func Test_ManagerSurvivesRestart(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		host1      = "host1"
+		host2      = "host2"
+		runnerName = "runner1"
+		path       = filepath.Join(t.TempDir(), "state.json")
+	)
+
+	manager, err := host.New(newHosts(host1, host2), host.NewFileStore(path))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	assigned, err := manager.Assign(runnerName, host.Resources{VCPU: 2, MemoryMiB: 2048})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	restarted, err := host.New(newHosts(host1, host2), host.NewFileStore(path))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	found, err := restarted.Lookup(runnerName)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal(assigned))
+	g.Expect(restarted.Count(assigned)).To(Equal(1))
+	g.Expect(restarted.Used(assigned)).To(Equal(host.Resources{VCPU: 2, MemoryMiB: 2048}))
+
+	g.Expect(restarted.Unassign(runnerName)).To(Succeed())
+
+	restarted, err = host.New(newHosts(host1, host2), host.NewFileStore(path))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = restarted.Lookup(runnerName)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func Test_ManagerIgnoresRemovedHostsWhenCounting(t *testing.T) {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	g.Expect(host.NewFileStore(path).Save(map[string]host.Assignment{"runner1": {Host: "gone"}})).To(Succeed())
+
+	manager, err := host.New(newHosts("host1"), host.NewFileStore(path))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	found, err := manager.Lookup("runner1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(found).To(Equal("gone"))
+	g.Expect(manager.Count("gone")).To(Equal(0))
+}
+
+// fakeStore is a Store which loads a fixed set of assignments.
+type fakeStore struct {
+	host.Store
+	assigned map[string]host.Assignment
+}
+
+func (s fakeStore) Load() (map[string]host.Assignment, error) {
+	return s.assigned, nil
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+var (
+	hostRunnersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "host", "runners"),
+		"Runners currently assigned to each host.",
+		[]string{"host"}, nil,
+	)
+	hostVCPUDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "host", "vcpu_used"),
+		"vCPUs given to the runners on each host.",
+		[]string{"host"}, nil,
+	)
+	hostMemoryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "host", "memory_used_mib"),
+		"Memory in MiB given to the runners on each host.",
+		[]string{"host"}, nil,
+	)
+	hostDrainingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "host", "draining"),
+		"1 if the host has been removed from the pool and is waiting for its runners to finish.",
+		[]string{"host"}, nil,
+	)
+	pendingJobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pending_jobs"),
+		"Jobs waiting in the pending queue for a runner.",
+		nil, nil,
+	)
+	pendingOldestDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pending_jobs_oldest_age_seconds"),
+		"How long the job at the front of the pending queue has been waiting, 0 when the queue is empty.",
+		nil, nil,
+	)
+	warmPoolSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "warm_pool", "size"),
+		"How many idle warm runners each profile is meant to have.",
+		[]string{"profile"}, nil,
+	)
+	warmPoolRunnersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "warm_pool", "runners"),
+		"Warm runners for each profile, by whether they are being created, idle or have been given a job.",
+		[]string{"profile", "state"}, nil,
+	)
+)
+
+type hostCollector struct {
+	manager *host.Manager
+}
+
+// NewHostCollector returns a collector which reports how much of each host is
+// in use, read from the Manager whenever it is scraped.
+func NewHostCollector(manager *host.Manager) prometheus.Collector {
+	return hostCollector{manager: manager}
+}
+
+func (c hostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hostRunnersDesc
+	ch <- hostVCPUDesc
+	ch <- hostMemoryDesc
+	ch <- hostDrainingDesc
+}
+
+func (c hostCollector) Collect(ch chan<- prometheus.Metric) {
+	draining := map[string]bool{}
+	for _, h := range c.manager.Draining() {
+		draining[h] = true
+	}
+
+	for _, h := range c.manager.Hosts() {
+		used := c.manager.Used(h)
+
+		ch <- prometheus.MustNewConstMetric(hostRunnersDesc, prometheus.GaugeValue, float64(c.manager.Count(h)), h)
+		ch <- prometheus.MustNewConstMetric(hostVCPUDesc, prometheus.GaugeValue, float64(used.VCPU), h)
+		ch <- prometheus.MustNewConstMetric(hostMemoryDesc, prometheus.GaugeValue, float64(used.MemoryMiB), h)
+		ch <- prometheus.MustNewConstMetric(hostDrainingDesc, prometheus.GaugeValue, boolValue(draining[h]), h)
+	}
+}
+
+type queueCollector struct {
+	queue *queue.Queue
+}
+
+// NewQueueCollector returns a collector which reports the depth of the pending
+// queue, read whenever it is scraped.
+func NewQueueCollector(q *queue.Queue) prometheus.Collector {
+	return queueCollector{queue: q}
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingJobsDesc
+	ch <- pendingOldestDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	jobs := c.queue.Jobs()
+
+	var oldest time.Duration
+
+	for _, job := range jobs {
+		if age := time.Since(job.QueuedAt); age > oldest {
+			oldest = age
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(pendingJobsDesc, prometheus.GaugeValue, float64(len(jobs)))
+	ch <- prometheus.MustNewConstMetric(pendingOldestDesc, prometheus.GaugeValue, oldest.Seconds())
+}
+
+type warmPoolCollector struct {
+	pool *warmpool.Pool
+}
+
+// NewWarmPoolCollector returns a collector which reports the size of each
+// profile's warm pool, read whenever it is scraped.
+func NewWarmPoolCollector(pool *warmpool.Pool) prometheus.Collector {
+	return warmPoolCollector{pool: pool}
+}
+
+func (c warmPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- warmPoolSizeDesc
+	ch <- warmPoolRunnersDesc
+}
+
+func (c warmPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.pool.Stats() {
+		profile := profileLabel(s.Profile)
+
+		ch <- prometheus.MustNewConstMetric(warmPoolSizeDesc, prometheus.GaugeValue, float64(s.Size), profile)
+		ch <- prometheus.MustNewConstMetric(warmPoolRunnersDesc, prometheus.GaugeValue, float64(s.Creating), profile, "creating")
+		ch <- prometheus.MustNewConstMetric(warmPoolRunnersDesc, prometheus.GaugeValue, float64(s.Idle), profile, "idle")
+		ch <- prometheus.MustNewConstMetric(warmPoolRunnersDesc, prometheus.GaugeValue, float64(s.Busy), profile, "busy")
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
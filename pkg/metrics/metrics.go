@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "microvm_action_runner"
+
+// Webhook outcomes
+const (
+	OutcomeAccepted  = "accepted"
+	OutcomeIgnored   = "ignored"
+	OutcomeDuplicate = "duplicate"
+	OutcomeRejected  = "rejected"
+	OutcomeError     = "error"
+)
+
+// Flintlock and event processing outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Warm pool request results
+const (
+	ResultHit  = "hit"
+	ResultMiss = "miss"
+)
+
+// defaultProfile is the profile label given to runners with the default
+// MicroVM.
+const defaultProfile = "default"
+
+// Flintlock operations
+const (
+	OpCreate = "create"
+	OpDelete = "delete"
+	OpList   = "list"
+)
+
+// Metrics holds everything the service reports to prometheus. Each Metrics has
+// its own registry so that tests do not share counts.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	webhooks          *prometheus.CounterVec
+	eventAttempts     *prometheus.CounterVec
+	flintlockDuration *prometheus.HistogramVec
+	pendingAdded      prometheus.Counter
+	pendingExpired    prometheus.Counter
+	reaped            *prometheus.CounterVec
+	warmPoolRequests  *prometheus.CounterVec
+}
+
+// New returns a new Metrics with the Go runtime and process metrics already
+// registered.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhooks_total",
+			Help:      "Webhooks received, by workflow job action and what was done with them.",
+		}, []string{"action", "outcome"}),
+		eventAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "event_attempts_total",
+			Help:      "Attempts at processing accepted webhook events, including retries, by action and outcome.",
+		}, []string{"action", "outcome"}),
+		flintlockDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "flintlock_request_duration_seconds",
+			Help:      "How long requests to flintlock hosts took, by operation and outcome.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"operation", "outcome"}),
+		pendingAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pending_jobs_added_total",
+			Help:      "Jobs which were added to the pending queue because a runner could not be created straight away.",
+		}),
+		pendingExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pending_jobs_expired_total",
+			Help:      "Jobs which were dropped from the pending queue after waiting too long.",
+		}),
+		reaped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reaped_microvms_total",
+			Help:      "MicroVMs deleted by the reaper, by why they were deleted.",
+		}, []string{"reason"}),
+		warmPoolRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "warm_pool_requests_total",
+			Help:      "Queued jobs for profiles with a warm pool, by profile and whether a warm runner was free for them.",
+		}, []string{"profile", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.webhooks,
+		m.eventAttempts,
+		m.flintlockDuration,
+		m.pendingAdded,
+		m.pendingExpired,
+		m.reaped,
+		m.warmPoolRequests,
+	)
+
+	return m
+}
+
+// Register adds more collectors, eg. ones which read the current state of
+// the hosts or queue whenever they are scraped.
+func (m *Metrics) Register(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// Handler serves the metrics for prometheus to scrape.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Gatherer returns the registry the metrics are in.
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.registry
+}
+
+// Webhook counts a webhook with the given action and outcome.
+func (m *Metrics) Webhook(action, outcome string) {
+	if action == "" {
+		action = "unknown"
+	}
+
+	m.webhooks.WithLabelValues(action, outcome).Inc()
+}
+
+// EventAttempt counts one attempt at processing a webhook event.
+func (m *Metrics) EventAttempt(action string, err error) {
+	m.eventAttempts.WithLabelValues(action, outcome(err)).Inc()
+}
+
+// ObserveFlintlock runs fn, which makes a request to a flintlock host, and
+// records how long it took.
+func (m *Metrics) ObserveFlintlock(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+
+	m.flintlockDuration.WithLabelValues(operation, outcome(err)).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// PendingAdded counts a job being added to the pending queue.
+func (m *Metrics) PendingAdded() {
+	m.pendingAdded.Inc()
+}
+
+// PendingExpired counts jobs being dropped from the pending queue.
+func (m *Metrics) PendingExpired(n int) {
+	m.pendingExpired.Add(float64(n))
+}
+
+// Reaped counts a MicroVM being deleted by the reaper.
+func (m *Metrics) Reaped(reason string) {
+	m.reaped.WithLabelValues(reason).Inc()
+}
+
+// WarmPoolRequest counts a queued job for a profile with a warm pool, and
+// whether it was given a warm runner. The default MicroVM is the empty profile.
+func (m *Metrics) WarmPoolRequest(profile string, hit bool) {
+	result := ResultMiss
+	if hit {
+		result = ResultHit
+	}
+
+	m.warmPoolRequests.WithLabelValues(profileLabel(profile), result).Inc()
+}
+
+func profileLabel(profile string) string {
+	if profile == "" {
+		return defaultProfile
+	}
+
+	return profile
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+
+	return OutcomeSuccess
+}
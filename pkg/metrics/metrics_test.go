@@ -0,0 +1,211 @@
+package metrics_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/host"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/metrics"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+func TestWebhook(t *testing.T) {
+	g := NewWithT(t)
+
+	m := metrics.New()
+	m.Webhook("queued", metrics.OutcomeAccepted)
+	m.Webhook("queued", metrics.OutcomeAccepted)
+	m.Webhook("completed", metrics.OutcomeDuplicate)
+	m.Webhook("", metrics.OutcomeError)
+
+	expected := `
+# HELP microvm_action_runner_webhooks_total Webhooks received, by workflow job action and what was done with them.
+# TYPE microvm_action_runner_webhooks_total counter
+microvm_action_runner_webhooks_total{action="completed",outcome="duplicate"} 1
+microvm_action_runner_webhooks_total{action="queued",outcome="accepted"} 2
+microvm_action_runner_webhooks_total{action="unknown",outcome="error"} 1
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected), "microvm_action_runner_webhooks_total")).To(Succeed())
+}
+
+func TestObserveFlintlock(t *testing.T) {
+	g := NewWithT(t)
+
+	m := metrics.New()
+
+	g.Expect(m.ObserveFlintlock(metrics.OpCreate, func() error { return nil })).To(Succeed())
+	g.Expect(m.ObserveFlintlock(metrics.OpCreate, func() error { return errors.New("boom") })).To(MatchError("boom"))
+	g.Expect(m.ObserveFlintlock(metrics.OpDelete, func() error { return nil })).To(Succeed())
+
+	g.Expect(testutil.GatherAndCount(m.Gatherer(), "microvm_action_runner_flintlock_request_duration_seconds")).To(Equal(3))
+}
+
+func TestHostCollector(t *testing.T) {
+	g := NewWithT(t)
+
+	manager, err := host.New([]config.Host{{Address: "host1"}, {Address: "host2"}}, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = manager.Assign("runner1", host.Resources{VCPU: 2, MemoryMiB: 1024})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// host1 has a runner so it is drained rather than removed
+	manager.SetHosts([]config.Host{{Address: "host2"}})
+
+	m := metrics.New()
+	m.Register(metrics.NewHostCollector(manager))
+
+	expected := `
+# HELP microvm_action_runner_host_runners Runners currently assigned to each host.
+# TYPE microvm_action_runner_host_runners gauge
+microvm_action_runner_host_runners{host="host1"} 1
+microvm_action_runner_host_runners{host="host2"} 0
+# HELP microvm_action_runner_host_vcpu_used vCPUs given to the runners on each host.
+# TYPE microvm_action_runner_host_vcpu_used gauge
+microvm_action_runner_host_vcpu_used{host="host1"} 2
+microvm_action_runner_host_vcpu_used{host="host2"} 0
+# HELP microvm_action_runner_host_memory_used_mib Memory in MiB given to the runners on each host.
+# TYPE microvm_action_runner_host_memory_used_mib gauge
+microvm_action_runner_host_memory_used_mib{host="host1"} 1024
+microvm_action_runner_host_memory_used_mib{host="host2"} 0
+# HELP microvm_action_runner_host_draining 1 if the host has been removed from the pool and is waiting for its runners to finish.
+# TYPE microvm_action_runner_host_draining gauge
+microvm_action_runner_host_draining{host="host1"} 1
+microvm_action_runner_host_draining{host="host2"} 0
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected),
+		"microvm_action_runner_host_runners",
+		"microvm_action_runner_host_vcpu_used",
+		"microvm_action_runner_host_memory_used_mib",
+		"microvm_action_runner_host_draining",
+	)).To(Succeed())
+
+	// the gauges follow the manager
+	g.Expect(manager.Unassign("runner1")).To(Succeed())
+
+	g.Expect(testutil.GatherAndCount(m.Gatherer(), "microvm_action_runner_host_runners")).To(Equal(1))
+}
+
+func TestQueueCollector(t *testing.T) {
+	g := NewWithT(t)
+
+	q, err := queue.New("", 0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	m := metrics.New()
+	m.Register(metrics.NewQueueCollector(q))
+
+	g.Expect(q.Push("runner1", github.WorkflowJobPayload{})).To(Succeed())
+	g.Expect(q.Push("runner2", github.WorkflowJobPayload{})).To(Succeed())
+	m.PendingAdded()
+	m.PendingAdded()
+	m.PendingExpired(1)
+
+	expected := `
+# HELP microvm_action_runner_pending_jobs Jobs waiting in the pending queue for a runner.
+# TYPE microvm_action_runner_pending_jobs gauge
+microvm_action_runner_pending_jobs 2
+# HELP microvm_action_runner_pending_jobs_added_total Jobs which were added to the pending queue because a runner could not be created straight away.
+# TYPE microvm_action_runner_pending_jobs_added_total counter
+microvm_action_runner_pending_jobs_added_total 2
+# HELP microvm_action_runner_pending_jobs_expired_total Jobs which were dropped from the pending queue after waiting too long.
+# TYPE microvm_action_runner_pending_jobs_expired_total counter
+microvm_action_runner_pending_jobs_expired_total 1
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected),
+		"microvm_action_runner_pending_jobs",
+		"microvm_action_runner_pending_jobs_added_total",
+		"microvm_action_runner_pending_jobs_expired_total",
+	)).To(Succeed())
+
+	time.Sleep(10 * time.Millisecond)
+
+	families, err := m.Gatherer().Gather()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	for _, f := range families {
+		if f.GetName() == "microvm_action_runner_pending_jobs_oldest_age_seconds" {
+			g.Expect(f.GetMetric()[0].GetGauge().GetValue()).To(BeNumerically(">", 0))
+		}
+	}
+}
+
+func TestWarmPoolCollector(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.SetSizes(map[string]int{"": 2, "large": 1})
+
+	reserved := pool.Reserve()
+	g.Expect(reserved).To(HaveLen(3))
+
+	for _, r := range reserved {
+		if r.Profile == "" {
+			pool.Created(r.Name)
+		}
+	}
+
+	pool.Add("warm-busy", "large")
+	pool.Started("job1", "warm-busy")
+
+	m := metrics.New()
+	m.Register(metrics.NewWarmPoolCollector(pool))
+	m.WarmPoolRequest("", true)
+	m.WarmPoolRequest("large", false)
+
+	expected := `
+# HELP microvm_action_runner_warm_pool_requests_total Queued jobs for profiles with a warm pool, by profile and whether a warm runner was free for them.
+# TYPE microvm_action_runner_warm_pool_requests_total counter
+microvm_action_runner_warm_pool_requests_total{profile="default",result="hit"} 1
+microvm_action_runner_warm_pool_requests_total{profile="large",result="miss"} 1
+# HELP microvm_action_runner_warm_pool_runners Warm runners for each profile, by whether they are being created, idle or have been given a job.
+# TYPE microvm_action_runner_warm_pool_runners gauge
+microvm_action_runner_warm_pool_runners{profile="default",state="busy"} 0
+microvm_action_runner_warm_pool_runners{profile="default",state="creating"} 0
+microvm_action_runner_warm_pool_runners{profile="default",state="idle"} 2
+microvm_action_runner_warm_pool_runners{profile="large",state="busy"} 1
+microvm_action_runner_warm_pool_runners{profile="large",state="creating"} 1
+microvm_action_runner_warm_pool_runners{profile="large",state="idle"} 0
+# HELP microvm_action_runner_warm_pool_size How many idle warm runners each profile is meant to have.
+# TYPE microvm_action_runner_warm_pool_size gauge
+microvm_action_runner_warm_pool_size{profile="default"} 2
+microvm_action_runner_warm_pool_size{profile="large"} 1
+`
+
+	g.Expect(testutil.GatherAndCompare(m.Gatherer(), strings.NewReader(expected),
+		"microvm_action_runner_warm_pool_requests_total",
+		"microvm_action_runner_warm_pool_runners",
+		"microvm_action_runner_warm_pool_size",
+	)).To(Succeed())
+}
+
+func TestHandler(t *testing.T) {
+	g := NewWithT(t)
+
+	m := metrics.New()
+	m.Webhook("queued", metrics.OutcomeAccepted)
+
+	r := httptest.NewRecorder()
+	m.Handler().ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	g.Expect(r.Result().StatusCode).To(Equal(http.StatusOK))
+
+	body, err := io.ReadAll(r.Result().Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(ContainSubstring(`microvm_action_runner_webhooks_total{action="queued",outcome="accepted"} 1`))
+	g.Expect(string(body)).To(ContainSubstring("go_goroutines"))
+}
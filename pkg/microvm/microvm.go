@@ -1,46 +1,274 @@
 package microvm
 
 import (
-	"embed"
+	"bytes"
+	_ "embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/warehouse-13/hammertime/pkg/defaults"
+	"github.com/warehouse-13/hammertime/pkg/utils"
 	"github.com/weaveworks-liquidmetal/flintlock/api/types"
 	"github.com/weaveworks-liquidmetal/flintlock/client/cloudinit/instance"
 	"github.com/weaveworks-liquidmetal/flintlock/client/cloudinit/userdata"
 	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
 )
 
 const (
-	Namespace      = "self-hosted"
-	userdataScript = "userdata.sh"
+	Namespace = "self-hosted"
+	// DefaultLabel is the label runners are registered with if none are given
+	DefaultLabel = "self-hosted"
+	// ProfileLabel is the MicroVM label which records the profile the MicroVM
+	// was created with
+	ProfileLabel = "microvm-action-runner/profile"
+	// RepoLabel is the MicroVM label which records the repo, as owner/name, the
+	// MicroVM's runner was registered for
+	RepoLabel = "microvm-action-runner/repo"
+	// RunnerIDLabel is the MicroVM label which records the ID github gave the
+	// MicroVM's runner when it was registered
+	RunnerIDLabel = "microvm-action-runner/runner-id"
+	// RunnerLabel is the label every runner is registered with, so that the
+	// service can tell its runners apart from others in the same org or
+	// enterprise
+	RunnerLabel = "microvm-action-runner"
 )
 
-func New(ghToken, publicKey, user, repo, id string) (*types.MicroVMSpec, error) {
+// New returns the spec for a MicroVM for the runner named id. The MicroVM is
+// shaped by the profile, a zero Profile gives the default MicroVM. It does not
+// run anything until SetUserData is called.
+func New(id string, profile config.Profile) (*types.MicroVMSpec, error) {
 	mvm := defaults.BaseMicroVM()
 	mvm.Id = id
 	mvm.Namespace = Namespace
 
-	metadata, err := createMetadata(id, Namespace)
-	if err != nil {
-		return nil, err
+	applyProfile(mvm, profile)
+
+	if profile.Name != "" {
+		if mvm.Labels == nil {
+			mvm.Labels = map[string]string{}
+		}
+
+		mvm.Labels[ProfileLabel] = profile.Name
 	}
 
-	userdata, err := createUserData(id, user, repo, ghToken, publicKey)
+	metadata, err := createMetadata(id, Namespace)
 	if err != nil {
 		return nil, err
 	}
 
 	mvm.Metadata = map[string]string{
 		"meta-data": metadata,
-		"user-data": userdata,
 	}
 
 	return mvm, nil
 }
 
+// SetRepo records the repo, as owner/name, which the MicroVM's runner is
+// registered for.
+func SetRepo(mvm *types.MicroVMSpec, repo string) {
+	if mvm.Labels == nil {
+		mvm.Labels = map[string]string{}
+	}
+
+	mvm.Labels[RepoLabel] = repo
+}
+
+// SetRunnerID records the ID of the MicroVM's runner in github.
+func SetRunnerID(mvm *types.MicroVMSpec, id int64) {
+	if mvm.Labels == nil {
+		mvm.Labels = map[string]string{}
+	}
+
+	mvm.Labels[RunnerIDLabel] = strconv.FormatInt(id, 10)
+}
+
+// RunnerID returns the ID of the MicroVM's runner in github, which is not
+// known for MicroVMs created before it was recorded.
+func RunnerID(mvm *types.MicroVMSpec) (int64, bool) {
+	id, err := strconv.ParseInt(mvm.Labels[RunnerIDLabel], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// CABundlePath is where the CA bundle is put in the MicroVM, so that the
+// system trusts it once the certificates are updated.
+const CABundlePath = "/usr/local/share/ca-certificates/microvm-action-runner.crt"
+
+// Bootstrap is what a MicroVM needs to start its runner.
+type Bootstrap struct {
+	// JITConfig is the just in time config github generated for the runner
+	JITConfig string
+	// PublicKey, if there is one, is allowed to ssh in as root
+	PublicKey string
+	// RunnerDownloadURL is where the runner release is downloaded from,
+	// config.DefaultRunnerDownloadURL when empty
+	RunnerDownloadURL string
+	// CABundle is PEM certificates for the MicroVM, and the runner's jobs, to
+	// trust as well as the system's
+	CABundle []byte
+	// Template renders the script which starts the runner, the embedded one
+	// when nil
+	Template *template.Template
+}
+
+// ScriptData is what the runner script template is rendered with.
+type ScriptData struct {
+	// Name is the name of the runner and its MicroVM
+	Name string
+	// JITConfig is the just in time config the runner is run with
+	JITConfig string
+	// RunnerDownloadURL is where the runner release is downloaded from, with
+	// no trailing slash
+	RunnerDownloadURL string
+	// CAFile is the path of the CA bundle in the MicroVM, which the system
+	// already trusts, or empty if there is none
+	CAFile string
+}
+
+//go:embed userdata.sh.tmpl
+var embeddedScript string
+
+var defaultTemplate = template.Must(ParseTemplate("userdata.sh.tmpl", embeddedScript))
+
+// ParseTemplate parses a runner script template. A template which refers to
+// anything ScriptData does not have is rejected, rather than failing once a
+// runner needs it.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse userdata template: %w", err)
+	}
+
+	// fields are only looked up when the template is executed
+	sample := ScriptData{
+		Name:              "runner",
+		JITConfig:         "jit-config",
+		RunnerDownloadURL: config.DefaultRunnerDownloadURL,
+		CAFile:            CABundlePath,
+	}
+
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("failed to render userdata template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// SetUserData has the MicroVM start a runner as set out in the bootstrap.
+func SetUserData(mvm *types.MicroVMSpec, b Bootstrap) error {
+	userdata, err := createUserData(mvm.Id, b)
+	if err != nil {
+		return err
+	}
+
+	mvm.Metadata["user-data"] = userdata
+
+	return nil
+}
+
+// Labels returns the labels to register a runner with, which are the given
+// labels or DefaultLabel if there are none, along with RunnerLabel.
+func Labels(labels []string) []string {
+	if len(labels) == 0 {
+		labels = []string{DefaultLabel}
+	}
+
+	for _, l := range labels {
+		if strings.EqualFold(l, RunnerLabel) {
+			return labels
+		}
+	}
+
+	return append(append([]string{}, labels...), RunnerLabel)
+}
+
+// applyProfile overrides the parts of the MicroVM which are set in the
+// profile.
+func applyProfile(mvm *types.MicroVMSpec, p config.Profile) {
+	if p.VCPU > 0 {
+		mvm.Vcpu = int32(p.VCPU)
+	}
+
+	if p.MemoryMiB > 0 {
+		mvm.MemoryInMb = int32(p.MemoryMiB)
+	}
+
+	if p.KernelImage != "" {
+		mvm.Kernel.Image = p.KernelImage
+	}
+
+	if p.KernelFilename != "" {
+		mvm.Kernel.Filename = utils.PointyString(p.KernelFilename)
+	}
+
+	if p.RootVolumeImage != "" {
+		mvm.RootVolume.Source.ContainerSource = utils.PointyString(p.RootVolumeImage)
+	}
+
+	for _, v := range p.Volumes {
+		vol := &types.Volume{
+			Id:         v.ID,
+			IsReadOnly: v.ReadOnly,
+			Source: &types.VolumeSource{
+				ContainerSource: utils.PointyString(v.Image),
+			},
+		}
+
+		if v.SizeMiB > 0 {
+			size := int32(v.SizeMiB)
+			vol.SizeInMb = &size
+		}
+
+		mvm.AdditionalVolumes = append(mvm.AdditionalVolumes, vol)
+	}
+
+	if len(p.Interfaces) > 0 {
+		mvm.Interfaces = make([]*types.NetworkInterface, 0, len(p.Interfaces))
+
+		for _, i := range p.Interfaces {
+			mvm.Interfaces = append(mvm.Interfaces, networkInterface(i))
+		}
+	}
+}
+
+func networkInterface(i config.Interface) *types.NetworkInterface {
+	iface := &types.NetworkInterface{
+		DeviceId: i.DeviceID,
+		Type:     types.NetworkInterface_MACVTAP,
+	}
+
+	if i.Type == config.InterfaceTAP {
+		iface.Type = types.NetworkInterface_TAP
+	}
+
+	if i.GuestMAC != "" {
+		iface.GuestMac = utils.PointyString(i.GuestMAC)
+	}
+
+	if i.Address != "" {
+		iface.Address = &types.StaticAddress{
+			Address:     i.Address,
+			Nameservers: i.Nameservers,
+		}
+
+		if i.Gateway != "" {
+			iface.Address.Gateway = utils.PointyString(i.Gateway)
+		}
+	}
+
+	return iface
+}
+
 func createMetadata(name, ns string) (string, error) {
 	metadata := instance.New(
 		instance.WithInstanceID(fmt.Sprintf("%s/%s", ns, name)),
@@ -56,21 +284,43 @@ func createMetadata(name, ns string) (string, error) {
 	return base64.StdEncoding.EncodeToString(userMeta), nil
 }
 
-//go:embed userdata.sh
-var embeddedScript embed.FS
+func createUserData(id string, b Bootstrap) (string, error) {
+	// a template renders an empty field as a blank, which leaves a script
+	// that cannot start the runner
+	if id == "" {
+		return "", errors.New("runner name not provided")
+	}
 
-func createUserData(id, ghToken, user, repo, publicKey string) (string, error) {
-	dat, err := embeddedScript.ReadFile(userdataScript)
-	if err != nil {
-		return "", err
+	if b.JITConfig == "" {
+		return "", errors.New("jit config not provided")
+	}
+
+	if b.RunnerDownloadURL == "" {
+		b.RunnerDownloadURL = config.DefaultRunnerDownloadURL
+	}
+
+	if b.Template == nil {
+		b.Template = defaultTemplate
 	}
 
-	script := string(dat)
+	data := ScriptData{
+		Name:              id,
+		JITConfig:         b.JITConfig,
+		RunnerDownloadURL: strings.TrimSuffix(b.RunnerDownloadURL, "/"),
+	}
 
-	script = strings.Replace(script, "REPLACE_PAT", ghToken, 1)
-	script = strings.Replace(script, "REPLACE_ID", id, 1)
-	script = strings.Replace(script, "REPLACE_ORG_USER", user, 1)
-	script = strings.Replace(script, "REPLACE_REPO", repo, 1)
+	if data.RunnerDownloadURL == "" {
+		return "", errors.New("runner download url not provided")
+	}
+
+	if len(b.CABundle) > 0 {
+		data.CAFile = CABundlePath
+	}
+
+	var script bytes.Buffer
+	if err := b.Template.Execute(&script, data); err != nil {
+		return "", fmt.Errorf("failed to render userdata template: %w", err)
+	}
 
 	userData := &userdata.UserData{
 		HostName: id,
@@ -82,20 +332,32 @@ func createUserData(id, ghToken, user, repo, publicKey string) (string, error) {
 			"ln -sf /run/systemd/resolve/stub-resolv.conf /etc/resolv.conf",
 		},
 		RunCommands: []string{
-			script,
+			script.String(),
 		},
 	}
 
-	if publicKey != "" {
-		userData.Users[0].SSHAuthorizedKeys = []string{publicKey}
+	if b.PublicKey != "" {
+		userData.Users[0].SSHAuthorizedKeys = []string{b.PublicKey}
+	}
+
+	// the bundle is trusted before the runner is downloaded, which may well be
+	// from a server with a certificate from the same CA
+	if data.CAFile != "" {
+		userData.WriteFiles = []userdata.WriteFile{{
+			Encoding:    "b64",
+			Content:     base64.StdEncoding.EncodeToString(b.CABundle),
+			Path:        data.CAFile,
+			Permissions: "0644",
+		}}
+		userData.RunCommands = append([]string{"update-ca-certificates"}, userData.RunCommands...)
 	}
 
-	data, err := yaml.Marshal(userData)
+	rendered, err := yaml.Marshal(userData)
 	if err != nil {
 		return "", fmt.Errorf("marshalling bootstrap data: %w", err)
 	}
 
-	dataWithHeader := append([]byte("#cloud-config\n"), data...)
+	dataWithHeader := append([]byte("#cloud-config\n"), rendered...)
 
 	return base64.StdEncoding.EncodeToString(dataWithHeader), nil
 }
@@ -2,54 +2,315 @@ package microvm_test
 
 import (
 	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/gomega"
 	"github.com/weaveworks-liquidmetal/flintlock/api/types"
 	"github.com/weaveworks-liquidmetal/flintlock/client/cloudinit/userdata"
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/config"
 	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/microvm"
 	"gopkg.in/yaml.v2"
 )
 
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func Test_SetUserData_Golden(t *testing.T) {
+	g := NewWithT(t)
+
+	custom, err := os.ReadFile(filepath.Join("testdata", "custom.sh.tmpl"))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	customTemplate, err := microvm.ParseTemplate("custom.sh.tmpl", string(custom))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tt := []struct {
+		name      string
+		bootstrap microvm.Bootstrap
+	}{
+		{
+			name:      "default",
+			bootstrap: microvm.Bootstrap{JITConfig: "jit-config"},
+		},
+		{
+			name: "github-server",
+			bootstrap: microvm.Bootstrap{
+				JITConfig:         "jit-config",
+				PublicKey:         "ssh-ed25519 AAAA test",
+				RunnerDownloadURL: "https://mirror.example.com/actions-runner/",
+				CABundle:          []byte("-----BEGIN CERTIFICATE-----\nfoo\n-----END CERTIFICATE-----\n"),
+			},
+		},
+		{
+			name: "custom-template",
+			bootstrap: microvm.Bootstrap{
+				JITConfig: "jit-config",
+				CABundle:  []byte("-----BEGIN CERTIFICATE-----\nfoo\n-----END CERTIFICATE-----\n"),
+				Template:  customTemplate,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := microvm.New("foo", config.Profile{})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			g.Expect(microvm.SetUserData(spec, tc.bootstrap)).To(Succeed())
+
+			rendered, err := base64.StdEncoding.DecodeString(spec.Metadata["user-data"])
+			g.Expect(err).NotTo(HaveOccurred())
+
+			golden := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				g.Expect(os.WriteFile(golden, rendered, 0o644)).To(Succeed())
+			}
+
+			expected, err := os.ReadFile(golden)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(rendered)).To(Equal(string(expected)))
+		})
+	}
+}
+
+func Test_ParseTemplate(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		text        string
+		expectedErr string
+	}{
+		{
+			name: "every field is known",
+			text: "{{ .Name }} {{ .JITConfig }} {{ .RunnerDownloadURL }} {{ .CAFile }}",
+		},
+		{
+			name:        "a template which does not parse is rejected",
+			text:        "{{ .JITConfig",
+			expectedErr: "failed to parse userdata template",
+		},
+		{
+			name:        "a field which does not exist is rejected, rather than left blank",
+			text:        "{{ .Token }}",
+			expectedErr: "failed to render userdata template",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := microvm.ParseTemplate("test", tc.text)
+			if tc.expectedErr == "" {
+				g.Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+
+}
+
+func Test_SetUserData_Required(t *testing.T) {
+	g := NewWithT(t)
+
+	tt := []struct {
+		name        string
+		id          string
+		bootstrap   microvm.Bootstrap
+		expectedErr string
+	}{
+		{
+			name:        "no runner name",
+			bootstrap:   microvm.Bootstrap{JITConfig: "jit-config"},
+			expectedErr: "runner name not provided",
+		},
+		{
+			name:        "no jit config",
+			id:          "foo",
+			expectedErr: "jit config not provided",
+		},
+		{
+			name:        "no runner download url",
+			id:          "foo",
+			bootstrap:   microvm.Bootstrap{JITConfig: "jit-config", RunnerDownloadURL: "/"},
+			expectedErr: "runner download url not provided",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := microvm.New(tc.id, config.Profile{})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			g.Expect(microvm.SetUserData(spec, tc.bootstrap)).To(MatchError(tc.expectedErr))
+		})
+	}
+}
+
 func Test_MicrovmNew(t *testing.T) {
 	g := NewWithT(t)
 
-	var (
-		id       = "foo"
-		repoName = "action-runner"
-		userName = "liquid-metal"
-		token    = "token"
-	)
+	id := "foo"
 
-	spec, err := microvm.New(token, "", userName, repoName, id)
+	spec, err := microvm.New(id, config.Profile{})
 	g.Expect(err).NotTo(HaveOccurred())
 
 	g.Expect(spec.Namespace).To(Equal(microvm.Namespace))
 	g.Expect(spec.Id).To(Equal(id))
+	g.Expect(spec.Metadata).To(HaveKey("meta-data"))
+	g.Expect(spec.Metadata).NotTo(HaveKey("user-data"))
+
+	g.Expect(microvm.SetUserData(spec, microvm.Bootstrap{JITConfig: "jit-config"})).To(Succeed())
 
 	userData := decodeData(g, spec)
 
+	g.Expect(userData.HostName).To(Equal(id))
 	g.Expect(userData.Users[0].Name).To(Equal("root"))
 	g.Expect(userData.Users[0].SSHAuthorizedKeys).To(BeNil())
-	g.Expect(userData.RunCommands[0]).To(ContainSubstring(token))
-	g.Expect(userData.RunCommands[0]).To(ContainSubstring(userName))
-	g.Expect(userData.RunCommands[0]).To(ContainSubstring(repoName))
+	g.Expect(userData.RunCommands[0]).To(ContainSubstring(`JIT_CONFIG="jit-config"`))
+	g.Expect(userData.RunCommands[0]).To(ContainSubstring(`./run.sh --jitconfig "$JIT_CONFIG"`))
+	// the runner is watched by systemd rather than left in the background
+	g.Expect(userData.RunCommands[0]).To(ContainSubstring(`systemctl start --no-block "$UNIT"`))
+	g.Expect(userData.RunCommands[0]).NotTo(ContainSubstring(`"$SCRIPT" &`))
+	// the MicroVM is never given a token
+	g.Expect(userData.RunCommands[0]).NotTo(ContainSubstring("Authorization"))
+	g.Expect(userData.RunCommands[0]).NotTo(ContainSubstring("registration-token"))
 }
 
-func Test_MicrovmNew_WithSSHKey(t *testing.T) {
+func Test_SetUserData_GitHubServer(t *testing.T) {
+	g := NewWithT(t)
+
+	spec, err := microvm.New("foo", config.Profile{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// the runner comes from github, and only the system's certificates are trusted
+	g.Expect(microvm.SetUserData(spec, microvm.Bootstrap{JITConfig: "jit-config"})).To(Succeed())
+
+	userData := decodeData(g, spec)
+
+	g.Expect(userData.WriteFiles).To(BeEmpty())
+	g.Expect(userData.RunCommands).To(HaveLen(1))
+	g.Expect(userData.RunCommands[0]).To(ContainSubstring(`DOWNLOAD_URL="` + config.DefaultRunnerDownloadURL + `"`))
+	g.Expect(userData.RunCommands[0]).To(ContainSubstring(`CA_FILE=""`))
+
+	bundle := []byte("-----BEGIN CERTIFICATE-----\nfoo\n-----END CERTIFICATE-----\n")
+
+	g.Expect(microvm.SetUserData(spec, microvm.Bootstrap{
+		JITConfig:         "jit-config",
+		RunnerDownloadURL: "https://mirror.example.com/runner/",
+		CABundle:          bundle,
+	})).To(Succeed())
+
+	userData = decodeData(g, spec)
+
+	// the bundle is trusted before the runner script runs
+	g.Expect(userData.WriteFiles).To(HaveLen(1))
+	g.Expect(userData.WriteFiles[0].Path).To(Equal(microvm.CABundlePath))
+	g.Expect(base64.StdEncoding.DecodeString(userData.WriteFiles[0].Content)).To(Equal(bundle))
+	g.Expect(userData.RunCommands).To(HaveLen(2))
+	g.Expect(userData.RunCommands[0]).To(Equal("update-ca-certificates"))
+	g.Expect(userData.RunCommands[1]).To(ContainSubstring(`CA_FILE="` + microvm.CABundlePath + `"`))
+	g.Expect(userData.RunCommands[1]).To(ContainSubstring(`DOWNLOAD_URL="https://mirror.example.com/runner"`))
+}
+
+func Test_Labels(t *testing.T) {
 	g := NewWithT(t)
 
-	var (
-		name  = "foo"
-		token = "token"
-		key   = "key"
-	)
+	g.Expect(microvm.Labels([]string{"self-hosted", "gpu"})).To(Equal([]string{"self-hosted", "gpu", microvm.RunnerLabel}))
+	g.Expect(microvm.Labels(nil)).To(Equal([]string{microvm.DefaultLabel, microvm.RunnerLabel}))
+	g.Expect(microvm.Labels([]string{"self-hosted", microvm.RunnerLabel})).To(Equal([]string{"self-hosted", microvm.RunnerLabel}))
+}
+
+func Test_RunnerID(t *testing.T) {
+	g := NewWithT(t)
 
-	spec, err := microvm.New(token, key, "", "", name)
+	spec, err := microvm.New("foo", config.Profile{})
 	g.Expect(err).NotTo(HaveOccurred())
 
-	g.Expect(spec.Namespace).To(Equal(microvm.Namespace))
-	g.Expect(spec.Id).To(Equal(name))
+	_, ok := microvm.RunnerID(spec)
+	g.Expect(ok).To(BeFalse())
+
+	microvm.SetRunnerID(spec, 42)
+
+	id, ok := microvm.RunnerID(spec)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(id).To(BeEquivalentTo(42))
+}
+
+func Test_MicrovmNew_WithProfile(t *testing.T) {
+	g := NewWithT(t)
+
+	base, err := microvm.New("foo", config.Profile{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	profile := config.Profile{
+		Name:            "large",
+		VCPU:            8,
+		MemoryMiB:       16384,
+		KernelImage:     "kernel:latest",
+		KernelFilename:  "boot/vmlinuz",
+		RootVolumeImage: "root:latest",
+		Volumes: []config.Volume{
+			{ID: "cache", Image: "cache:latest", ReadOnly: true, SizeMiB: 1024},
+		},
+		Interfaces: []config.Interface{
+			{DeviceID: "eth1"},
+			{DeviceID: "eth2", Type: "tap", GuestMAC: "aa:bb:cc:dd:ee:ff", Address: "10.0.0.2/24", Gateway: "10.0.0.1", Nameservers: []string{"1.1.1.1"}},
+		},
+	}
+
+	spec, err := microvm.New("foo", profile)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(spec.Vcpu).To(BeEquivalentTo(8))
+	g.Expect(spec.MemoryInMb).To(BeEquivalentTo(16384))
+	g.Expect(spec.Kernel.Image).To(Equal("kernel:latest"))
+	g.Expect(*spec.Kernel.Filename).To(Equal("boot/vmlinuz"))
+	g.Expect(*spec.RootVolume.Source.ContainerSource).To(Equal("root:latest"))
+
+	g.Expect(spec.AdditionalVolumes).To(HaveLen(1))
+	g.Expect(spec.AdditionalVolumes[0].Id).To(Equal("cache"))
+	g.Expect(spec.AdditionalVolumes[0].IsReadOnly).To(BeTrue())
+	g.Expect(*spec.AdditionalVolumes[0].Source.ContainerSource).To(Equal("cache:latest"))
+	g.Expect(*spec.AdditionalVolumes[0].SizeInMb).To(BeEquivalentTo(1024))
+
+	g.Expect(spec.Interfaces).To(HaveLen(2))
+	g.Expect(spec.Interfaces[0].DeviceId).To(Equal("eth1"))
+	g.Expect(spec.Interfaces[0].Type).To(Equal(types.NetworkInterface_MACVTAP))
+	g.Expect(spec.Interfaces[0].Address).To(BeNil())
+	g.Expect(spec.Interfaces[1].Type).To(Equal(types.NetworkInterface_TAP))
+	g.Expect(*spec.Interfaces[1].GuestMac).To(Equal("aa:bb:cc:dd:ee:ff"))
+	g.Expect(spec.Interfaces[1].Address.Address).To(Equal("10.0.0.2/24"))
+	g.Expect(*spec.Interfaces[1].Address.Gateway).To(Equal("10.0.0.1"))
+	g.Expect(spec.Interfaces[1].Address.Nameservers).To(Equal([]string{"1.1.1.1"}))
+
+	// the profile is recorded so that its settings can be found later
+	g.Expect(spec.Labels).To(HaveKeyWithValue(microvm.ProfileLabel, "large"))
+	g.Expect(base.Labels).NotTo(HaveKey(microvm.ProfileLabel))
+
+	// the parts of the profile which are left out stay as the default
+	spec, err = microvm.New("foo", config.Profile{Name: "small", VCPU: 1})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(spec.Vcpu).To(BeEquivalentTo(1))
+	g.Expect(spec.MemoryInMb).To(Equal(base.MemoryInMb))
+	g.Expect(spec.Kernel.Image).To(Equal(base.Kernel.Image))
+	g.Expect(spec.RootVolume.Source.ContainerSource).To(Equal(base.RootVolume.Source.ContainerSource))
+	g.Expect(spec.AdditionalVolumes).To(BeEmpty())
+	g.Expect(spec.Interfaces).To(HaveLen(len(base.Interfaces)))
+}
+
+func Test_MicrovmNew_WithSSHKey(t *testing.T) {
+	g := NewWithT(t)
+
+	key := "key"
+
+	spec, err := microvm.New("foo", config.Profile{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(microvm.SetUserData(spec, microvm.Bootstrap{JITConfig: "jit-config", PublicKey: key})).To(Succeed())
 
 	userData := decodeData(g, spec)
 
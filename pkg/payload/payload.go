@@ -3,6 +3,7 @@ package payload
 import (
 	"errors"
 	"net/http"
+	"sync"
 
 	"github.com/go-playground/webhooks/v6/github"
 )
@@ -12,18 +13,32 @@ type Payload interface {
 }
 
 type Service struct {
+	mu     sync.RWMutex
 	secret string
 }
 
 func New(s string) *Service {
-	return &Service{s}
+	return &Service{secret: s}
 }
 
-func (s Service) Parse(r *http.Request) (*github.WorkflowJobPayload, error) {
+// SetSecret replaces the secret which payloads are verified with. It is safe
+// to call while payloads are being parsed.
+func (s *Service) SetSecret(secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.secret = secret
+}
+
+func (s *Service) Parse(r *http.Request) (*github.WorkflowJobPayload, error) {
 	var opt = noOpt()
 
-	if s.secret != "" {
-		opt = github.Options.Secret(s.secret)
+	s.mu.RLock()
+	secret := s.secret
+	s.mu.RUnlock()
+
+	if secret != "" {
+		opt = github.Options.Secret(secret)
 	}
 
 	hook, err := github.New(opt)
@@ -40,6 +40,29 @@ func Test_ParsePayload_WithSecret(t *testing.T) {
 	g.Expect(err).To(MatchError(github.ErrHMACVerificationFailed))
 }
 
+func Test_ParsePayload_SetSecret(t *testing.T) {
+	g := NewWithT(t)
+
+	s := payload.New("")
+	s.SetSecret("secret")
+
+	req, err := newRequest()
+	g.Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("X-Hub-Signature", "secret")
+
+	// as above, this error means the new secret is being applied
+	_, err = s.Parse(req)
+	g.Expect(err).To(MatchError(github.ErrHMACVerificationFailed))
+
+	s.SetSecret("")
+
+	req, err = newRequest()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	_, err = s.Parse(req)
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
 func newRequest() (*http.Request, error) {
 	dat, err := json.Marshal(github.WorkflowJobPayload{})
 	if err != nil {
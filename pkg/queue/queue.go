@@ -0,0 +1,174 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/filestore"
+)
+
+// ErrFull is returned by Push when the queue already holds the maximum number
+// of pending jobs.
+var ErrFull = errors.New("pending job queue is full")
+
+// Job is a workflow job which is waiting for a runner to be created for it.
+type Job struct {
+	// Name is the name of the runner which will be created for the job
+	Name string `json:"name"`
+	// Payload is the queued event the job was received in
+	Payload github.WorkflowJobPayload `json:"payload"`
+	// QueuedAt is when the job was first added to the queue
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+// Queue is a FIFO list of pending workflow jobs. If it is given a path, every
+// change is written to disk so that pending jobs survive a restart of the
+// service. It is safe for concurrent use.
+type Queue struct {
+	path    string
+	maxLen  int
+	maxWait time.Duration
+
+	mu   sync.Mutex
+	jobs []Job
+}
+
+// New returns a new Queue, loading any jobs saved at path. If path is empty,
+// jobs are only kept in memory. A maxLen or maxWait of zero means unlimited.
+func New(path string, maxLen int, maxWait time.Duration) (*Queue, error) {
+	q := &Queue{
+		path:    path,
+		maxLen:  maxLen,
+		maxWait: maxWait,
+		jobs:    []Job{},
+	}
+
+	if path != "" {
+		if err := filestore.ReadJSON(path, &q.jobs); err != nil {
+			return nil, fmt.Errorf("failed to load pending jobs: %w", err)
+		}
+	}
+
+	return q, nil
+}
+
+// Push adds a job to the back of the queue. Pushing a job which is already
+// pending does nothing.
+func (q *Queue) Push(name string, p github.WorkflowJobPayload) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.indexOf(name) >= 0 {
+		return nil
+	}
+
+	if q.maxLen > 0 && len(q.jobs) >= q.maxLen {
+		return ErrFull
+	}
+
+	q.jobs = append(q.jobs, Job{Name: name, Payload: p, QueuedAt: time.Now()})
+
+	return q.save()
+}
+
+// Has returns true if the named job is pending.
+func (q *Queue) Has(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.indexOf(name) >= 0
+}
+
+// Remove takes the named job out of the queue wherever it is. It returns false
+// if the job was not pending.
+func (q *Queue) Remove(name string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.indexOf(name)
+	if i < 0 {
+		return false, nil
+	}
+
+	q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+
+	return true, q.save()
+}
+
+// Prune removes and returns every job which has been waiting for longer than
+// the max wait.
+func (q *Queue) Prune() ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxWait == 0 {
+		return nil, nil
+	}
+
+	var (
+		kept    = []Job{}
+		expired []Job
+		now     = time.Now()
+	)
+
+	for _, job := range q.jobs {
+		if now.Sub(job.QueuedAt) > q.maxWait {
+			expired = append(expired, job)
+			continue
+		}
+
+		kept = append(kept, job)
+	}
+
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	q.jobs = kept
+
+	return expired, q.save()
+}
+
+// Len returns the number of pending jobs.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.jobs)
+}
+
+// Jobs returns a copy of every pending job, front first.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, len(q.jobs))
+	copy(jobs, q.jobs)
+
+	return jobs
+}
+
+// indexOf returns the position of the named job, or -1 if it is not pending.
+// The caller must hold the lock.
+func (q *Queue) indexOf(name string) int {
+	for i, job := range q.jobs {
+		if job.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// save writes the queue to disk if it has a path. The caller must hold the lock.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	return filestore.WriteJSON(q.path, q.jobs)
+}
@@ -0,0 +1,126 @@
+package queue_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/queue"
+)
+
+func Test_QueuePushHas(t *testing.T) {
+	g := NewWithT(t)
+
+	q, err := queue.New("", 0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Has("job1")).To(BeFalse())
+
+	g.Expect(q.Push("job1", payload(1))).To(Succeed())
+	g.Expect(q.Push("job2", payload(2))).To(Succeed())
+	// pushing the same job twice is a no-op
+	g.Expect(q.Push("job1", payload(1))).To(Succeed())
+	g.Expect(q.Len()).To(Equal(2))
+
+	g.Expect(q.Has("job1")).To(BeTrue())
+	g.Expect(names(q.Jobs())).To(Equal([]string{"job1", "job2"}))
+	g.Expect(q.Jobs()[0].Payload.WorkflowJob.ID).To(Equal(int64(1)))
+
+	_, err = q.Remove("job1")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Has("job1")).To(BeFalse())
+	g.Expect(names(q.Jobs())).To(Equal([]string{"job2"}))
+}
+
+func Test_QueueMaxLength(t *testing.T) {
+	g := NewWithT(t)
+
+	q, err := queue.New("", 1, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Push("job1", payload(1))).To(Succeed())
+	g.Expect(q.Push("job2", payload(2))).To(MatchError(queue.ErrFull))
+	g.Expect(q.Len()).To(Equal(1))
+}
+
+func Test_QueueRemove(t *testing.T) {
+	g := NewWithT(t)
+
+	q, err := queue.New("", 0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Push("job1", payload(1))).To(Succeed())
+	g.Expect(q.Push("job2", payload(2))).To(Succeed())
+	g.Expect(q.Push("job3", payload(3))).To(Succeed())
+
+	removed, err := q.Remove("job2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(removed).To(BeTrue())
+
+	removed, err = q.Remove("job2")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(removed).To(BeFalse())
+
+	g.Expect(names(q.Jobs())).To(Equal([]string{"job1", "job3"}))
+}
+
+func Test_QueuePrune(t *testing.T) {
+	g := NewWithT(t)
+
+	q, err := queue.New("", 0, 10*time.Millisecond)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Push("old", payload(1))).To(Succeed())
+	time.Sleep(20 * time.Millisecond)
+	g.Expect(q.Push("new", payload(2))).To(Succeed())
+
+	expired, err := q.Prune()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(names(expired)).To(Equal([]string{"old"}))
+	g.Expect(names(q.Jobs())).To(Equal([]string{"new"}))
+}
+
+func Test_QueueSurvivesRestart(t *testing.T) {
+	g := NewWithT(t)
+
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	q, err := queue.New(path, 0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(q.Push("job1", payload(1))).To(Succeed())
+	g.Expect(q.Push("job2", payload(2))).To(Succeed())
+	_, err = q.Remove("job1")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// a job which is being given a runner is still saved
+	g.Expect(q.Has("job2")).To(BeTrue())
+
+	restarted, err := queue.New(path, 0, 0)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	jobs := restarted.Jobs()
+	g.Expect(names(jobs)).To(Equal([]string{"job2"}))
+	g.Expect(jobs[0].Payload.WorkflowJob.ID).To(Equal(int64(2)))
+	g.Expect(jobs[0].QueuedAt).NotTo(BeZero())
+}
+
+func payload(id int64) github.WorkflowJobPayload {
+	p := github.WorkflowJobPayload{}
+	p.WorkflowJob.ID = id
+
+	return p
+}
+
+func names(jobs []queue.Job) []string {
+	out := []string{}
+	for _, job := range jobs {
+		out = append(out, job.Name)
+	}
+
+	return out
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certLoader serves a TLS certificate from disk, loading it again whenever the
+// files change so that a rotated certificate is used without a restart.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	l        *logrus.Entry
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertLoader(certFile, keyFile string, l *logrus.Entry) (*certLoader, error) {
+	c := &certLoader{certFile: certFile, keyFile: keyFile, l: l}
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for use as
+// tls.Config.GetCertificate. If the files have changed but cannot be loaded,
+// the previous certificate keeps being served.
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		c.l.Errorf("failed to check TLS certificate for changes: %s", err)
+		return c.cert, nil
+	}
+
+	if modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	if err := c.load(modTime); err != nil {
+		c.l.Errorf("failed to reload TLS certificate, serving the previous one: %s", err)
+		return c.cert, nil
+	}
+
+	c.l.Info("reloaded TLS certificate")
+
+	return c.cert, nil
+}
+
+// load reads the certificate and key. The caller must hold the lock, or be the
+// only one with the loader.
+func (c *certLoader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+
+	return nil
+}
+
+// latestModTime returns when either file was last changed.
+func (c *certLoader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Params groups the init opts for a New server
+type Params struct {
+	// Address is the host:port to listen on
+	Address string
+	// Handler serves every request
+	Handler http.Handler
+	// TLSCertFile and TLSKeyFile are the paths to a PEM encoded certificate
+	// and key. When both are empty the server uses plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ReadTimeout is how long a client has to send its whole request
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a request has to be answered
+	WriteTimeout time.Duration
+	L            *logrus.Entry
+}
+
+// Server is an HTTP(S) server which can be shut down gracefully.
+type Server struct {
+	srv   *http.Server
+	ln    net.Listener
+	certs *certLoader
+	l     *logrus.Entry
+}
+
+// New returns a new Server which is already listening on the address, so that
+// a port which is in use is reported straight away. Nothing is served until
+// Run is called.
+func New(p Params) (*Server, error) {
+	if p.Handler == nil {
+		return nil, errors.New("handler not provided")
+	}
+
+	if p.L == nil {
+		return nil, errors.New("logger not provided")
+	}
+
+	if (p.TLSCertFile == "") != (p.TLSKeyFile == "") {
+		return nil, errors.New("both a TLS certificate and key must be provided, or neither")
+	}
+
+	s := &Server{
+		srv: &http.Server{
+			Handler:           p.Handler,
+			ReadTimeout:       p.ReadTimeout,
+			ReadHeaderTimeout: p.ReadTimeout,
+			WriteTimeout:      p.WriteTimeout,
+		},
+		l: p.L,
+	}
+
+	if p.TLSCertFile != "" {
+		certs, err := newCertLoader(p.TLSCertFile, p.TLSKeyFile, p.L)
+		if err != nil {
+			return nil, err
+		}
+
+		s.certs = certs
+		s.srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	ln, err := net.Listen("tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ln = ln
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Run serves requests until ctx is done, then stops accepting new connections
+// and waits up to shutdownTimeout for requests which are in flight to finish.
+func (s *Server) Run(ctx context.Context, shutdownTimeout time.Duration) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		if s.certs != nil {
+			s.l.Infof("serving https on %s", s.Addr())
+			errs <- s.srv.ServeTLS(s.ln, "", "")
+
+			return
+		}
+
+		s.l.Infof("serving http on %s", s.Addr())
+		errs <- s.srv.Serve(s.ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.l.Info("shutting down server, waiting for requests in flight")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/server"
+)
+
+func TestNew_Errors(t *testing.T) {
+	g := NewWithT(t)
+
+	ok := http.NewServeMux()
+
+	tt := []struct {
+		name        string
+		params      server.Params
+		expectedErr string
+	}{
+		{
+			name:        "without a handler",
+			params:      server.Params{L: nullLogger()},
+			expectedErr: "handler not provided",
+		},
+		{
+			name:        "without a logger",
+			params:      server.Params{Handler: ok},
+			expectedErr: "logger not provided",
+		},
+		{
+			name:        "with a cert but no key",
+			params:      server.Params{Handler: ok, L: nullLogger(), TLSCertFile: "cert.pem"},
+			expectedErr: "both a TLS certificate and key must be provided, or neither",
+		},
+		{
+			name:        "with a cert which does not exist",
+			params:      server.Params{Handler: ok, L: nullLogger(), TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+			expectedErr: "no such file or directory",
+		},
+		{
+			name:        "with a bad address",
+			params:      server.Params{Handler: ok, L: nullLogger(), Address: "nope"},
+			expectedErr: "missing port in address",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := server.New(tc.params)
+			g.Expect(err).To(MatchError(ContainSubstring(tc.expectedErr)))
+		})
+	}
+}
+
+func TestRun_GracefulShutdown(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	srv, err := server.New(server.Params{Address: "127.0.0.1:0", Handler: mux, L: nullLogger()})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+
+	go func() {
+		stopped <- srv.Run(ctx, time.Minute)
+	}()
+
+	statuses := make(chan int)
+
+	go func() {
+		resp, err := http.Get("http://" + srv.Addr().String() + "/slow")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	// the request in flight holds up the shutdown
+	g.Consistently(stopped, 100*time.Millisecond).ShouldNot(Receive())
+
+	close(release)
+
+	g.Eventually(statuses).Should(Receive(Equal(http.StatusAccepted)))
+	g.Eventually(stopped).Should(Receive(BeNil()))
+
+	// and once it is shut down, nothing else is accepted
+	_, err = http.Get("http://" + srv.Addr().String() + "/slow")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestRun_ShutdownTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	defer close(release)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	srv, err := server.New(server.Params{Address: "127.0.0.1:0", Handler: mux, L: nullLogger()})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+
+	go func() {
+		stopped <- srv.Run(ctx, 50*time.Millisecond)
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + srv.Addr().String() + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	g.Eventually(stopped).Should(Receive(MatchError(context.DeadlineExceeded)))
+}
+
+func TestRun_TLSReload(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile  = filepath.Join(dir, "tls.key")
+	)
+
+	writeCert(g, certFile, keyFile, "first")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	srv, err := server.New(server.Params{
+		Address:     "127.0.0.1:0",
+		Handler:     mux,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		L:           nullLogger(),
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		_ = srv.Run(ctx, time.Second)
+	}()
+
+	g.Expect(servedCertName(g, srv)).To(Equal("first"))
+
+	// make sure the rotated files do not share a modification time with the
+	// old ones
+	later := time.Now().Add(time.Minute)
+
+	writeCert(g, certFile, keyFile, "second")
+	g.Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+
+	g.Expect(servedCertName(g, srv)).To(Equal("second"))
+
+	// a broken rotation keeps the last good certificate
+	g.Expect(os.WriteFile(keyFile, []byte("nope"), 0o600)).To(Succeed())
+	g.Expect(os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))).To(Succeed())
+
+	g.Expect(servedCertName(g, srv)).To(Equal("second"))
+}
+
+// servedCertName connects to the server and returns the common name of the
+// certificate it presents.
+func servedCertName(g *WithT, srv *server.Server) string {
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true, //nolint: gosec // the test certs are self signed
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// writeCert writes a new self signed certificate with the given common name.
+func writeCert(g *WithT, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	g.Expect(os.WriteFile(certFile, certPEM, 0o600)).To(Succeed())
+	g.Expect(os.WriteFile(keyFile, keyPEM, 0o600)).To(Succeed())
+}
+
+func nullLogger() *logrus.Entry {
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	log := logrus.NewEntry(l)
+	return log
+}
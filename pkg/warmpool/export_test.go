@@ -0,0 +1,14 @@
+package warmpool
+
+import "time"
+
+// ClaimTTL is exported for tests.
+const ClaimTTL = claimTTL
+
+// SetNow replaces the pool's clock, so that tests can move time on.
+func (p *Pool) SetNow(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.now = now
+}
@@ -0,0 +1,321 @@
+package warmpool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namePrefix starts the name of every warm runner, so that they can be told
+// apart from runners created for a job.
+const namePrefix = "warm-"
+
+// claimTTL is how long a job's claim on a warm runner is held without the
+// runner picking up a job. Claims are normally settled within seconds, this
+// only stops lost webhooks from making the pool think it is in use forever.
+const claimTTL = 10 * time.Minute
+
+// NewName returns a name for a new warm runner.
+func NewName() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	return namePrefix + hex.EncodeToString(b)
+}
+
+// IsWarm returns true if the runner name was made by NewName.
+func IsWarm(name string) bool {
+	return strings.HasPrefix(name, namePrefix)
+}
+
+// Reservation is a warm runner which should be created.
+type Reservation struct {
+	// Name is the name of the runner
+	Name string
+	// Profile is the profile to create it with, empty for the default MicroVM
+	Profile string
+}
+
+// Stat describes the pool for one profile.
+type Stat struct {
+	// Profile is the name of the profile, empty for the default MicroVM
+	Profile string
+	// Size is how many idle runners the pool is meant to have
+	Size int
+	// Creating is how many runners have been reserved but whose MicroVMs do
+	// not exist yet
+	Creating int
+	// Idle is how many runners are waiting for a job
+	Idle int
+	// Busy is how many runners have been given a job
+	Busy int
+}
+
+// state is where a warm runner is in its life.
+type state int
+
+const (
+	stateCreating state = iota
+	stateIdle
+	stateBusy
+)
+
+type runner struct {
+	profile string
+	state   state
+}
+
+type claim struct {
+	profile string
+	at      time.Time
+}
+
+// Pool keeps track of the runners which have been booted ahead of time so that
+// jobs do not have to wait for a MicroVM to be created. It only does the
+// bookkeeping, creating and deleting the MicroVMs is up to the caller. It is
+// safe for concurrent use.
+//
+// github hands jobs to whichever idle runner has matching labels, so the pool
+// cannot choose a runner for a job. Instead, a job claims one of the idle
+// runners of its profile, and the claim is settled when github says which
+// runner picked it up.
+type Pool struct {
+	mu      sync.Mutex
+	sizes   map[string]int
+	runners map[string]*runner
+	claims  map[string]claim
+	now     func() time.Time
+}
+
+// New returns an empty Pool.
+func New() *Pool {
+	return &Pool{
+		sizes:   map[string]int{},
+		runners: map[string]*runner{},
+		claims:  map[string]claim{},
+		now:     time.Now,
+	}
+}
+
+// SetSizes sets how many idle runners to keep for each profile. The default
+// MicroVM is the empty profile. Shrinking a pool does not delete runners, the
+// extra ones are used up by jobs instead.
+func (p *Pool) SetSizes(sizes map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sizes = make(map[string]int, len(sizes))
+	for profile, size := range sizes {
+		p.sizes[profile] = size
+	}
+}
+
+// Size returns how many idle runners the pool keeps for the profile.
+func (p *Pool) Size(profile string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sizes[profile]
+}
+
+// Add records a warm runner which exists, eg. one found on a host on startup.
+func (p *Pool) Add(name, profile string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.runners[name] = &runner{profile: profile, state: stateIdle}
+}
+
+// Created marks a reserved runner as idle now that its MicroVM exists, so that
+// jobs can claim it. It returns false if the runner is not in the pool.
+func (p *Pool) Created(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.runners[name]
+	if !ok {
+		return false
+	}
+
+	if r.state == stateCreating {
+		r.state = stateIdle
+	}
+
+	return true
+}
+
+// Remove forgets the runner. It returns false if the runner is not in the
+// pool.
+func (p *Pool) Remove(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.runners[name]; !ok {
+		return false
+	}
+
+	delete(p.runners, name)
+
+	return true
+}
+
+// Reserve returns the runners which need to be created to fill the pool. They
+// are added to the pool straight away, so that they are not reserved twice,
+// but cannot be claimed until they are Created; Remove any which cannot be
+// created.
+func (p *Pool) Reserve() []Reservation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireClaims()
+
+	var reserved []Reservation
+
+	for _, profile := range p.profiles() {
+		for i := p.idle(profile) + p.count(profile, stateCreating); i < p.sizes[profile]; i++ {
+			r := Reservation{Name: NewName(), Profile: profile}
+			p.runners[r.Name] = &runner{profile: r.Profile, state: stateCreating}
+
+			reserved = append(reserved, r)
+		}
+	}
+
+	return reserved
+}
+
+// Claim takes one of the profile's idle runners for the job. It returns false
+// if there are none.
+func (p *Pool) Claim(job, profile string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireClaims()
+
+	if p.idle(profile) < 1 {
+		return false
+	}
+
+	p.claims[job] = claim{profile: profile, at: p.now()}
+
+	return true
+}
+
+// Started settles the job's claim now that github has given it to a runner. If
+// the runner is in the pool it is marked as busy. It returns false if the
+// runner is not in the pool.
+func (p *Pool) Started(job, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.claims, job)
+
+	r, ok := p.runners[name]
+	if !ok {
+		return false
+	}
+
+	r.state = stateBusy
+
+	return true
+}
+
+// Release drops the job's claim, if it has one, and returns true if it did.
+func (p *Pool) Release(job string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.claims[job]
+	delete(p.claims, job)
+
+	return ok
+}
+
+// Stats returns the state of the pool for every profile which has a size or
+// has runners, sorted by profile.
+func (p *Pool) Stats() []Stat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireClaims()
+
+	profiles := p.profiles()
+	stats := make([]Stat, 0, len(profiles))
+
+	for _, profile := range profiles {
+		stats = append(stats, Stat{
+			Profile:  profile,
+			Size:     p.sizes[profile],
+			Creating: p.count(profile, stateCreating),
+			Idle:     p.idle(profile),
+			Busy:     p.count(profile, stateBusy),
+		})
+	}
+
+	return stats
+}
+
+// idle returns how many of the profile's runners have been created and are
+// neither busy nor claimed.
+func (p *Pool) idle(profile string) int {
+	n := p.count(profile, stateIdle)
+
+	for _, c := range p.claims {
+		if c.profile == profile {
+			n--
+		}
+	}
+
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// count returns how many of the profile's runners are in the state.
+func (p *Pool) count(profile string, st state) int {
+	n := 0
+
+	for _, r := range p.runners {
+		if r.profile == profile && r.state == st {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (p *Pool) expireClaims() {
+	for job, c := range p.claims {
+		if p.now().Sub(c.at) > claimTTL {
+			delete(p.claims, job)
+		}
+	}
+}
+
+// profiles returns every profile with a size or runners, sorted.
+func (p *Pool) profiles() []string {
+	seen := map[string]bool{}
+
+	for profile, size := range p.sizes {
+		if size > 0 {
+			seen[profile] = true
+		}
+	}
+
+	for _, r := range p.runners {
+		seen[r.profile] = true
+	}
+
+	profiles := make([]string, 0, len(seen))
+	for profile := range seen {
+		profiles = append(profiles, profile)
+	}
+
+	sort.Strings(profiles)
+
+	return profiles
+}
@@ -0,0 +1,160 @@
+package warmpool_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/warmpool"
+)
+
+func TestNewName(t *testing.T) {
+	g := NewWithT(t)
+
+	name := warmpool.NewName()
+
+	g.Expect(name).To(MatchRegexp(`^warm-[0-9a-f]{8}$`))
+	g.Expect(warmpool.IsWarm(name)).To(BeTrue())
+	g.Expect(warmpool.NewName()).NotTo(Equal(name))
+	g.Expect(warmpool.IsWarm("MDg6Q2hlY2tSdW4=-1-2")).To(BeFalse())
+}
+
+func TestReserve(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.SetSizes(map[string]int{"": 1, "large": 2})
+
+	reserved := pool.Reserve()
+	g.Expect(reserved).To(HaveLen(3))
+	g.Expect(profiles(reserved)).To(Equal(map[string]int{"": 1, "large": 2}))
+
+	// reserved runners count towards the pool, so they are not reserved again
+	g.Expect(pool.Reserve()).To(BeEmpty())
+
+	// runners which could not be created are reserved again
+	g.Expect(pool.Remove(reserved[0].Name)).To(BeTrue())
+	g.Expect(pool.Reserve()).To(HaveLen(1))
+
+	g.Expect(pool.Remove("unknown")).To(BeFalse())
+}
+
+func TestClaim(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.SetSizes(map[string]int{"": 1})
+	pool.Add("warm-1", "")
+
+	g.Expect(pool.Claim("job1", "")).To(BeTrue())
+	// the only runner is claimed, so there is none for the next job
+	g.Expect(pool.Claim("job2", "")).To(BeFalse())
+	g.Expect(pool.Claim("job2", "large")).To(BeFalse())
+
+	// a claimed runner is replaced straight away
+	reserved := pool.Reserve()
+	g.Expect(reserved).To(HaveLen(1))
+
+	// github gives the job to the runner, which stays busy until it is removed
+	g.Expect(pool.Started("job1", "warm-1")).To(BeTrue())
+	g.Expect(pool.Reserve()).To(BeEmpty())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1, Creating: 1, Busy: 1}}))
+
+	g.Expect(pool.Remove("warm-1")).To(BeTrue())
+	g.Expect(pool.Created(reserved[0].Name)).To(BeTrue())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1, Idle: 1}}))
+}
+
+func TestClaim_Expires(t *testing.T) {
+	g := NewWithT(t)
+
+	now := time.Now()
+
+	pool := warmpool.New()
+	pool.SetNow(func() time.Time { return now })
+	pool.SetSizes(map[string]int{"": 1})
+	pool.Add("warm-1", "")
+
+	g.Expect(pool.Claim("job1", "")).To(BeTrue())
+	g.Expect(pool.Claim("job2", "")).To(BeFalse())
+
+	// the runner never picked up job1, so its claim is given up on
+	now = now.Add(warmpool.ClaimTTL + time.Second)
+
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1, Idle: 1}}))
+	g.Expect(pool.Claim("job2", "")).To(BeTrue())
+	g.Expect(pool.Release("job1")).To(BeFalse())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1}}))
+}
+
+func TestCreated(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.SetSizes(map[string]int{"": 1})
+
+	reserved := pool.Reserve()
+	g.Expect(reserved).To(HaveLen(1))
+
+	// the runner's MicroVM does not exist yet, so no job can have it
+	g.Expect(pool.Claim("job1", "")).To(BeFalse())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1, Creating: 1}}))
+
+	g.Expect(pool.Created(reserved[0].Name)).To(BeTrue())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Size: 1, Idle: 1}}))
+	g.Expect(pool.Claim("job1", "")).To(BeTrue())
+
+	g.Expect(pool.Created("unknown")).To(BeFalse())
+}
+
+func TestStarted_NotWarm(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.Add("warm-1", "")
+
+	g.Expect(pool.Claim("job1", "")).To(BeTrue())
+
+	// the job went to another runner, so the claim is settled and the warm
+	// runner is free again
+	g.Expect(pool.Started("job1", "MDg6Q2hlY2tSdW4=-1-2")).To(BeFalse())
+	g.Expect(pool.Claim("job2", "")).To(BeTrue())
+}
+
+func TestRelease(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.Add("warm-1", "")
+
+	g.Expect(pool.Claim("job1", "")).To(BeTrue())
+	g.Expect(pool.Release("job1")).To(BeTrue())
+	g.Expect(pool.Release("job1")).To(BeFalse())
+
+	g.Expect(pool.Claim("job2", "")).To(BeTrue())
+}
+
+func TestSetSizes(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := warmpool.New()
+	pool.SetSizes(map[string]int{"": 2})
+	g.Expect(pool.Reserve()).To(HaveLen(2))
+	g.Expect(pool.Size("")).To(Equal(2))
+
+	// shrinking the pool leaves the runners which are already there
+	pool.SetSizes(map[string]int{})
+	g.Expect(pool.Size("")).To(Equal(0))
+	g.Expect(pool.Reserve()).To(BeEmpty())
+	g.Expect(pool.Stats()).To(Equal([]warmpool.Stat{{Profile: "", Creating: 2}}))
+}
+
+func profiles(reserved []warmpool.Reservation) map[string]int {
+	counts := map[string]int{}
+	for _, r := range reserved {
+		counts[r.Profile]++
+	}
+
+	return counts
+}
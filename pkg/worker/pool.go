@@ -0,0 +1,223 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned by Submit when there are already as many tasks
+	// waiting as the pool allows.
+	ErrFull = errors.New("worker pool is full")
+	// ErrStopped is returned by Submit once the pool has been stopped.
+	ErrStopped = errors.New("worker pool is stopped")
+)
+
+// State is where a task is in its lifecycle.
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StateRetrying  State = "retrying"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// statusTTL is how long the status of a finished task is kept for.
+const statusTTL = time.Hour
+
+// Status describes a task which has been submitted to the pool.
+type Status struct {
+	// ID is the ID the task was submitted with
+	ID string `json:"id"`
+	// State is where the task is in its lifecycle
+	State State `json:"state"`
+	// Attempts is how many times the task has been run
+	Attempts int `json:"attempts"`
+	// Error is the error returned by the last attempt, if it failed
+	Error string `json:"error,omitempty"`
+	// UpdatedAt is when the status last changed
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type task struct {
+	id string
+	fn func() error
+	// failed is called if the task has still failed after its last attempt
+	failed func(error)
+}
+
+// Pool runs submitted tasks on a fixed number of workers, retrying any which
+// fail. It keeps the status of each task so it can be reported back to
+// whoever submitted it. It is safe for concurrent use.
+type Pool struct {
+	tasks   chan task
+	retries int
+	backoff time.Duration
+
+	// inflight counts tasks which have been submitted but not yet finished
+	inflight sync.WaitGroup
+	workers  sync.WaitGroup
+
+	mu       sync.Mutex
+	stopped  bool
+	statuses map[string]*Status
+}
+
+// New returns a new Pool which will hold up to size tasks waiting for a worker.
+// A failed task is run up to retries more times, waiting backoff multiplied by
+// the attempt number in between.
+func New(size, retries int, backoff time.Duration) *Pool {
+	return &Pool{
+		tasks:    make(chan task, size),
+		retries:  retries,
+		backoff:  backoff,
+		statuses: map[string]*Status{},
+	}
+}
+
+// Start runs the given number of workers in the background. Once ctx is done,
+// tasks which fail are no longer retried, so that they do not hold up a
+// shutdown.
+func (p *Pool) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+
+		go func() {
+			defer p.workers.Done()
+
+			for t := range p.tasks {
+				p.run(ctx, t)
+			}
+		}()
+	}
+}
+
+// Submit adds a task to the pool. It does not block, if the pool is already
+// holding as many tasks as it can then ErrFull is returned.
+func (p *Pool) Submit(id string, fn func() error) error {
+	return p.SubmitWithFailure(id, fn, nil)
+}
+
+// SubmitWithFailure is Submit, but failed is called with the last error if the
+// task has still not succeeded once it stops being retried.
+func (p *Pool) SubmitWithFailure(id string, fn func() error, failed func(error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return ErrStopped
+	}
+
+	p.pruneStatuses()
+
+	p.inflight.Add(1)
+
+	select {
+	case p.tasks <- task{id: id, fn: fn, failed: failed}:
+	default:
+		p.inflight.Done()
+		return ErrFull
+	}
+
+	p.statuses[id] = &Status{ID: id, State: StatePending, UpdatedAt: time.Now()}
+
+	return nil
+}
+
+// Status returns the status of the task with the given ID. It returns false
+// if there is no such task, or if it finished too long ago to be remembered.
+func (p *Pool) Status(id string) (Status, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.statuses[id]
+	if !ok {
+		return Status{}, false
+	}
+
+	return *s, true
+}
+
+// Wait blocks until every task submitted so far has finished.
+func (p *Pool) Wait() {
+	p.inflight.Wait()
+}
+
+// Stop stops accepting new tasks and blocks until every task already
+// submitted has finished.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+
+	p.stopped = true
+	close(p.tasks)
+	p.mu.Unlock()
+
+	p.workers.Wait()
+}
+
+func (p *Pool) run(ctx context.Context, t task) {
+	defer p.inflight.Done()
+
+	for attempt := 1; ; attempt++ {
+		p.update(t.id, StateRunning, attempt, nil)
+
+		err := t.fn()
+		if err == nil {
+			p.update(t.id, StateSucceeded, attempt, nil)
+			return
+		}
+
+		if attempt > p.retries || ctx.Err() != nil {
+			p.fail(t, attempt, err)
+			return
+		}
+
+		p.update(t.id, StateRetrying, attempt, err)
+
+		select {
+		case <-time.After(p.backoff * time.Duration(attempt)):
+		case <-ctx.Done():
+			p.fail(t, attempt, err)
+			return
+		}
+	}
+}
+
+func (p *Pool) fail(t task, attempts int, err error) {
+	p.update(t.id, StateFailed, attempts, err)
+
+	if t.failed != nil {
+		t.failed(err)
+	}
+}
+
+func (p *Pool) update(id string, state State, attempts int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &Status{ID: id, State: state, Attempts: attempts, UpdatedAt: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	p.statuses[id] = s
+}
+
+// pruneStatuses forgets about tasks which finished a while ago. The caller
+// must hold the lock.
+func (p *Pool) pruneStatuses() {
+	for id, s := range p.statuses {
+		finished := s.State == StateSucceeded || s.State == StateFailed
+		if finished && time.Since(s.UpdatedAt) > statusTTL {
+			delete(p.statuses, id)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/weaveworks-liquidmetal/microvm-action-runner/pkg/worker"
+)
+
+func Test_PoolRunsTasks(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := worker.New(10, 0, 0)
+	pool.Start(context.Background(), 2)
+	defer pool.Stop()
+
+	var ran int32
+
+	for _, id := range []string{"a", "b", "c"} {
+		g.Expect(pool.Submit(id, func() error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})).To(Succeed())
+	}
+
+	pool.Wait()
+
+	g.Expect(atomic.LoadInt32(&ran)).To(Equal(int32(3)))
+
+	status, ok := pool.Status("b")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.ID).To(Equal("b"))
+	g.Expect(status.State).To(Equal(worker.StateSucceeded))
+	g.Expect(status.Attempts).To(Equal(1))
+	g.Expect(status.Error).To(BeEmpty())
+}
+
+func Test_PoolRetriesFailedTasks(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := worker.New(10, 2, 0)
+	pool.Start(context.Background(), 1)
+	defer pool.Stop()
+
+	var attempts int32
+
+	g.Expect(pool.Submit("flaky", func() error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("not yet")
+		}
+
+		return nil
+	})).To(Succeed())
+
+	g.Expect(pool.Submit("broken", func() error {
+		return errors.New("fail")
+	})).To(Succeed())
+
+	pool.Wait()
+
+	status, ok := pool.Status("flaky")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.State).To(Equal(worker.StateSucceeded))
+	g.Expect(status.Attempts).To(Equal(3))
+
+	status, ok = pool.Status("broken")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.State).To(Equal(worker.StateFailed))
+	g.Expect(status.Attempts).To(Equal(3))
+	g.Expect(status.Error).To(Equal("fail"))
+}
+
+func Test_PoolSubmitWithFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := worker.New(10, 2, 0)
+	pool.Start(context.Background(), 1)
+	defer pool.Stop()
+
+	var (
+		attempts int32
+		failures []error
+	)
+
+	failed := func(err error) {
+		failures = append(failures, err)
+	}
+
+	g.Expect(pool.SubmitWithFailure("flaky", func() error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("not yet")
+		}
+
+		return nil
+	}, failed)).To(Succeed())
+
+	g.Expect(pool.SubmitWithFailure("broken", func() error {
+		return errors.New("fail")
+	}, failed)).To(Succeed())
+
+	pool.Wait()
+
+	// only once the task has run out of retries
+	g.Expect(failures).To(ConsistOf(MatchError("fail")))
+}
+
+func Test_PoolFull(t *testing.T) {
+	g := NewWithT(t)
+
+	// no workers are started, so nothing is taken off the pool
+	pool := worker.New(1, 0, 0)
+
+	g.Expect(pool.Submit("a", func() error { return nil })).To(Succeed())
+	g.Expect(pool.Submit("b", func() error { return nil })).To(MatchError(worker.ErrFull))
+
+	status, ok := pool.Status("a")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.State).To(Equal(worker.StatePending))
+
+	_, ok = pool.Status("b")
+	g.Expect(ok).To(BeFalse())
+}
+
+func Test_PoolStopFinishesSubmittedTasks(t *testing.T) {
+	g := NewWithT(t)
+
+	pool := worker.New(10, 0, 0)
+
+	var ran int32
+
+	for _, id := range []string{"a", "b"} {
+		g.Expect(pool.Submit(id, func() error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})).To(Succeed())
+	}
+
+	pool.Start(context.Background(), 1)
+	pool.Stop()
+
+	g.Expect(atomic.LoadInt32(&ran)).To(Equal(int32(2)))
+	g.Expect(pool.Submit("c", func() error { return nil })).To(MatchError(worker.ErrStopped))
+}
+
+func Test_PoolStopsRetryingWhenCancelled(t *testing.T) {
+	g := NewWithT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pool := worker.New(10, 5, time.Hour)
+	pool.Start(ctx, 1)
+	defer pool.Stop()
+
+	failed := make(chan struct{})
+
+	g.Expect(pool.Submit("failing", func() error {
+		close(failed)
+		return errors.New("fail")
+	})).To(Succeed())
+
+	<-failed
+	cancel()
+
+	// the task gives up rather than waiting out its backoff
+	pool.Wait()
+
+	status, ok := pool.Status("failing")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(status.State).To(Equal(worker.StateFailed))
+	g.Expect(status.Attempts).To(Equal(1))
+	g.Expect(status.Error).To(Equal("fail"))
+}